@@ -253,6 +253,21 @@ func (b *counterBehavior) Recover(err interface{}, e Event) {}
 // Stop the behavior.
 func (b *counterBehavior) Stop() {}
 
+// Snapshot returns the counters.
+func (b *counterBehavior) Snapshot() ([]byte, error) {
+	return encodeState(b.counters)
+}
+
+// Restore sets the counters.
+func (b *counterBehavior) Restore(data []byte) error {
+	counters := make(map[string]int64)
+	if err := decodeState(data, &counters); err != nil {
+		return err
+	}
+	b.counters = counters
+	return nil
+}
+
 //--------------------
 // THRESHOLD BEHAVIOR
 //--------------------
@@ -375,4 +390,14 @@ func (b *thresholdBehavior) Recover(err interface{}, e Event) {
 // Stop the behavior.
 func (b *thresholdBehavior) Stop() {}
 
+// Snapshot returns the counter.
+func (b *thresholdBehavior) Snapshot() ([]byte, error) {
+	return encodeState(b.counter)
+}
+
+// Restore sets the counter.
+func (b *thresholdBehavior) Restore(data []byte) error {
+	return decodeState(data, &b.counter)
+}
+
 // EOF
@@ -96,6 +96,47 @@ type PoolableBehavior interface {
 	PoolConfig() (poolSize int, stateful bool)
 }
 
+// OverflowStrategy defines how events are handled if the
+// queue of a cell is full.
+type OverflowStrategy int
+
+const (
+	// OverflowBlock lets the emitter wait until the queue has space.
+	// If there's still no space after five seconds the event is
+	// dropped and a QueueFullError is returned.
+	OverflowBlock OverflowStrategy = iota
+	// OverflowDrop drops the new event.
+	OverflowDrop
+	// OverflowFail drops the new event and returns a QueueFullError.
+	OverflowFail
+)
+
+// BoundedBehavior is the interface for behaviors which want
+// to limit the queue of their cell.
+type BoundedBehavior interface {
+	QueueConfig() (limit int, strategy OverflowStrategy)
+}
+
+// RestartPolicy defines when a cell replaces its behavior by a fresh
+// one created by its behavior factory and how often this may happen.
+type RestartPolicy struct {
+	// Panics is the number of consecutive panics leading to a restart,
+	// values below one mean the first panic.
+	Panics int
+	// Intensity is the maximum number of restarts within the period,
+	// values below one mean one restart. If it is exceeded the cell
+	// gives up and is removed from the environment.
+	Intensity int
+	// Period is the duration the restarts are counted in.
+	Period time.Duration
+}
+
+// SupervisedBehavior is the interface for behaviors which want
+// their cell to be restarted after panics.
+type SupervisedBehavior interface {
+	RestartPolicy() RestartPolicy
+}
+
 // BehaviorFactory is a function that creates a behavior instance.
 type BehaviorFactory func() Behavior
 
@@ -105,43 +146,54 @@ type BehaviorFactoryMap map[Id]BehaviorFactory
 // poolBehavior manages a pool of behaviors and distributes the
 // received events round robin.
 type poolBehavior struct {
+	poolSize int
+	stateful bool
+	behavior Behavior
+	factory  BehaviorFactory
 	cellPool chan *cell
 }
 
 // newPoolBehavior creates a new pool behavior with the passed size and
-// the already created first behavior instance. It then creates the rest 
-// of the behavior instances.
-func newPoolBehavior(env *Environment, id Id, poolSize int, stateful bool, b Behavior, bf BehaviorFactory) (Behavior, error) {
-	pb := &poolBehavior{make(chan *cell, poolSize)}
-	c, err := newCell(env, id, b)
-	if err != nil {
-		return nil, err
+// the already created first behavior instance, which may be nil. The
+// rest of the behavior instances are created when the pool is initialized.
+func newPoolBehavior(poolSize int, stateful bool, b Behavior, bf BehaviorFactory) Behavior {
+	return &poolBehavior{poolSize: poolSize, stateful: stateful, behavior: b, factory: bf}
+}
+
+// newPoolBehaviorFactory creates a factory for pool behaviors, so
+// that restarted cells are pooled again.
+func newPoolBehaviorFactory(poolSize int, stateful bool, bf BehaviorFactory) BehaviorFactory {
+	return func() Behavior {
+		return newPoolBehavior(poolSize, stateful, nil, bf)
+	}
+}
+
+// Init the behavior by creating the cells for the buffer.
+func (b *poolBehavior) Init(env *Environment, id Id) error {
+	if b.behavior == nil {
+		b.behavior = b.factory()
 	}
-	pb.cellPool <- c
-	for i := 1; i < poolSize; i++ {
-		if stateful {
+	b.cellPool = make(chan *cell, b.poolSize)
+	for i := 0; i < b.poolSize; i++ {
+		behavior := b.behavior
+		if i > 0 && b.stateful {
 			// Stateful, so multiple instances.
-			c, err = newCell(env, id, bf())
-		} else {
-			// Not stateful, the pool is sharing only one instance.
-			c, err = newCell(env, id, b)
+			behavior = b.factory()
 		}
+		c, err := newCell(env, id, behavior)
 		if err != nil {
-			return nil, err
+			b.Stop()
+			return err
 		}
-		pb.cellPool <- c
+		b.cellPool <- c
 	}
-	return pb, nil
-}
-
-// Init the behavior by creating the cells for the buffer.
-func (b *poolBehavior) Init(env *Environment, id Id) error {
 	return nil
 }
 
 // ProcessEvent processes an event.
 func (b *poolBehavior) ProcessEvent(e Event, emitter EventEmitter) {
 	c := <-b.cellPool
+	e.Context().incrActivity()
 	c.processEvent(e)
 	b.cellPool <- c
 }
@@ -151,7 +203,7 @@ func (b *poolBehavior) Recover(err interface{}, e Event) {}
 
 // Stop the behavior, which means to stop all pooled cells.
 func (b *poolBehavior) Stop() {
-	for i := 0; i < len(b.cellPool); i++ {
+	for len(b.cellPool) > 0 {
 		c := <-b.cellPool
 		c.stop()
 	}
@@ -165,6 +217,12 @@ func (b *poolBehavior) Stop() {
 // SubscriptionMap is a map of emitter ids to subscribed ids.
 type SubscriptionMap map[Id][]Id
 
+// SystemCellId is the id of the cell receiving the system events of
+// an environment like the RestartEvent in their order. It has to be
+// added with AddSystemCell, e.g. with a broadcast behavior for other
+// cells to subscribe. Other cells can't use this id.
+const SystemCellId Id = "system"
+
 // Environment defines a common set of cells.
 type Environment struct {
 	mutex         sync.RWMutex
@@ -172,15 +230,18 @@ type Environment struct {
 	configuration *config.Configuration
 	cells         cellMap
 	tickers       map[Id]*ticker
+	systemEvents  *cellMessageQueue
 }
 
 // NewEnvironment creates a new environment.
 func NewEnvironment(id Id) *Environment {
 	env := &Environment{
-		id:      id,
-		cells:   make(cellMap),
-		tickers: make(map[Id]*ticker),
+		id:           id,
+		cells:        make(cellMap),
+		tickers:      make(map[Id]*ticker),
+		systemEvents: newBoundedCellMessageQueue(SystemCellId, 0, OverflowBlock),
 	}
+	go env.systemLoop()
 	runtime.SetFinalizer(env, (*Environment).Shutdown)
 	return env
 }
@@ -195,11 +256,41 @@ func (env *Environment) Configuration() *config.Configuration {
 	return env.configuration
 }
 
-// AddCell adds a cell with a given id and its behavior factory.
+// AddCell adds a cell with a given id and its behavior factory. The
+// queue of the cell is unlimited if the behavior doesn't implement
+// BoundedBehavior, it's not restarted if the behavior doesn't
+// implement SupervisedBehavior.
 func (env *Environment) AddCell(id Id, bf BehaviorFactory) (Behavior, error) {
 	env.mutex.Lock()
 	defer env.mutex.Unlock()
-	return env.startCell(id, bf)
+	return env.startCell(id, bf, 0, OverflowBlock, nil)
+}
+
+// AddBoundedCell adds a cell like AddCell but limits its queue to the
+// given number of events. Overflows are handled by the strategy.
+func (env *Environment) AddBoundedCell(id Id, bf BehaviorFactory, limit int, strategy OverflowStrategy) (Behavior, error) {
+	env.mutex.Lock()
+	defer env.mutex.Unlock()
+	return env.startCell(id, bf, limit, strategy, nil)
+}
+
+// AddSupervisedCell adds a cell like AddCell but restarts it with a
+// fresh behavior created by the factory according to the policy if
+// its behavior fails to initialize or panics. Subscribers and
+// subscriptions of the cell are kept. Each restart is signalled to
+// the system cell by a RestartEvent.
+func (env *Environment) AddSupervisedCell(id Id, bf BehaviorFactory, policy RestartPolicy) (Behavior, error) {
+	env.mutex.Lock()
+	defer env.mutex.Unlock()
+	return env.startCell(id, bf, 0, OverflowBlock, &policy)
+}
+
+// AddSystemCell adds the cell with the SystemCellId and the behavior
+// factory. Otherwise it's a cell like those added with AddCell.
+func (env *Environment) AddSystemCell(bf BehaviorFactory) (Behavior, error) {
+	env.mutex.Lock()
+	defer env.mutex.Unlock()
+	return env.createCell(SystemCellId, bf, 0, OverflowBlock, nil)
 }
 
 // AddCell adds a number of cells with a given ids and their behavior factories.
@@ -207,35 +298,54 @@ func (env *Environment) AddCells(bfm BehaviorFactoryMap) error {
 	env.mutex.Lock()
 	defer env.mutex.Unlock()
 	for id, bf := range bfm {
-		if _, err := env.startCell(id, bf); err != nil {
+		if _, err := env.startCell(id, bf, 0, OverflowBlock, nil); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-// startCell starts the cell with the behavior returned by the behavior factory.
-func (env *Environment) startCell(id Id, bf BehaviorFactory) (Behavior, error) {
+// startCell starts the cell with the behavior returned by the behavior
+// factory. The SystemCellId is refused, it's reserved for AddSystemCell.
+func (env *Environment) startCell(id Id, bf BehaviorFactory, limit int, strategy OverflowStrategy, policy *RestartPolicy) (Behavior, error) {
+	if id == SystemCellId {
+		return nil, CellIdReservedError{id}
+	}
+	return env.createCell(id, bf, limit, strategy, policy)
+}
+
+// createCell creates the cell with the behavior returned by the behavior
+// factory. Restarted pooled behaviors are pooled again.
+func (env *Environment) createCell(id Id, bf BehaviorFactory, limit int, strategy OverflowStrategy, policy *RestartPolicy) (Behavior, error) {
 	if _, ok := env.cells[id]; ok {
 		return nil, CellAlreadyExistsError{id}
 	}
-	// Check poolability.
+	// Check queue limit.
 	behavior := bf()
+	if bb, ok := behavior.(BoundedBehavior); ok && limit <= 0 {
+		limit, strategy = bb.QueueConfig()
+	}
+	// Check restart policy.
+	if sb, ok := behavior.(SupervisedBehavior); ok && policy == nil {
+		p := sb.RestartPolicy()
+		policy = &p
+	}
+	// Check poolability.
 	if pb, ok := behavior.(PoolableBehavior); ok {
-		var err error
 		poolSize, stateful := pb.PoolConfig()
-		behavior, err = newPoolBehavior(env, id, poolSize, stateful, behavior, bf)
-		if err != nil {
-			return nil, err
+		if poolSize < 1 {
+			poolSize = 1
 		}
+		behavior = newPoolBehavior(poolSize, stateful, behavior, bf)
+		bf = newPoolBehaviorFactory(poolSize, stateful, bf)
 	}
 	// Create cell.
-	c, err := newCell(env, id, behavior)
+	c, err := newSupervisedCell(env, id, behavior, limit, strategy, bf, policy)
 	if err != nil {
 		return nil, err
 	}
 	env.cells[id] = c
-	return behavior, nil
+	return c.currentBehavior(), nil
 }
 
 // RemoveCell removes the cell with the given id.
@@ -248,6 +358,18 @@ func (env *Environment) RemoveCell(id Id) {
 	}
 }
 
+// removeRegisteredCell removes the cell if it's still registered. It's
+// used by cells which give up after too many restarts and to roll back
+// failed restores.
+func (env *Environment) removeRegisteredCell(c *cell) {
+	env.mutex.Lock()
+	defer env.mutex.Unlock()
+	if env.cells[c.id] == c {
+		delete(env.cells, c.id)
+		c.stop()
+	}
+}
+
 // HasCell returns true if the cell with the given id exists.
 func (env *Environment) HasCell(id Id) bool {
 	env.mutex.RLock()
@@ -261,7 +383,7 @@ func (env *Environment) CellBehavior(id Id) (Behavior, error) {
 	env.mutex.RLock()
 	defer env.mutex.RUnlock()
 	if c, ok := env.cells[id]; ok {
-		return c.behavior, nil
+		return c.currentBehavior(), nil
 	}
 	return nil, CellDoesNotExistError{id}
 }
@@ -314,7 +436,19 @@ func (env *Environment) Unsubscribe(emitterId Id, unsubscriberIds ...Id) error {
 
 // Emit emits an event to the cell with a given id and returns its
 // (possibly new created) context.
-func (env *Environment) Emit(id Id, e Event) (ctx *Context, err error) {
+func (env *Environment) Emit(id Id, e Event) (*Context, error) {
+	return env.emit(id, e, time.Time{})
+}
+
+// EmitWithDeadline emits an event like Emit. The processing of the
+// context is canceled when the deadline has passed.
+func (env *Environment) EmitWithDeadline(id Id, e Event, deadline time.Time) (*Context, error) {
+	return env.emit(id, e, deadline)
+}
+
+// emit emits an event to the cell with a given id. A new context
+// is created if the event has none, a non-zero deadline is set.
+func (env *Environment) emit(id Id, e Event, deadline time.Time) (ctx *Context, err error) {
 	defer func() {
 		if err != nil {
 			applog.Errorf("can't emit topic %q to %q: %v", e.Topic(), id, err)
@@ -326,14 +460,22 @@ func (env *Environment) Emit(id Id, e Event) (ctx *Context, err error) {
 		c, ok := env.cells[id]
 		env.mutex.RUnlock()
 		if ok {
-			if e.Context() == nil {
-				e.SetContext(newContext())
+			// Prepare the context before the event is handed over,
+			// afterwards it's owned by the cell.
+			ctx = e.Context()
+			if ctx == nil {
+				ctx = NewContext()
+				e.SetContext(ctx)
+			} else {
+				ctx.incrActivity()
+			}
+			if !deadline.IsZero() {
+				ctx.SetDeadline(deadline)
 			}
-			e.Context().incrActivity()
 			if err := c.processEvent(e); err != nil {
 				return nil, err
 			}
-			return e.Context(), nil
+			return ctx, nil
 		}
 		// Wait an increasing time befor retry, max 5 seconds.
 		if sleep <= 5000 {
@@ -349,6 +491,32 @@ func (env *Environment) EmitSimple(id Id, t string, p interface{}) (*Context, er
 	return env.Emit(id, NewSimpleEvent(t, p))
 }
 
+// emitSystemEvent queues the event for the system cell. It doesn't
+// wait for the environment, so it can be used inside of cells.
+func (env *Environment) emitSystemEvent(e Event) {
+	env.systemEvents.push(e, nil, false)
+}
+
+// systemLoop passes the queued system events in their order
+// to the system cell if it exists.
+func (env *Environment) systemLoop() {
+	for {
+		message := env.systemEvents.pull()
+		if message.event == nil {
+			// Stop the loop.
+			env.systemEvents.close()
+			return
+		}
+		env.mutex.RLock()
+		c, ok := env.cells[SystemCellId]
+		env.mutex.RUnlock()
+		if ok {
+			message.event.SetContext(NewContext())
+			c.processEvent(message.event)
+		}
+	}
+}
+
 // AddTicker adds a new ticker for periodical ticker events with the given
 // id to the emitId.
 func (env *Environment) AddTicker(id, emitId Id, period time.Duration) error {
@@ -375,6 +543,8 @@ func (env *Environment) RemoveTicker(id Id) error {
 
 // Shutdown manages the proper finalization of an environment.
 func (env *Environment) Shutdown() error {
+	// Stop passing system events.
+	env.systemEvents.push(nil, nil, false)
 	// Stop all tickers.
 	for _, ticker := range env.tickers {
 		ticker.stop()
@@ -401,9 +571,21 @@ type EventEmitter interface {
 	EmitSimple(topic string, payload interface{})
 }
 
-// cellEventEmitter implements EventEmitter for the processing
-// of an event in a cell.
+// SelectiveEventEmitter is an EventEmitter which also can emit
+// events to selected subscribers. It's needed by the routing
+// behaviors.
+type SelectiveEventEmitter interface {
+	EventEmitter
+	// EmitTo emits an event only to those subscribers with the given ids.
+	EmitTo(e Event, ids ...Id)
+	// Subscribers returns the sorted ids of the subscribers.
+	Subscribers() []Id
+}
+
+// cellEventEmitter implements SelectiveEventEmitter for the
+// processing of an event in a cell.
 type cellEventEmitter struct {
+	cell    *cell
 	cells   cellMap
 	context *Context
 }
@@ -411,17 +593,7 @@ type cellEventEmitter struct {
 // Emit emits an event to the subscribers of a cell. It passes
 // the context to that event.
 func (cee *cellEventEmitter) Emit(e Event) {
-	e.SetContext(cee.context)
-	e.Context().incrActivity()
-	erroneousSubscriberIds := []Id{}
-	for id, sc := range cee.cells {
-		if err := sc.processEvent(e); err != nil {
-			erroneousSubscriberIds = append(erroneousSubscriberIds, id)
-		}
-	}
-	for _, id := range erroneousSubscriberIds {
-		delete(cee.cells, id)
-	}
+	cee.emit(e, cee.cells)
 }
 
 // EmitSimple emits convieniently a simple event to the subscribers
@@ -430,34 +602,116 @@ func (cee *cellEventEmitter) EmitSimple(topic string, payload interface{}) {
 	cee.Emit(NewSimpleEvent(topic, payload))
 }
 
+// EmitTo emits an event to those subscribers of a cell with the
+// given ids. Other ids are ignored.
+func (cee *cellEventEmitter) EmitTo(e Event, ids ...Id) {
+	cells := make(cellMap)
+	for _, id := range ids {
+		if sc, ok := cee.cells[id]; ok {
+			cells[id] = sc
+		}
+	}
+	if len(cells) > 0 {
+		cee.emit(e, cells)
+	}
+}
+
+// Subscribers returns the sorted ids of the subscribers of a cell.
+func (cee *cellEventEmitter) Subscribers() []Id {
+	return cee.cells.ids()
+}
+
+// emitInContext emits the event in the context instead of the one of
+// the emitter if it's a cell event emitter and the context isn't nil.
+// Otherwise the event is emitted like with Emit.
+func emitInContext(emitter EventEmitter, e Event, ctx *Context) {
+	if cee, ok := emitter.(*cellEventEmitter); ok && ctx != nil {
+		emitter = &cellEventEmitter{cee.cell, cee.cells, ctx}
+	}
+	emitter.Emit(e)
+}
+
+// emit emits an event to the cells and passes the context to it.
+// Nothing is emitted if the context is canceled. Cells with closed
+// queues are removed from the subscribers.
+func (cee *cellEventEmitter) emit(e Event, cells cellMap) {
+	if cee.context.Canceled() {
+		return
+	}
+	e.SetContext(cee.context)
+	erroneousSubscriberIds := []Id{}
+	for id, sc := range cells {
+		cee.context.incrActivity()
+		if err := sc.processEvent(e); IsQueueClosedError(err) {
+			erroneousSubscriberIds = append(erroneousSubscriberIds, id)
+		}
+	}
+	if len(erroneousSubscriberIds) > 0 {
+		cee.cell.removeSubscribers(erroneousSubscriberIds)
+	}
+}
+
 //--------------------
 // CELL
 //--------------------
 
 // cell for event processing.
 type cell struct {
+	mutex       sync.RWMutex
 	env         *Environment
 	id          Id
 	behavior    Behavior
+	factory     BehaviorFactory
+	policy      *RestartPolicy
+	restarts    *restartFrequency
+	panics      int
+	broken      bool
 	subscribers cellMap
 	queue       *cellMessageQueue
 	measuringId string
+	droppedId   string
+	config      *CellConfig
 }
 
 // newCell create a new cell around a behavior.
 func newCell(env *Environment, id Id, b Behavior) (*cell, error) {
+	return newBoundedCell(env, id, b, 0, OverflowBlock)
+}
+
+// newBoundedCell creates a new cell around a behavior with a queue
+// limited to the number of events. A limit of zero or less means
+// unlimited.
+func newBoundedCell(env *Environment, id Id, b Behavior, limit int, strategy OverflowStrategy) (*cell, error) {
+	return newSupervisedCell(env, id, b, limit, strategy, nil, nil)
+}
+
+// newSupervisedCell creates a new cell like newBoundedCell. If a
+// restart policy is passed the cell is restarted with new behaviors
+// created by the factory.
+func newSupervisedCell(env *Environment, id Id, b Behavior, limit int, strategy OverflowStrategy, bf BehaviorFactory, policy *RestartPolicy) (*cell, error) {
 	c := &cell{
 		env:         env,
 		id:          id,
-		behavior:    b,
+		factory:     bf,
+		policy:      policy,
 		subscribers: make(cellMap),
-		queue:       newCellMessageQueue(),
+		queue:       newBoundedCellMessageQueue(id, limit, strategy),
 		measuringId: identifier.Identifier("cells", env.id, "cell", identifier.TypeAsIdentifierPart(b)),
+		droppedId:   identifier.Identifier("cells", env.id, "cell", id, "dropped"),
+	}
+	if policy != nil {
+		c.restarts = newRestartFrequency(policy.Intensity, policy.Period)
+	}
+	if limit > 0 {
+		// Don't count the drops of a former cell with the same id.
+		monitoring.SetVariable(c.droppedId, 0)
 	}
 	// Init behavior.
-	if err := b.Init(env, id); err != nil {
+	b, err := c.initBehavior(b)
+	if err != nil {
 		return nil, CellInitError{id, err}
 	}
+	c.behavior = b
 	go c.processLoop()
 	monitoring.IncrVariable(identifier.Identifier("cells", c.env.id, "total-cells"))
 	monitoring.IncrVariable(c.measuringId)
@@ -471,45 +725,168 @@ func (c *cell) stop() {
 
 // changeSubscriptions tells the cell to change subscribers.
 func (c *cell) changeSubscriptions(add bool, cells cellMap) error {
-	return c.queue.push(nil, cells, add)
+	_, err := c.queue.push(nil, cells, add)
+	return err
 }
 
-// processEvent tells the cell to handle an event.
+// processEvent tells the cell to handle an event. Dropped events
+// are counted and like not queued ones don't keep their context
+// active.
 func (c *cell) processEvent(e Event) error {
-	return c.queue.push(e, nil, false)
+	ctx := e.Context()
+	dropped, err := c.queue.push(e, nil, false)
+	if dropped {
+		monitoring.IncrVariable(c.droppedId)
+	}
+	if (dropped || err != nil) && ctx != nil {
+		ctx.decrActivity()
+	}
+	return err
+}
+
+// currentBehavior returns the behavior, which may change
+// when the cell is restarted.
+func (c *cell) currentBehavior() Behavior {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.behavior
+}
+
+// initBehavior initializes the behavior. If this fails and the
+// cell is supervised new behaviors are created by the factory
+// until one succeeds or the restart frequency is exceeded.
+func (c *cell) initBehavior(b Behavior) (Behavior, error) {
+	err := b.Init(c.env, c.id)
+	for err != nil && c.policy != nil {
+		applog.Errorf("cell %q can't initialize: %v", c.id, err)
+		if ferr := c.restarts.check(c.id); ferr != nil {
+			return nil, ferr
+		}
+		b = c.factory()
+		err = b.Init(c.env, c.id)
+	}
+	return b, err
+}
+
+// panicked counts the consecutive panics and restarts the
+// cell if its restart policy demands it.
+func (c *cell) panicked(reason interface{}) {
+	if c.policy == nil {
+		return
+	}
+	c.panics++
+	if c.panics < c.policy.Panics {
+		return
+	}
+	c.panics = 0
+	c.restart(reason)
+}
+
+// restart replaces the behavior by a new one created by the factory.
+// If the restart frequency is exceeded the cell gives up and removes
+// itself from the environment.
+func (c *cell) restart(reason interface{}) {
+	c.behavior.Stop()
+	err := c.restarts.check(c.id)
+	var b Behavior
+	if err == nil {
+		b, err = c.initBehavior(c.factory())
+	}
+	if err != nil {
+		applog.Errorf("cell %q gives up: %v", c.id, err)
+		c.broken = true
+		c.env.emitSystemEvent(&RestartEvent{c.id, err, true, nil})
+		go c.env.removeRegisteredCell(c)
+		return
+	}
+	c.mutex.Lock()
+	c.behavior = b
+	c.mutex.Unlock()
+	applog.Infof("cell %q restarted after: %v", c.id, reason)
+	c.env.emitSystemEvent(&RestartEvent{c.id, reason, false, nil})
+}
+
+// do executes f inside the cell between the processing of
+// two events and waits until it's done. It returns a
+// QueueClosedError if the cell is already stopping.
+func (c *cell) do(f func()) error {
+	done := make(chan bool)
+	err := c.queue.pushDo(func() {
+		f()
+		done <- true
+	})
+	if err != nil {
+		return err
+	}
+	<-done
+	return nil
+}
+
+// subscriberIds returns the sorted ids of the subscribers. The
+// subscribers are only changed inside the cell and while holding
+// the mutex, so they can be read from outside.
+func (c *cell) subscriberIds() []Id {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.subscribers.ids()
+}
+
+// changeSubscribers adds or removes the subscribers. It
+// has to be called inside the cell.
+func (c *cell) changeSubscribers(add bool, cells cellMap) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for id, sc := range cells {
+		if add {
+			c.subscribers[id] = sc
+		} else {
+			delete(c.subscribers, id)
+		}
+	}
+}
+
+// removeSubscribers removes the subscribers with the ids. It
+// has to be called inside the cell.
+func (c *cell) removeSubscribers(ids []Id) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, id := range ids {
+		delete(c.subscribers, id)
+	}
 }
 
 // processLoop is the backend for the processing of events.
 func (c *cell) processLoop() {
+loop:
 	for {
 		message := c.queue.pull()
 		switch {
 		case message.event != nil:
 			// Process the event.
 			c.process(message.event)
+		case message.do != nil:
+			// Execute a function inside the cell.
+			message.do()
 		case message.cells != nil:
 			// Change the subscriptions.
-			for id, sc := range message.cells {
-				if message.add {
-					c.subscribers[id] = sc
-				} else {
-					delete(c.subscribers, id)
-				}
-			}
+			c.changeSubscribers(message.add, message.cells)
 		case message.event == nil && message.cells == nil:
 			// Stop the cell.
 			c.queue.close()
-			break
+			break loop
 		}
 	}
 	monitoring.DecrVariable(c.measuringId)
 	monitoring.DecrVariable(identifier.Identifier("cells", c.env.id, "total-cells"))
-	c.behavior.Stop()
+	if !c.broken {
+		c.behavior.Stop()
+	}
 }
 
 // process encapsulates event processing including error 
 // recovery and measuring.
 func (c *cell) process(e Event) {
+	defer e.Context().decrActivity()
 	// Error recovering.
 	defer func() {
 		if r := recover(); r != nil {
@@ -519,15 +896,23 @@ func (c *cell) process(e Event) {
 			} else {
 				applog.Errorf("cell %q has error '%v'", c.id, r)
 			}
+			e.Context().setError(c.id, r)
 			c.behavior.Recover(r, e)
+			c.panicked(r)
 		}
 	}()
-	defer e.Context().decrActivity()
+	if c.broken || e.Context().Canceled() {
+		// Gave up after too many restarts or the
+		// processing has been canceled.
+		return
+	}
+	e.Context().contribute(c.id)
 	// Handle the event inside a measuring.
 	measuring := monitoring.BeginMeasuring(c.measuringId)
-	emitter := &cellEventEmitter{c.subscribers, e.Context()}
+	emitter := &cellEventEmitter{c, c.subscribers, e.Context()}
 	c.behavior.ProcessEvent(e, emitter)
 	measuring.EndMeasuring()
+	c.panics = 0
 }
 
 // EOF
@@ -13,8 +13,12 @@ package cells
 
 import (
 	"github.com/denkhaus/tcgl/asserts"
+	"github.com/denkhaus/tcgl/monitoring"
+	"bytes"
+	"fmt"
 	"testing"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -28,6 +32,173 @@ func Counter(e Event) []string {
 	return []string{e.Topic()}
 }
 
+// faultyBehavior panics on the topic "panic" and emits the
+// number of processed events otherwise. Its initialization
+// fails as long as the counter of failing inits is positive.
+// The optional stops counter is atomically incremented when it's
+// stopped.
+type faultyBehavior struct {
+	failingInits *int
+	stops        *int64
+	processed    int
+}
+
+// Init the behavior.
+func (b *faultyBehavior) Init(env *Environment, id Id) error {
+	if *b.failingInits > 0 {
+		*b.failingInits--
+		return fmt.Errorf("init failed")
+	}
+	return nil
+}
+
+// ProcessEvent processes an event.
+func (b *faultyBehavior) ProcessEvent(e Event, emitter EventEmitter) {
+	if e.Topic() == "panic" {
+		panic("faulty behavior")
+	}
+	b.processed++
+	emitter.EmitSimple("processed", b.processed)
+}
+
+// Recover from an error.
+func (b *faultyBehavior) Recover(err interface{}, e Event) {}
+
+// Stop the behavior.
+func (b *faultyBehavior) Stop() {
+	if b.stops != nil {
+		atomic.AddInt64(b.stops, 1)
+	}
+}
+
+// pooledFaultyBehavior is a faulty behavior in a pool of two.
+type pooledFaultyBehavior struct {
+	faultyBehavior
+}
+
+// PoolConfig returns the pool size and that it's stateful.
+func (b *pooledFaultyBehavior) PoolConfig() (int, bool) {
+	return 2, true
+}
+
+// cellAddingBehavior adds a cell with the topic of
+// the event as id after a short delay.
+type cellAddingBehavior struct {
+	env *Environment
+}
+
+// Init the behavior.
+func (b *cellAddingBehavior) Init(env *Environment, id Id) error {
+	b.env = env
+	return nil
+}
+
+// ProcessEvent processes an event.
+func (b *cellAddingBehavior) ProcessEvent(e Event, emitter EventEmitter) {
+	time.Sleep(20 * time.Millisecond)
+	b.env.AddCell(Id(e.Topic()), BroadcastBehaviorFactory)
+}
+
+// Recover from an error.
+func (b *cellAddingBehavior) Recover(err interface{}, e Event) {}
+
+// Stop the behavior.
+func (b *cellAddingBehavior) Stop() {}
+
+// countingEventEmitter is an EventEmitter only counting
+// the emitted events.
+type countingEventEmitter struct {
+	count int
+}
+
+// Emit counts the event.
+func (cee *countingEventEmitter) Emit(e Event) {
+	cee.count++
+}
+
+// EmitSimple counts the simple event.
+func (cee *countingEventEmitter) EmitSimple(topic string, payload interface{}) {
+	cee.count++
+}
+
+// recordingEventEmitter is an EventEmitter recording
+// the emitted events.
+type recordingEventEmitter struct {
+	events []Event
+}
+
+// Emit records the event.
+func (ree *recordingEventEmitter) Emit(e Event) {
+	ree.events = append(ree.events, e)
+}
+
+// EmitSimple records the simple event.
+func (ree *recordingEventEmitter) EmitSimple(topic string, payload interface{}) {
+	ree.Emit(NewSimpleEvent(topic, payload))
+}
+
+// waitFor polls the condition until it's true or a deadline
+// has passed. It returns the last result of the condition.
+func waitFor(condition func() bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+// waitForEvents waits until the collector cell with the id has
+// collected at least count events and returns them. The events
+// are read inside the cell to not race with the collecting.
+func waitForEvents(env *Environment, id Id, count int) []Event {
+	return pollCollector(env, id, count, false)
+}
+
+// takeEvents waits for the events like waitForEvents and
+// resets the collector when returning them.
+func takeEvents(env *Environment, id Id, count int) []Event {
+	return pollCollector(env, id, count, true)
+}
+
+// settle waits until the cells with the ids, passed in the order
+// of the event flow, have processed all events queued so far.
+func settle(env *Environment, ids ...Id) {
+	for _, id := range ids {
+		env.mutex.RLock()
+		c, ok := env.cells[id]
+		env.mutex.RUnlock()
+		if ok {
+			c.do(func() {})
+		}
+	}
+}
+
+// pollCollector polls the collector cell with the id until it
+// has collected count events and optionally resets it then.
+func pollCollector(env *Environment, id Id, count int, reset bool) []Event {
+	var events []Event
+	waitFor(func() bool {
+		env.mutex.RLock()
+		c, ok := env.cells[id]
+		env.mutex.RUnlock()
+		if !ok {
+			return false
+		}
+		c.do(func() {
+			collector := c.currentBehavior().(EventCollector)
+			events = collector.Events()
+			if reset && len(events) >= count {
+				collector.Reset()
+			}
+		})
+		return len(events) >= count
+	})
+	return events
+}
+
 //--------------------
 // TESTS
 //--------------------
@@ -37,7 +208,7 @@ func TestContext(t *testing.T) {
 	assert := asserts.NewTestingAsserts(t, true)
 
 	// Check setting and getting.
-	c := newContext()
+	c := NewContext()
 	c.Set("foo", 4711)
 	c.Set("bar", "BAR")
 	i, err := c.Get("foo")
@@ -175,6 +346,14 @@ func TestRemoveCell(t *testing.T) {
 	assert.Nil(err, "Add cell A after removal.")
 	assert.NotNil(counterA, "Add cell A after removal.")
 
+	// Stopping cells don't accept functions anymore.
+	c := env.cells["counter-a"]
+	env.RemoveCell("counter-a")
+	err = c.do(func() {})
+	assert.True(IsQueueClosedError(err), "Function rejected by stopping cell.")
+	_, err = c.queue.push(NewSimpleEvent("a", true), nil, false)
+	assert.True(IsQueueClosedError(err), "Event rejected by stopping cell.")
+
 	err = env.Shutdown()
 	assert.Nil(err, "No error during shutdown.")
 }
@@ -394,4 +573,920 @@ func TestCounterBehavior(t *testing.T) {
 	assert.Equal(events[3].Payload().(int64), int64(2), "Fourth result is ok.")
 }
 
+// TestBoundedCell tests the overflow strategies of limited cell queues.
+func TestBoundedCell(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	env := NewEnvironment("bounded-cell")
+	defer env.Shutdown()
+
+	release := make(chan bool)
+	saf := func(e Event, emitter EventEmitter) {
+		<-release
+		emitter.Emit(e)
+	}
+	env.AddBoundedCell("drop", NewSimpleActionBehaviorFactory(saf), 2, OverflowDrop)
+	env.AddBoundedCell("fail", NewSimpleActionBehaviorFactory(saf), 2, OverflowFail)
+	env.AddBoundedCell("block", NewSimpleActionBehaviorFactory(saf), 2, OverflowBlock)
+	env.AddCell("collector", CollectorBehaviorFactory)
+	env.Subscribe("drop", "collector")
+
+	// Drop events if the queue is full.
+	for i := 0; i < 5; i++ {
+		_, err := env.EmitSimple("drop", "drop", i)
+		assert.Nil(err, "No error when dropping.")
+		if i == 0 {
+			waitFor(func() bool { return env.cells["drop"].queue.length() == 0 })
+		}
+	}
+	for i := 0; i < 3; i++ {
+		release <- true
+	}
+	events := waitForEvents(env, "collector", 3)
+	assert.Length(events, 3, "Processing and queued events received.")
+	var dropped *monitoring.StaySetVariable
+	waitFor(func() bool {
+		dropped, _ = monitoring.ReadVariable(env.cells["drop"].droppedId)
+		return dropped != nil && dropped.ActValue == 2
+	})
+	assert.NotNil(dropped, "Dropped events are counted.")
+	assert.Equal(dropped.ActValue, int64(2), "Two events dropped.")
+
+	// Fail if the queue is full.
+	for i := 0; i < 3; i++ {
+		_, err := env.EmitSimple("fail", "fail", i)
+		assert.Nil(err, "No error while queue has space.")
+		if i == 0 {
+			waitFor(func() bool { return env.cells["fail"].queue.length() == 0 })
+		}
+	}
+	_, err := env.EmitSimple("fail", "fail", 3)
+	assert.True(IsQueueFullError(err), "Error if queue is full.")
+	assert.ErrorMatch(err, `queue of cell "fail" is full with 2 events`, "Error contains cell id and limit.")
+	for i := 0; i < 3; i++ {
+		release <- true
+	}
+
+	// Block if the queue is full.
+	for i := 0; i < 3; i++ {
+		env.EmitSimple("block", "block", i)
+		if i == 0 {
+			waitFor(func() bool { return env.cells["block"].queue.length() == 0 })
+		}
+	}
+	emitted := make(chan bool)
+	go func() {
+		env.EmitSimple("block", "block", 3)
+		emitted <- true
+	}()
+	select {
+	case <-emitted:
+		assert.Fail("Emitter is not blocked.")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release <- true
+	select {
+	case <-emitted:
+	case <-time.After(50 * time.Millisecond):
+		assert.Fail("Emitter is still blocked.")
+	}
+	for i := 0; i < 3; i++ {
+		release <- true
+	}
+
+	// Fail if the queue is still full after the timeout.
+	queue := env.cells["block"].queue
+	queue.cond.L.Lock()
+	queue.timeout = 50 * time.Millisecond
+	queue.cond.L.Unlock()
+	for i := 4; i < 7; i++ {
+		env.EmitSimple("block", "block", i)
+		if i == 4 {
+			waitFor(func() bool { return queue.length() == 0 })
+		}
+	}
+	_, err = env.EmitSimple("block", "block", 7)
+	assert.True(IsQueueFullError(err), "Error if queue is full after the timeout.")
+	for i := 0; i < 3; i++ {
+		release <- true
+	}
+}
+
+// TestLoadTopology tests the loading of topologies in SML and JSON.
+func TestLoadTopology(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+
+	// Load SML topology.
+	sml := `{topology
+		{cell {id counter} {behavior threshold}
+			{parameters {upper-threshold 2} {lower-threshold -2}}
+			{subscribers {id collector}}
+			{queue-limit 10} {overflow drop}}
+		{cell {id collector} {behavior collector}}
+		{ticker {id clock} {emit counter} {period 1h}}}`
+	env := NewEnvironment("load-sml-topology")
+	err := env.LoadTopology(strings.NewReader(sml))
+	assert.Nil(err, "SML topology loaded.")
+	assert.True(env.HasCell("counter"), "Counter added.")
+	assert.True(env.HasCell("collector"), "Collector added.")
+	assert.Equal(env.cells["counter"].queue.limit, 10, "Queue limit set.")
+	assert.Equal(env.cells["counter"].queue.strategy, OverflowDrop, "Overflow strategy set.")
+	assert.NotNil(env.tickers["clock"], "Ticker added.")
+
+	env.EmitSimple("counter", "count", 1)
+	env.EmitSimple("counter", "count", 1)
+	events := waitForEvents(env, "collector", 2)
+	assert.Length(events, 2, "Collector subscribed to counter.")
+	assert.Equal(events[1].Topic(), "threshold(upper)", "Threshold parameter used.")
+	env.Shutdown()
+
+	// Load JSON topology.
+	js := `{
+		"cells": [
+			{"id": "broadcast", "behavior": "broadcast", "subscribers": ["collector"]},
+			{"id": "collector", "behavior": "collector"}
+		],
+		"tickers": [
+			{"id": "clock", "emit": "broadcast", "period": "50ms"}
+		]
+	}`
+	env = NewEnvironment("load-json-topology")
+	err = env.LoadTopology(strings.NewReader(js))
+	assert.Nil(err, "JSON topology loaded.")
+	events = waitForEvents(env, "collector", 2)
+	assert.True(len(events) >= 2, "Ticks broadcasted to collector.")
+	env.Shutdown()
+
+	// Validation errors point to the cell.
+	env = NewEnvironment("invalid-topology")
+	defer env.Shutdown()
+	tests := []struct {
+		topology string
+		msg      string
+	}{
+		{`{topology {cell {id a} {behavior unknown}}}`, `cell "a": unknown behavior "unknown"`},
+		{`{topology {cell {id a} {behavior log}} {cell {id a} {behavior log}}}`, `cell "a": cell defined twice`},
+		{`{topology {cell {id a} {behavior log} {subscribers {id b}}}}`, `cell "a": unknown subscriber "b"`},
+		{`{topology {cell {id a} {behavior threshold} {parameters {upper-threshold x}}}}`, `cell "a": invalid parameter "upper-threshold"`},
+		{`{topology {cell {id a} {behavior log} {overflow sometimes}}}`, `cell "a": unknown overflow strategy "sometimes"`},
+		{`{topology {cell {id a} {behavior log} {color red}}}`, `cell "a": invalid tag "topology/cell/color"`},
+		{`{topology {ticker {id t} {emit b} {period 1s}}}`, `ticker "t": ticker emits to unknown cell "b"`},
+		{`{topology {cell {id a} {behavior log}} {ticker {id t} {emit a} {period 1s}} {ticker {id t} {emit a} {period 2s}}}`, `ticker "t": ticker defined twice`},
+		{`{"cells": [{"id": "a", "behavior": "unknown"}]}`, `cell "a": unknown behavior "unknown"`},
+	}
+	for _, test := range tests {
+		err = env.LoadTopology(strings.NewReader(test.topology))
+		assert.True(IsTopologyError(err), "Topology error returned.")
+		assert.Substring(err.Error(), test.msg, "Error points to the cell or ticker.")
+	}
+	assert.False(env.HasCell("a"), "No cell of invalid topologies added.")
+
+	// Register own behavior.
+	RegisterBehavior("test-filter", func(params map[string]string) (BehaviorFactory, error) {
+		topic := params["topic"]
+		return NewFilteredBroadcastBehaviorFactory(func(e Event) bool {
+			return e.Topic() == topic
+		}), nil
+	})
+	err = env.LoadTopology(strings.NewReader(`{topology {cell {id filter} {behavior test-filter} {parameters {topic foo}}}}`))
+	assert.Nil(err, "Topology with own behavior loaded.")
+	assert.True(env.HasCell("filter"), "Filter added.")
+
+	// Failing start removes the already started cells.
+	failingInits := 1
+	RegisterBehavior("test-faulty", func(params map[string]string) (BehaviorFactory, error) {
+		return func() Behavior { return &faultyBehavior{failingInits: &failingInits} }, nil
+	})
+	err = env.LoadTopology(strings.NewReader(`{topology
+		{cell {id first} {behavior log} {subscribers {id filter}}}
+		{cell {id second} {behavior test-faulty}}
+		{ticker {id first-clock} {emit first} {period 1h}}}`))
+	assert.True(IsTopologyError(err), "Topology error returned.")
+	assert.Substring(err.Error(), `cell "second": `, "Error points to the failing cell.")
+	assert.False(env.HasCell("first"), "Started cell removed.")
+	assert.Nil(env.tickers["first-clock"], "Ticker not started.")
+}
+
+// TestSnapshot tests the snapshot and restore of environments.
+func TestSnapshot(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+
+	// Create environment partly by topology, partly by code.
+	env := NewEnvironment("snapshot")
+	err := env.LoadTopology(strings.NewReader(`{topology
+		{cell {id threshold} {behavior threshold} {parameters {upper-threshold 5}}
+			{subscribers {id collector}}}
+		{cell {id collector} {behavior collector}}}`))
+	assert.Nil(err, "Topology loaded.")
+	env.AddCell("counter", NewCounterBehaviorFactory(Counter))
+	env.Subscribe("counter", "collector")
+	for i := 0; i < 3; i++ {
+		env.EmitSimple("threshold", "count", 1)
+		env.EmitSimple("counter", "a", true)
+	}
+	var buf bytes.Buffer
+	err = env.Snapshot(&buf)
+	assert.Nil(err, "Snapshot taken.")
+	env.Shutdown()
+
+	// Restore requires the cells not added by topology.
+	data := buf.Bytes()
+	env = NewEnvironment("restore")
+	defer env.Shutdown()
+	err = env.Restore(bytes.NewReader(data))
+	assert.True(IsCellDoesNotExistError(err), "Counter has to exist.")
+
+	env.AddCell("counter", NewCounterBehaviorFactory(Counter))
+	err = env.Restore(bytes.NewReader(data))
+	assert.Nil(err, "Snapshot restored.")
+	assert.True(env.HasCell("threshold"), "Threshold added again.")
+	assert.True(env.HasCell("collector"), "Collector added again.")
+
+	env.EmitSimple("threshold", "count", 2)
+	env.EmitSimple("counter", "a", true)
+	events := waitForEvents(env, "collector", 2)
+	assert.Length(events, 2, "Subscriptions restored.")
+	for _, event := range events {
+		switch event.Topic() {
+		case "threshold(upper)":
+			assert.Equal(event.Payload().([2]int64)[0], int64(5), "Threshold counter restored.")
+		case "counter:a":
+			assert.Equal(event.Payload().(int64), int64(4), "Counter restored.")
+		default:
+			assert.Fail("Unexpected event " + event.Topic() + ".")
+		}
+	}
+
+	// A failing restore is rolled back.
+	env.RemoveCell("collector")
+	env.RemoveCell("threshold")
+	env.AddCell("threshold", CollectorBehaviorFactory)
+	err = env.Restore(bytes.NewReader(data))
+	assert.True(IsCellSnapshotError(err), "Threshold is not snapshotable anymore.")
+	assert.False(env.HasCell("collector"), "Added collector removed again.")
+	env.Subscribe("counter", "threshold")
+	env.EmitSimple("counter", "a", true)
+	events = waitForEvents(env, "threshold", 1)
+	assert.Length(events, 1, "Counter event received.")
+	assert.Equal(events[0].Payload().(int64), int64(5), "Counter state rolled back.")
+
+	// Cells may change the environment while the snapshot is taken.
+	env.AddCell("adder", func() Behavior { return &cellAddingBehavior{} })
+	env.EmitSimple("adder", "added", true)
+	done := make(chan error)
+	go func() {
+		var buf bytes.Buffer
+		done <- env.Snapshot(&buf)
+	}()
+	select {
+	case err = <-done:
+		assert.Nil(err, "Snapshot taken while adding cell.")
+	case <-time.After(time.Second):
+		assert.Fail("Snapshot deadlocked.")
+	}
+	assert.True(env.HasCell("added"), "Cell added while taking snapshot.")
+}
+
+// TestExportTopology tests the export of live topologies.
+func TestExportTopology(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	env := NewEnvironment("export")
+	defer env.Shutdown()
+
+	err := env.LoadTopology(strings.NewReader(`{topology
+		{cell {id threshold} {behavior threshold} {parameters {upper-threshold 5}}
+			{subscribers {id collector}} {queue-limit 10} {overflow fail}}
+		{cell {id collector} {behavior collector}}
+		{ticker {id clock} {emit threshold} {period 1h}}}`))
+	assert.Nil(err, "Topology loaded.")
+	env.AddCell("counter", NewCounterBehaviorFactory(Counter))
+	env.Subscribe("counter", "collector", "threshold")
+	waitFor(func() bool { return len(env.cells["counter"].subscriberIds()) == 2 })
+
+	te, err := env.ExportTopology()
+	assert.Nil(err, "Topology exported.")
+	assert.Equal(te.Id, Id("export"), "Environment id exported.")
+	assert.Length(te.Cells, 3, "All cells exported.")
+	assert.Equal(te.Cells[0].Id, Id("collector"), "Cells sorted by id.")
+	assert.Equal(te.Cells[1].Id, Id("counter"), "Cells sorted by id.")
+	assert.Equal(te.Cells[1].Type, "counter-behavior", "Behavior type exported.")
+	assert.Equal(te.Cells[1].Subscribers, []Id{"collector", "threshold"}, "Subscribers exported.")
+	assert.Equal(te.Cells[2].Behavior, "threshold", "Behavior name exported.")
+	assert.Equal(te.Cells[2].Parameters["upper-threshold"], "5", "Behavior parameters exported.")
+	assert.Equal(te.Cells[2].QueueLimit, 10, "Queue limit exported.")
+	assert.Equal(te.Cells[2].Overflow, "fail", "Overflow strategy exported.")
+	assert.Equal(te.Cells[2].QueueLength, 0, "Queue length exported.")
+	assert.Length(te.Tickers, 1, "Tickers exported.")
+	assert.Equal(*te.Tickers[0], TickerExport{"clock", "threshold", "1h0m0s"}, "Ticker exported.")
+
+	// Export as JSON.
+	var buf bytes.Buffer
+	err = te.WriteJSON(&buf)
+	assert.Nil(err, "JSON written.")
+	assert.Substring(buf.String(), `"queue-length": 0`, "JSON contains queue length.")
+	topology, err := ReadTopology(bytes.NewReader(buf.Bytes()))
+	assert.Nil(err, "JSON readable as topology.")
+	assert.Equal(topology.Cells[2].Behavior, "threshold", "JSON contains behavior.")
+	assert.Equal(topology.Tickers[0].Period, time.Hour, "JSON contains ticker period.")
+
+	// Export as DOT.
+	buf.Reset()
+	err = te.WriteDOT(&buf)
+	assert.Nil(err, "DOT written.")
+	dot := buf.String()
+	assert.Substring(dot, `digraph "export" {`, "DOT graph started.")
+	assert.Substring(dot, `"threshold" [shape=box,label="threshold\nthreshold\nqueue: 0/10"];`, "DOT cell node.")
+	assert.Substring(dot, `"counter" -> "collector";`, "DOT subscription edge.")
+	assert.Substring(dot, `"ticker:clock" -> "threshold" [style=dashed];`, "DOT ticker edge.")
+
+	// Cells may change the environment while the topology is exported.
+	env.AddCell("adder", func() Behavior { return &cellAddingBehavior{} })
+	env.EmitSimple("adder", "added", true)
+	done := make(chan error)
+	go func() {
+		_, err := env.ExportTopology()
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		assert.Nil(err, "Topology exported while adding cell.")
+	case <-time.After(time.Second):
+		assert.Fail("Export deadlocked.")
+	}
+	assert.True(waitFor(func() bool { return env.HasCell("added") }), "Cell added during export.")
+
+	// Behaviors may export the topology.
+	exported := make(chan *TopologyExport, 1)
+	env.AddCell("exporter", NewSimpleActionBehaviorFactory(func(e Event, emitter EventEmitter) {
+		te, _ := env.ExportTopology()
+		exported <- te
+	}))
+	env.Subscribe("exporter", "collector")
+	env.EmitSimple("exporter", "export", true)
+	select {
+	case te = <-exported:
+		assert.NotNil(te, "Topology exported by behavior.")
+		for _, ce := range te.Cells {
+			if ce.Id == "exporter" {
+				assert.Equal(ce.Subscribers, []Id{"collector"}, "Own subscribers exported.")
+			}
+		}
+	case <-time.After(time.Second):
+		assert.Fail("Export by behavior deadlocked.")
+	}
+}
+
+// TestWindowBehaviors tests the tumbling and sliding window behaviors.
+func TestWindowBehaviors(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	env := NewEnvironment("window-behaviors")
+	defer env.Shutdown()
+
+	base := time.Date(2012, time.June, 1, 12, 0, 0, 0, time.UTC)
+	vf := func(e Event) (float64, time.Time, bool) {
+		v := e.Payload().(int)
+		return float64(v), base.Add(time.Duration(v) * time.Second), true
+	}
+	env.AddCell("count", NewTumblingWindowBehaviorFactory(0, 3, nil, 50))
+	env.AddCell("time", NewTumblingWindowBehaviorFactory(10*time.Second, 0, vf))
+	env.AddCell("sliding-count", NewSlidingWindowBehaviorFactory(0, 3, nil, 90))
+	env.AddCell("sliding-time", NewSlidingWindowBehaviorFactory(10*time.Second, 0, vf))
+	env.AddCell("collector", CollectorBehaviorFactory)
+	env.SubscribeAll(SubscriptionMap{
+		"count":         {"collector"},
+		"time":          {"collector"},
+		"sliding-count": {"collector"},
+		"sliding-time":  {"collector"},
+	})
+	aggregates := func(id Id, count int) []*Aggregate {
+		as := []*Aggregate{}
+		for _, e := range takeEvents(env, "collector", count) {
+			assert.Equal(e.Topic(), "aggregate("+string(id)+")", "Aggregate emitted by the window.")
+			as = append(as, e.Payload().(*Aggregate))
+		}
+		return as
+	}
+
+	// Tumbling window by count.
+	for i := 1; i <= 7; i++ {
+		env.EmitSimple("count", "value", i)
+	}
+	as := aggregates("count", 2)
+	assert.Length(as, 2, "Two windows closed.")
+	assert.Equal(as[0].Count, 3, "Count of first window.")
+	assert.Equal(as[0].Sum, 6.0, "Sum of first window.")
+	assert.Equal(as[0].Min, 1.0, "Min of first window.")
+	assert.Equal(as[0].Max, 3.0, "Max of first window.")
+	assert.Equal(as[0].Average, 2.0, "Average of first window.")
+	assert.Equal(as[0].Percentiles[50], 2.0, "Median of first window.")
+	assert.Equal(as[1].Sum, 15.0, "Sum of second window.")
+
+	// Tumbling window by event timestamps and ticker.
+	for _, v := range []int{1, 5, 9, 12, 25} {
+		env.EmitSimple("time", "value", v)
+	}
+	env.Emit("time", &TickerEvent{"ticker", base.Add(40 * time.Second), nil})
+	as = aggregates("time", 3)
+	assert.Length(as, 3, "Three windows closed.")
+	assert.Equal(as[0].Count, 3, "Count of first window.")
+	assert.Equal(as[0].Start, base.Add(time.Second), "Start of first window.")
+	assert.Equal(as[0].End, base.Add(9*time.Second), "End of first window.")
+	assert.Equal(as[1].Sum, 12.0, "Sum of second window.")
+	assert.Equal(as[2].Sum, 25.0, "Sum of third window closed by ticker.")
+
+	// Tumbling window with values out of order.
+	for _, v := range []int{30, 27, 35, 33} {
+		env.EmitSimple("time", "value", v)
+	}
+	env.Emit("time", &TickerEvent{"ticker", base.Add(50 * time.Second), nil})
+	as = aggregates("time", 1)
+	assert.Length(as, 1, "Window closed by ticker.")
+	assert.Equal(as[0].Sum, 98.0, "Value before window start dropped.")
+	assert.Equal(as[0].Start, base.Add(30*time.Second), "Start of window.")
+	assert.Equal(as[0].End, base.Add(35*time.Second), "End of window.")
+
+	// Sliding window by count.
+	for i := 1; i <= 5; i++ {
+		env.EmitSimple("sliding-count", "value", i)
+	}
+	env.Emit("sliding-count", NewTickerEvent("ticker"))
+	env.EmitSimple("sliding-count", "value", 6)
+	env.Emit("sliding-count", NewTickerEvent("ticker"))
+	as = aggregates("sliding-count", 2)
+	assert.Length(as, 2, "Each ticker emits.")
+	assert.Equal(as[0].Sum, 12.0, "Sum of last three values.")
+	assert.Equal(as[0].Percentiles[90], 4.8, "Interpolated percentile.")
+	assert.Equal(as[1].Sum, 15.0, "Window slided.")
+
+	// Sliding window by event timestamps.
+	for _, v := range []int{1, 5, 12} {
+		env.EmitSimple("sliding-time", "value", v)
+	}
+	env.Emit("sliding-time", &TickerEvent{"ticker", base.Add(13 * time.Second), nil})
+	env.Emit("sliding-time", &TickerEvent{"ticker", base.Add(20 * time.Second), nil})
+	env.Emit("sliding-time", &TickerEvent{"ticker", base.Add(30 * time.Second), nil})
+	as = aggregates("sliding-time", 2)
+	assert.Length(as, 2, "Empty window not emitted.")
+	assert.Equal(as[0].Sum, 17.0, "Old value evicted.")
+	assert.Equal(as[1].Sum, 12.0, "Window slided.")
+
+	// Sliding window with values out of order.
+	for _, v := range []int{15, 25, 22} {
+		env.EmitSimple("sliding-time", "value", v)
+	}
+	env.Emit("sliding-time", &TickerEvent{"ticker", base.Add(31 * time.Second), nil})
+	as = aggregates("sliding-time", 1)
+	assert.Length(as, 1, "Window emitted.")
+	assert.Equal(as[0].Sum, 47.0, "Already evicted value dropped.")
+	assert.Equal(as[0].Start, base.Add(22*time.Second), "Values ordered by timestamp.")
+
+	// Window behaviors in topologies.
+	err := env.LoadTopology(strings.NewReader(`{topology
+		{cell {id topology-window} {behavior tumbling-window}
+			{parameters {count 2} {percentiles 50, 100}}
+			{subscribers {id collector}}}}`))
+	assert.Nil(err, "Topology loaded.")
+	env.EmitSimple("topology-window", "value", 1)
+	env.EmitSimple("topology-window", "value", 2.5)
+	as = aggregates("topology-window", 1)
+	assert.Length(as, 1, "Window closed.")
+	assert.Equal(as[0].Percentiles, map[int]float64{50: 1.75, 100: 2.5}, "Percentiles of topology window.")
+	err = env.LoadTopology(strings.NewReader(`{topology
+		{cell {id invalid-window} {behavior sliding-window} {parameters {percentiles 101}}}}`))
+	assert.True(IsTopologyError(err), "Invalid percentile detected.")
+}
+
+// TestPatternBehavior tests the matching of event patterns.
+func TestPatternBehavior(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	env := NewEnvironment("pattern-behavior")
+	defer env.Shutdown()
+
+	large := func(e Event) bool {
+		return e.Payload().(int) > 10
+	}
+	abc := NewPattern("a-b").Match("A", nil).Without("C", nil).Match("B", nil).Within(100 * time.Millisecond)
+	large3 := NewPattern("large").Match("V", large).Match("V", large).Match("V", large)
+	limited := NewPattern("limited").Match("L", nil).Match("M", nil).Limit(2)
+	env.AddCell("pattern", NewPatternBehaviorFactory(abc, large3, limited))
+	env.AddCell("collector", CollectorBehaviorFactory)
+	env.Subscribe("pattern", "collector")
+	matches := func() []Event {
+		settle(env, "pattern")
+		return takeEvents(env, "collector", 0)
+	}
+
+	// A followed by B with skipped events.
+	env.EmitSimple("pattern", "A", 1)
+	env.EmitSimple("pattern", "X", 2)
+	env.EmitSimple("pattern", "B", 3)
+	ms := matches()
+	assert.Length(ms, 1, "Pattern matched.")
+	assert.Equal(ms[0].Topic(), "match(a-b)", "Topic contains the pattern id.")
+	events := ms[0].Payload().([]Event)
+	assert.Length(events, 2, "Two events captured.")
+	assert.Equal(events[0].Topic(), "A", "First event captured.")
+	assert.Equal(events[1].Payload(), 3, "Second event captured.")
+
+	// Excluded event in between.
+	env.EmitSimple("pattern", "A", 1)
+	env.EmitSimple("pattern", "C", 2)
+	env.EmitSimple("pattern", "B", 3)
+	assert.Empty(matches(), "Excluded event prevents match.")
+
+	// Duration exceeded.
+	env.EmitSimple("pattern", "A", 1)
+	time.Sleep(150 * time.Millisecond)
+	env.EmitSimple("pattern", "B", 2)
+	assert.Empty(matches(), "Exceeded duration prevents match.")
+
+	// Overlapping sequences.
+	env.EmitSimple("pattern", "A", 1)
+	env.EmitSimple("pattern", "A", 2)
+	env.EmitSimple("pattern", "B", 3)
+	assert.Length(matches(), 2, "Each started sequence matches.")
+
+	// Predicates.
+	for _, v := range []int{20, 5, 30, 40, 50} {
+		env.EmitSimple("pattern", "V", v)
+	}
+	ms = matches()
+	assert.Length(ms, 2, "Predicates matched.")
+	events = ms[0].Payload().([]Event)
+	assert.Equal([]interface{}{events[0].Payload(), events[1].Payload(), events[2].Payload()}, []interface{}{20, 30, 40}, "Small value skipped.")
+
+	// Limited partial matches.
+	for i := 1; i <= 3; i++ {
+		env.EmitSimple("pattern", "L", i)
+	}
+	env.EmitSimple("pattern", "M", 4)
+	ms = matches()
+	assert.Length(ms, 2, "Oldest partial match dropped.")
+	events = ms[0].Payload().([]Event)
+	assert.Equal(events[0].Payload(), 2, "Newer partial matches kept.")
+
+	// Invalid patterns.
+	_, err := env.AddCell("invalid", NewPatternBehaviorFactory(NewPattern("invalid").Match("A", nil).Without("C", nil)))
+	assert.True(IsCellInitError(err), "Trailing exclusion is invalid.")
+	assert.True(IsPatternError(err.(CellInitError).Err), "Trailing exclusion is a pattern error.")
+	_, err = env.AddCell("empty", NewPatternBehaviorFactory(NewPattern("empty")))
+	assert.True(IsCellInitError(err), "Empty pattern is invalid.")
+	assert.ErrorMatch(err.(CellInitError).Err, `pattern "empty" matches no event`, "Error contains pattern id.")
+	_, err = env.AddCell("unlimited", NewPatternBehaviorFactory(NewPattern("unlimited").Match("A", nil).Limit(0)))
+	assert.True(IsCellInitError(err), "Pattern without partial matches is invalid.")
+	assert.True(IsPatternError(err.(CellInitError).Err), "Missing limit is a pattern error.")
+}
+
+// TestSupervisedCell tests the restart of cells.
+func TestSupervisedCell(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	env := NewEnvironment("supervised-cell")
+	defer env.Shutdown()
+
+	failingInits := 0
+	factory := func() Behavior { return &faultyBehavior{failingInits: &failingInits} }
+	processed := make(chan Event, 10)
+	restarts := make(chan Event, 10)
+	forward := func(events chan Event) BehaviorFactory {
+		return NewSimpleActionBehaviorFactory(func(e Event, emitter EventEmitter) {
+			events <- e
+		})
+	}
+	_, err := env.AddCell(SystemCellId, BroadcastBehaviorFactory)
+	assert.True(IsCellIdReservedError(err), "System cell id is reserved.")
+	env.AddSystemCell(BroadcastBehaviorFactory)
+	env.AddCell("watcher", forward(restarts))
+	env.AddCell("collector", forward(processed))
+	env.Subscribe(SystemCellId, "watcher")
+	_, err = env.AddSupervisedCell("faulty", factory, RestartPolicy{2, 2, time.Hour})
+	assert.Nil(err, "Supervised cell added.")
+	env.Subscribe("faulty", "collector")
+	emit := func(topics ...string) {
+		for _, topic := range topics {
+			env.EmitSimple("faulty", topic, nil)
+		}
+	}
+	receive := func(events chan Event) Event {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(5 * time.Second):
+			assert.Fail("No event received.")
+		}
+		return nil
+	}
+
+	// Single panics are recovered.
+	emit("ok", "panic", "ok", "panic", "ok")
+	for i := 1; i <= 3; i++ {
+		assert.Equal(receive(processed).Payload(), i, "Behavior not restarted.")
+	}
+
+	// Consecutive panics restart the behavior. The restart is
+	// the first system event, so the single panics signalled none.
+	emit("panic", "panic", "ok")
+	assert.Equal(receive(processed).Payload(), 1, "Subscribers kept, fresh behavior.")
+	event := receive(restarts)
+	assert.Equal(event.Topic(), "restart(faulty)", "Restart event.")
+	assert.Equal(event.Payload(), "faulty behavior", "Restart reason.")
+	restart := event.(*RestartEvent)
+	assert.Equal(restart.Id, Id("faulty"), "Restarted cell.")
+	assert.Equal(restart.Reason, "faulty behavior", "Restart reason.")
+	assert.False(restart.GaveUp, "Cell didn't give up.")
+
+	// Exceeding the restart frequency removes the cell.
+	emit("panic", "panic", "panic", "panic")
+	event = receive(restarts)
+	assert.Equal(event.Topic(), "restart(faulty)", "Restart signalled first.")
+	event = receive(restarts)
+	assert.Equal(event.Topic(), "restart-failed(faulty)", "Restart failed event.")
+	err, ok := event.Payload().(error)
+	assert.True(ok && IsTooMuchRestartsError(err), "Restart frequency exceeded.")
+	assert.True(event.(*RestartEvent).GaveUp, "Cell gave up.")
+	assert.True(waitFor(func() bool { return !env.HasCell("faulty") }), "Broken cell removed.")
+
+	// Failing inits are retried.
+	failingInits = 2
+	_, err = env.AddSupervisedCell("init", factory, RestartPolicy{1, 3, time.Hour})
+	assert.Nil(err, "Init retried.")
+	failingInits = 2
+	_, err = env.AddSupervisedCell("broken-init", factory, RestartPolicy{1, 1, time.Hour})
+	assert.True(IsCellInitError(err), "Init retries exceeded.")
+	assert.True(IsTooMuchRestartsError(err.(CellInitError).Err), "Restart frequency exceeded.")
+	failingInits = 1
+	pooledFactory := func() Behavior { return &pooledFaultyBehavior{faultyBehavior{failingInits: &failingInits}} }
+	behavior, err := env.AddSupervisedCell("pooled-init", pooledFactory, RestartPolicy{1, 3, time.Hour})
+	assert.Nil(err, "Pooled init retried.")
+	_, ok = behavior.(*poolBehavior)
+	assert.True(ok, "Restarted behavior pooled again.")
+
+	// Removed cells stop their behavior.
+	var stops int64
+	env.AddCell("stopping", func() Behavior { return &faultyBehavior{failingInits: &failingInits, stops: &stops} })
+	env.RemoveCell("stopping")
+	assert.True(waitFor(func() bool { return atomic.LoadInt64(&stops) == 1 }), "Behavior stopped.")
+}
+
+// TestRoutingBehaviors tests the routing and load-balancing behaviors.
+func TestRoutingBehaviors(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	env := NewEnvironment("routing-behaviors")
+	defer env.Shutdown()
+
+	large := func(e Event) bool {
+		v, ok := e.Payload().(int)
+		return ok && v > 10
+	}
+	key := func(e Event) string {
+		return e.Topic()
+	}
+	env.AddCell("router", NewRouterBehaviorFactory(
+		Route{Topic: "a", Targets: []Id{"x"}},
+		Route{Predicate: large, Targets: []Id{"y", "unknown"}},
+		Route{Topic: "b", Targets: []Id{"x", "y"}}))
+	env.AddCell("partition", NewHashPartitionBehaviorFactory(key, 0))
+	env.AddCell("balancer", NewWeightedRoundRobinBehaviorFactory(map[Id]int{"x": 3, "z": 0}))
+	env.AddCell("x", CollectorBehaviorFactory)
+	env.AddCell("y", CollectorBehaviorFactory)
+	env.AddCell("z", CollectorBehaviorFactory)
+	env.SubscribeAll(SubscriptionMap{
+		"router":    {"x", "y"},
+		"partition": {"x", "y", "z"},
+		"balancer":  {"x", "y", "z"},
+	})
+	collected := func(source Id) map[Id][]Event {
+		settle(env, source)
+		events := make(map[Id][]Event)
+		for _, id := range []Id{"x", "y", "z"} {
+			events[id] = takeEvents(env, id, 0)
+		}
+		return events
+	}
+
+	// Content based routing.
+	env.EmitSimple("router", "a", 20)
+	env.EmitSimple("router", "c", 30)
+	env.EmitSimple("router", "b", 1)
+	env.EmitSimple("router", "c", 1)
+	events := collected("router")
+	assert.Length(events["x"], 2, "First route and default route.")
+	assert.Equal(events["x"][0].Topic(), "a", "First matching route wins.")
+	assert.Length(events["y"], 2, "Predicate route and default route.")
+	assert.Equal(events["y"][0].Payload(), 30, "Predicate matched.")
+
+	// Consistent hash partitioning.
+	for i := 0; i < 30; i++ {
+		env.EmitSimple("partition", fmt.Sprintf("key-%d", i%10), i)
+	}
+	events = collected("partition")
+	targets := make(map[string]Id)
+	for id, es := range events {
+		assert.NotEmpty(es, "Events distributed to "+string(id)+".")
+		for _, e := range es {
+			if target, ok := targets[e.Topic()]; ok {
+				assert.Equal(target, id, "Key stays in partition.")
+			}
+			targets[e.Topic()] = id
+		}
+	}
+	assert.Length(targets, 10, "All keys partitioned.")
+
+	// Weighted round robin.
+	for i := 0; i < 8; i++ {
+		env.EmitSimple("balancer", "event", i)
+	}
+	events = collected("balancer")
+	assert.Length(events["x"], 6, "Weight three.")
+	assert.Length(events["y"], 2, "Default weight one.")
+	assert.Empty(events["z"], "Weight zero.")
+	assert.Equal(events["y"][0].Payload(), 2, "Smooth distribution.")
+
+	// Routing needs a selective emitter.
+	emitter := &countingEventEmitter{}
+	router := NewRouterBehaviorFactory(Route{Targets: []Id{"x"}})()
+	router.ProcessEvent(NewSimpleEvent("event", 1), emitter)
+	assert.Equal(emitter.count, 0, "Event dropped without selective emitter.")
+}
+
+// TestContextResults tests results, errors, cancellation and
+// deadlines of contexts.
+func TestContextResults(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	env := NewEnvironment("context-results")
+	defer env.Shutdown()
+
+	env.AddCell("a", NewSimpleActionBehaviorFactory(func(e Event, emitter EventEmitter) {
+		e.Context().SetResult("a", 1)
+		emitter.Emit(e)
+	}))
+	env.AddCell("b", NewSimpleActionBehaviorFactory(func(e Event, emitter EventEmitter) {
+		e.Context().SetResult("b", "done")
+	}))
+	env.AddCell("c", NewSimpleActionBehaviorFactory(func(e Event, emitter EventEmitter) {
+		panic("c failed")
+	}))
+	started := make(chan bool)
+	release := make(chan bool)
+	env.AddCell("slow", NewSimpleActionBehaviorFactory(func(e Event, emitter EventEmitter) {
+		started <- true
+		<-release
+		emitter.Emit(e)
+	}))
+	env.SubscribeAll(SubscriptionMap{"a": {"b", "c"}, "slow": {"b"}})
+
+	// Results and errors.
+	ctx, err := env.EmitSimple("a", "event", nil)
+	assert.Nil(err, "Event emitted.")
+	assert.Nil(ctx.Wait(time.Second), "Processing done.")
+	assert.Equal(ctx.Contributors(), []Id{"a", "b", "c"}, "All cells contributed.")
+	var i int
+	assert.Nil(ctx.Result("a", &i), "Result of a.")
+	assert.Equal(i, 1, "Typed result of a.")
+	err = ctx.Result("b", &i)
+	assert.True(IsContextResultError(err), "Wrong result type.")
+	assert.ErrorMatch(err, `context result for "b" is string, not assignable to int`, "Error contains types.")
+	err = ctx.Result("c", &i)
+	assert.True(IsContextResultError(err), "No result of c.")
+	assert.ErrorMatch(err, `context result for "c" does not exist`, "Error contains cell id.")
+	assert.True(IsContextResultError(ctx.Result("a", i)), "Result needs a pointer.")
+	assert.Equal(ctx.Results(), map[Id]interface{}{"a": 1, "b": "done"}, "All results.")
+	errs := ctx.Errors()
+	assert.Length(errs, 1, "One error.")
+	assert.ErrorMatch(errs["c"], "c failed", "Error of c.")
+
+	// Cancellation.
+	ctx, err = env.EmitSimple("slow", "event", nil)
+	assert.Nil(err, "Event emitted.")
+	<-started
+	ctx.Cancel()
+	assert.True(ctx.Canceled(), "Context canceled.")
+	release <- true
+	assert.Nil(ctx.Wait(time.Second), "Processing done.")
+	assert.Equal(ctx.Contributors(), []Id{"slow"}, "Emission after cancellation suppressed.")
+
+	// Deadlines.
+	deadline := time.Now().Add(10 * time.Millisecond)
+	ctx, err = env.EmitWithDeadline("slow", NewSimpleEvent("event", nil), deadline)
+	assert.Nil(err, "Event emitted.")
+	d, ok := ctx.Deadline()
+	assert.True(ok, "Deadline set.")
+	assert.Equal(d, deadline, "Deadline returned.")
+	ctx.SetDeadline(deadline.Add(time.Hour))
+	d, _ = ctx.Deadline()
+	assert.Equal(d, deadline, "Earlier deadline kept.")
+	<-started
+	assert.True(waitFor(ctx.Canceled), "Deadline passed.")
+	release <- true
+	assert.Nil(ctx.Wait(time.Second), "Processing done.")
+	assert.Equal(ctx.Contributors(), []Id{"slow"}, "Emission after deadline suppressed.")
+	ctx, err = env.EmitWithDeadline("a", NewSimpleEvent("event", nil), time.Now())
+	assert.Nil(err, "Event emitted.")
+	assert.Nil(ctx.Wait(time.Second), "Processing done.")
+	assert.Empty(ctx.Contributors(), "Expired events not processed.")
+}
+
+// Test the rate limiting, debouncing and throttling behaviors.
+func TestRateLimitingBehaviors(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	var b Behavior
+	var emitter *recordingEventEmitter
+	now := time.Now()
+	clock := func() time.Time { return now }
+	start := func(bf BehaviorFactory) {
+		b = bf()
+		switch tb := b.(type) {
+		case *rateLimitBehavior:
+			tb.clock = clock
+		case *debounceBehavior:
+			tb.clock = clock
+		case *throttleBehavior:
+			tb.clock = clock
+		}
+		emitter = &recordingEventEmitter{}
+	}
+	process := func(topic string, payload interface{}) {
+		b.ProcessEvent(NewSimpleEvent(topic, payload), emitter)
+	}
+	tick := func(d time.Duration) {
+		now = now.Add(d)
+		b.ProcessEvent(NewTickerEvent("ticker"), emitter)
+	}
+	payloads := func() []interface{} {
+		ps := []interface{}{}
+		for _, e := range emitter.events {
+			ps = append(ps, e.Payload())
+		}
+		return ps
+	}
+
+	// Token bucket dropping excess events.
+	start(NewRateLimitBehaviorFactory(1, 2, 0))
+	for i := 1; i <= 3; i++ {
+		process("value", i)
+	}
+	assert.Equal(payloads(), []interface{}{1, 2}, "Burst passed, excess dropped.")
+	tick(time.Second)
+	process("value", 4)
+	assert.Equal(payloads(), []interface{}{1, 2, 4}, "Token refilled.")
+
+	// Token bucket delaying excess events.
+	start(NewRateLimitBehaviorFactory(10, 1, 2))
+	for i := 1; i <= 4; i++ {
+		process("value", i)
+	}
+	assert.Equal(payloads(), []interface{}{1}, "Burst passed, excess delayed.")
+	tick(100 * time.Millisecond)
+	assert.Equal(payloads(), []interface{}{1, 2}, "One delayed event released.")
+	tick(time.Second)
+	assert.Equal(payloads(), []interface{}{1, 2, 3}, "Delayed events released in order, those beyond limit dropped.")
+
+	// Debouncing.
+	start(NewDebounceBehaviorFactory(time.Second))
+	process("value", 1)
+	process("value", 2)
+	tick(0)
+	assert.Empty(payloads(), "Still not quiet.")
+	tick(time.Second)
+	assert.Equal(payloads(), []interface{}{2}, "Latest event emitted after quiet period.")
+	tick(time.Second)
+	assert.Length(payloads(), 1, "Event emitted only once.")
+
+	// Throttling per key.
+	start(NewThrottleBehaviorFactory(50*time.Millisecond, nil))
+	process("a", 1)
+	process("a", 2)
+	process("b", 3)
+	assert.Equal(payloads(), []interface{}{1, 3}, "One event per key.")
+	now = now.Add(60 * time.Millisecond)
+	process("a", 4)
+	assert.Equal(payloads(), []interface{}{1, 3, 4}, "Event passed after interval.")
+
+	// Delayed events keep their context.
+	env := NewEnvironment("rate-limiting")
+	defer env.Shutdown()
+	env.AddCell("limiter", NewRateLimitBehaviorFactory(100, 1, 10))
+	env.AddCell("collector", CollectorBehaviorFactory)
+	env.Subscribe("limiter", "collector")
+	env.EmitSimple("limiter", "value", 1)
+	ctx, _ := env.EmitSimple("limiter", "value", 2)
+	assert.NotNil(ctx.Wait(50*time.Millisecond), "Context active while event is delayed.")
+	env.Emit("limiter", NewTickerEvent("ticker"))
+	assert.Nil(ctx.Wait(time.Second), "Context done after delayed event is processed.")
+	events := waitForEvents(env, "collector", 2)
+	assert.Length(events, 2, "Delayed event emitted.")
+	assert.Equal(events[1].Context(), ctx, "Delayed event emitted in its context.")
+
+	// Topology builders.
+	bb, ok := lookupBehavior("rate-limit")
+	assert.True(ok, "Rate limit builder registered.")
+	_, err := bb(map[string]string{"rate": "5", "burst": "10", "mode": "delay", "delay-limit": "50"})
+	assert.Nil(err, "Rate limit built.")
+	_, err = bb(map[string]string{"rate": "5", "mode": "delay", "delay-limit": "many"})
+	assert.ErrorMatch(err, `invalid parameter "delay-limit": .*`, "Invalid delay limit.")
+	_, err = bb(map[string]string{"rate": "5", "mode": "queue"})
+	assert.ErrorMatch(err, `invalid parameter "mode": .*`, "Invalid mode.")
+	bb, _ = lookupBehavior("debounce")
+	_, err = bb(map[string]string{})
+	assert.ErrorMatch(err, `missing parameter "quiet"`, "Quiet period required.")
+}
+
 // EOF
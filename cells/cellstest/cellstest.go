@@ -0,0 +1,150 @@
+// Tideland Common Go Library - Cells - Test Harness
+//
+// Copyright (C) 2010-2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package cellstest
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"github.com/denkhaus/tcgl/asserts"
+	"github.com/denkhaus/tcgl/cells"
+	"time"
+)
+
+//--------------------
+// BEHAVIOR HARNESS
+//--------------------
+
+// BehaviorHarness runs one behavior in isolation for tests. Events
+// are processed synchronously and the emitted events are recorded
+// by a RecordingEventEmitter. The assertion methods use the passed
+// asserts instance.
+type BehaviorHarness struct {
+	assert   *asserts.Asserts
+	id       cells.Id
+	behavior cells.Behavior
+	emitter  *RecordingEventEmitter
+	panics   []interface{}
+}
+
+// NewBehaviorHarness creates the behavior with the factory and
+// initializes it with the id and the environment. The environment
+// may be nil if the behavior doesn't use it. The emitter pretends
+// the given subscribers.
+func NewBehaviorHarness(assert *asserts.Asserts, env *cells.Environment, id cells.Id, bf cells.BehaviorFactory, subscribers ...cells.Id) (*BehaviorHarness, error) {
+	h := &BehaviorHarness{
+		assert:   assert,
+		id:       id,
+		behavior: bf(),
+		emitter:  NewRecordingEventEmitter(subscribers...),
+	}
+	if err := h.behavior.Init(env, id); err != nil {
+		return nil, cells.CellInitError{Id: id, Err: err}
+	}
+	return h, nil
+}
+
+// Behavior returns the behavior.
+func (h *BehaviorHarness) Behavior() cells.Behavior {
+	return h.behavior
+}
+
+// Emitter returns the recording emitter.
+func (h *BehaviorHarness) Emitter() *RecordingEventEmitter {
+	return h.emitter
+}
+
+// Process lets the behavior process the event. A panic is passed to
+// the recover method of the behavior like in a cell and returned.
+func (h *BehaviorHarness) Process(e cells.Event) (r interface{}) {
+	if e.Context() == nil {
+		e.SetContext(cells.NewContext())
+	}
+	defer func() {
+		if r = recover(); r != nil {
+			h.panics = append(h.panics, r)
+			h.behavior.Recover(r, e)
+		}
+	}()
+	h.emitter.SetContext(e.Context())
+	h.behavior.ProcessEvent(e, h.emitter)
+	return nil
+}
+
+// ProcessSimple lets the behavior process a simple event.
+func (h *BehaviorHarness) ProcessSimple(topic string, payload interface{}) interface{} {
+	return h.Process(cells.NewSimpleEvent(topic, payload))
+}
+
+// ProcessTicker lets the behavior process a ticker event with
+// the given time.
+func (h *BehaviorHarness) ProcessTicker(id cells.Id, t time.Time) interface{} {
+	return h.Process(cells.NewTickerEventAt(id, t))
+}
+
+// Emitted returns the events emitted so far.
+func (h *BehaviorHarness) Emitted() []*EmittedEvent {
+	return h.emitter.Emitted()
+}
+
+// Panics returns the panics of the behavior so far.
+func (h *BehaviorHarness) Panics() []interface{} {
+	return h.panics
+}
+
+// Reset clears the emitted events and the panics.
+func (h *BehaviorHarness) Reset() {
+	h.emitter.Reset()
+	h.panics = nil
+}
+
+// Stop stops the behavior.
+func (h *BehaviorHarness) Stop() {
+	h.behavior.Stop()
+}
+
+// AssertEmitted tests the number of emitted events.
+func (h *BehaviorHarness) AssertEmitted(count int, msg string) bool {
+	return h.assert.Length(h.emitter.Emitted(), count, msg)
+}
+
+// AssertTopics tests the topics of the emitted events in their order.
+func (h *BehaviorHarness) AssertTopics(topics []string, msg string) bool {
+	obtained := []string{}
+	for _, ee := range h.emitter.Emitted() {
+		obtained = append(obtained, ee.Event.Topic())
+	}
+	return h.assert.Equal(obtained, topics, msg)
+}
+
+// AssertPayloads tests the payloads of the emitted events in their order.
+func (h *BehaviorHarness) AssertPayloads(payloads []interface{}, msg string) bool {
+	obtained := []interface{}{}
+	for _, ee := range h.emitter.Emitted() {
+		obtained = append(obtained, ee.Event.Payload())
+	}
+	return h.assert.Equal(obtained, payloads, msg)
+}
+
+// AssertTargets tests the subscribers the emitted event with
+// the index has been emitted to.
+func (h *BehaviorHarness) AssertTargets(index int, targets []cells.Id, msg string) bool {
+	emitted := h.emitter.Emitted()
+	if index < 0 || index >= len(emitted) {
+		return h.assert.Fail(msg)
+	}
+	return h.assert.Equal(emitted[index].Targets, targets, msg)
+}
+
+// AssertPanics tests the number of panics of the behavior.
+func (h *BehaviorHarness) AssertPanics(count int, msg string) bool {
+	return h.assert.Length(h.panics, count, msg)
+}
+
+// EOF
@@ -0,0 +1,152 @@
+// Tideland Common Go Library - Cells - Test Harness - Unit Tests
+//
+// Copyright (C) 2010-2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package cellstest_test
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"github.com/denkhaus/tcgl/asserts"
+	"github.com/denkhaus/tcgl/cells"
+	"github.com/denkhaus/tcgl/cells/cellstest"
+	"fmt"
+	"testing"
+	"time"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestBehaviorHarness tests the isolated testing of behaviors.
+func TestBehaviorHarness(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	counter := func(e cells.Event) []string {
+		return []string{e.Topic()}
+	}
+
+	// Counter behavior.
+	h, err := cellstest.NewBehaviorHarness(assert, nil, "counter", cells.NewCounterBehaviorFactory(counter), "collector")
+	assert.Nil(err, "Harness created.")
+	defer h.Stop()
+	h.ProcessSimple("a", true)
+	h.ProcessSimple("b", true)
+	h.ProcessSimple("a", true)
+	h.AssertEmitted(3, "Three counters emitted.")
+	h.AssertTopics([]string{"counter:a", "counter:b", "counter:a"}, "Counter topics.")
+	h.AssertPayloads([]interface{}{int64(1), int64(1), int64(2)}, "Counter values.")
+	h.AssertTargets(0, []cells.Id{"collector"}, "Emitted to subscribers.")
+	assert.NotNil(h.Emitted()[0].Event.Context(), "Context passed.")
+
+	// Ticker driven window behavior.
+	h, err = cellstest.NewBehaviorHarness(assert, nil, "window", cells.NewTumblingWindowBehaviorFactory(0, 0, nil))
+	assert.Nil(err, "Harness created.")
+	defer h.Stop()
+	h.ProcessSimple("value", 1)
+	h.ProcessSimple("value", 2)
+	h.AssertEmitted(0, "Window still open.")
+	h.ProcessTicker("ticker", time.Now())
+	h.AssertTopics([]string{"aggregate(window)"}, "Window closed.")
+	assert.Equal(h.Emitted()[0].Event.Payload().(*cells.Aggregate).Sum, 3.0, "Aggregated.")
+
+	// Selective emitting and panics.
+	h, err = cellstest.NewBehaviorHarness(assert, nil, "balancer", cells.NewWeightedRoundRobinBehaviorFactory(map[cells.Id]int{"b": 2}), "a", "b")
+	assert.Nil(err, "Harness created.")
+	defer h.Stop()
+	h.ProcessSimple("event", 1)
+	h.ProcessSimple("event", 2)
+	h.ProcessSimple("event", 3)
+	h.AssertTargets(0, []cells.Id{"b"}, "Heaviest subscriber first.")
+	h.AssertTargets(1, []cells.Id{"a"}, "Then the lighter one.")
+	h.AssertTargets(2, []cells.Id{"b"}, "And the heavier one again.")
+	h, err = cellstest.NewBehaviorHarness(assert, nil, "panicking", func() cells.Behavior { return &panickingBehavior{} })
+	assert.Nil(err, "Harness created.")
+	defer h.Stop()
+	r := h.ProcessSimple("panic", nil)
+	assert.Equal(r, "panicking behavior", "Panic returned.")
+	h.ProcessSimple("ok", nil)
+	h.AssertPanics(1, "Panic recorded.")
+	h.AssertPayloads([]interface{}{1}, "Processing continued.")
+	h.Reset()
+	h.AssertEmitted(0, "Emitted events cleared.")
+	h.AssertPanics(0, "Panics cleared.")
+	_, err = cellstest.NewBehaviorHarness(assert, nil, "panicking", func() cells.Behavior { return &panickingBehavior{failingInit: true} })
+	assert.True(cells.IsCellInitError(err), "Init error returned.")
+
+	// Failing expectations.
+	failures := 0
+	failing := asserts.NewAsserts(func(test asserts.Test, obtained, expected interface{}, msg string) bool {
+		failures++
+		return false
+	})
+	h, err = cellstest.NewBehaviorHarness(failing, nil, "broadcast", cells.BroadcastBehaviorFactory, "collector")
+	assert.Nil(err, "Harness created.")
+	defer h.Stop()
+	h.ProcessSimple("a", 1)
+	assert.True(h.AssertTopics([]string{"a"}, "Matching topics."), "Expectation fulfilled.")
+	assert.False(h.AssertTopics([]string{"b"}, "Different topics."), "Expectation failed.")
+	assert.False(h.AssertTargets(1, []cells.Id{"collector"}, "Missing event."), "Expectation failed.")
+	assert.Equal(failures, 2, "Failures reported to asserts.")
+}
+
+// TestRecordingEventEmitter tests the recording of emitted events.
+func TestRecordingEventEmitter(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	emitter := cellstest.NewRecordingEventEmitter("b", "a")
+	ctx := cells.NewContext()
+	emitter.SetContext(ctx)
+
+	emitter.EmitSimple("all", 1)
+	emitter.EmitTo(cells.NewSimpleEvent("selected", 2), "b", "c")
+	emitter.EmitTo(cells.NewSimpleEvent("none", 3), "c")
+	assert.Equal(emitter.Subscribers(), []cells.Id{"a", "b"}, "Sorted subscribers.")
+	emitted := emitter.Emitted()
+	assert.Length(emitted, 2, "Events to unknown subscribers ignored.")
+	assert.Equal(emitted[0].Targets, []cells.Id{"a", "b"}, "Emitted to all subscribers.")
+	assert.Equal(emitted[1].Targets, []cells.Id{"b"}, "Emitted to selected subscribers.")
+	assert.Equal(emitted[1].Event.Context(), ctx, "Context passed.")
+	emitter.Reset()
+	assert.Empty(emitter.Emitted(), "Recorded events cleared.")
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// panickingBehavior panics on the topic "panic" and emits the
+// number of processed events otherwise.
+type panickingBehavior struct {
+	failingInit bool
+	processed   int
+}
+
+// Init the behavior.
+func (b *panickingBehavior) Init(env *cells.Environment, id cells.Id) error {
+	if b.failingInit {
+		return fmt.Errorf("init failed")
+	}
+	return nil
+}
+
+// ProcessEvent processes an event.
+func (b *panickingBehavior) ProcessEvent(e cells.Event, emitter cells.EventEmitter) {
+	if e.Topic() == "panic" {
+		panic("panicking behavior")
+	}
+	b.processed++
+	emitter.EmitSimple("processed", b.processed)
+}
+
+// Recover from an error.
+func (b *panickingBehavior) Recover(err interface{}, e cells.Event) {}
+
+// Stop the behavior.
+func (b *panickingBehavior) Stop() {}
+
+// EOF
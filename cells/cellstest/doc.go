@@ -0,0 +1,16 @@
+// Tideland Common Go Library - Cells - Test Harness
+//
+// Copyright (C) 2010-2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+// Helpers for the testing of cell behaviors.
+//
+// The cellstest package provides a harness running one behavior in
+// isolation. Events are processed synchronously, the emitted events
+// are recorded by a RecordingEventEmitter and can be checked with
+// assertion methods.
+package cellstest
+
+// EOF
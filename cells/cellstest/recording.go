@@ -0,0 +1,108 @@
+// Tideland Common Go Library - Cells - Test Harness - Recording cells.Event Emitter
+//
+// Copyright (C) 2010-2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package cellstest
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"github.com/denkhaus/tcgl/cells"
+	"sort"
+)
+
+//--------------------
+// RECORDING EVENT EMITTER
+//--------------------
+
+// EmittedEvent is an event recorded by the RecordingEventEmitter
+// together with the subscribers it has been emitted to.
+type EmittedEvent struct {
+	Event   cells.Event
+	Targets []cells.Id
+}
+
+// RecordingEventEmitter is a SelectiveEventEmitter for tests. It records
+// the emitted events instead of passing them to cells. The behavior
+// harness uses it to run behaviors in isolation.
+type RecordingEventEmitter struct {
+	context     *cells.Context
+	subscribers []cells.Id
+	emitted     []*EmittedEvent
+}
+
+// NewRecordingEventEmitter creates a recording emitter pretending
+// to have the given subscribers.
+func NewRecordingEventEmitter(subscribers ...cells.Id) *RecordingEventEmitter {
+	ids := []string{}
+	for _, id := range subscribers {
+		ids = append(ids, string(id))
+	}
+	sort.Strings(ids)
+	ree := &RecordingEventEmitter{}
+	for _, id := range ids {
+		ree.subscribers = append(ree.subscribers, cells.Id(id))
+	}
+	return ree
+}
+
+// Emit records an event emitted to all subscribers.
+func (ree *RecordingEventEmitter) Emit(e cells.Event) {
+	ree.record(e, ree.subscribers)
+}
+
+// EmitSimple records a simple event emitted to all subscribers.
+func (ree *RecordingEventEmitter) EmitSimple(topic string, payload interface{}) {
+	ree.Emit(cells.NewSimpleEvent(topic, payload))
+}
+
+// EmitTo records an event emitted to those subscribers with the
+// given ids. Like in cells the event is ignored if none of the
+// ids is a subscriber.
+func (ree *RecordingEventEmitter) EmitTo(e cells.Event, ids ...cells.Id) {
+	targets := []cells.Id{}
+	for _, sid := range ree.subscribers {
+		for _, id := range ids {
+			if id == sid {
+				targets = append(targets, sid)
+				break
+			}
+		}
+	}
+	if len(targets) > 0 {
+		ree.record(e, targets)
+	}
+}
+
+// Subscribers returns the sorted ids of the subscribers.
+func (ree *RecordingEventEmitter) Subscribers() []cells.Id {
+	return ree.subscribers
+}
+
+// Emitted returns the recorded events in their order.
+func (ree *RecordingEventEmitter) Emitted() []*EmittedEvent {
+	return ree.emitted
+}
+
+// SetContext sets the context passed to the recorded events.
+func (ree *RecordingEventEmitter) SetContext(c *cells.Context) {
+	ree.context = c
+}
+
+// Reset clears the recorded events.
+func (ree *RecordingEventEmitter) Reset() {
+	ree.emitted = nil
+}
+
+// record passes the context to the event and records it.
+func (ree *RecordingEventEmitter) record(e cells.Event, targets []cells.Id) {
+	e.SetContext(ree.context)
+	ree.emitted = append(ree.emitted, &EmittedEvent{e, targets})
+}
+
+// EOF
@@ -0,0 +1,16 @@
+// Tideland Common Go Library - Cells - Event Bus Bridge
+//
+// Copyright (C) 2010-2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+// Bridge between cells environments and the event bus.
+//
+// The ebusbridge package provides a behavior forwarding the events
+// of a cell to an ebus topic and an agent injecting ebus events into
+// a cell. Importing it registers the forwarder as behavior "ebus-forwarder"
+// with the parameters "topic" and "parts" for topologies.
+package ebusbridge
+
+// EOF
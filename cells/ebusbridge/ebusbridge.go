@@ -0,0 +1,178 @@
+// Tideland Common Go Library - Cells - Event Bus Bridge
+//
+// Copyright (C) 2010-2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package ebusbridge
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"github.com/denkhaus/tcgl/applog"
+	"github.com/denkhaus/tcgl/cells"
+	"github.com/denkhaus/tcgl/ebus"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+//--------------------
+// CONSTANTS
+//--------------------
+
+// TopicHeader is the header of ebus events containing the
+// topic of the forwarded cells event.
+const TopicHeader = "cells-topic"
+
+//--------------------
+// INIT
+//--------------------
+
+// init registers the forwarder behavior for topologies.
+func init() {
+	cells.RegisterBehavior("ebus-forwarder", buildForwarderBehavior)
+}
+
+// buildForwarderBehavior creates a forwarder behavior factory. The
+// parameter "topic" is the mandatory stem, the optional parameter
+// "parts" is a comma separated list of the parts.
+func buildForwarderBehavior(params map[string]string) (cells.BehaviorFactory, error) {
+	topic, ok := params["topic"]
+	if !ok {
+		return nil, fmt.Errorf("missing parameter %q", "topic")
+	}
+	parts := []interface{}{}
+	if value, ok := params["parts"]; ok {
+		for _, field := range strings.Split(value, ",") {
+			parts = append(parts, strings.TrimSpace(field))
+		}
+	}
+	return NewForwarderBehaviorFactory(topic, parts...), nil
+}
+
+//--------------------
+// FORWARDER BEHAVIOR
+//--------------------
+
+// NewForwarderBehaviorFactory creates a constructor for a behavior
+// forwarding the processed events to the event bus topic created out
+// of the stem and the parts. The payload is encoded with the codec of
+// the topic, the cells topic is passed in the header TopicHeader.
+// The event bus has to be initialized. Events injected by an
+// InjectorAgent without payload function can't be forwarded, their
+// ebus events can't be encoded.
+func NewForwarderBehaviorFactory(stem string, parts ...interface{}) cells.BehaviorFactory {
+	return func() cells.Behavior {
+		return &forwarderBehavior{ebus.Id(stem, parts...)}
+	}
+}
+
+// forwarderBehavior forwards events to the event bus.
+type forwarderBehavior struct {
+	topic string
+}
+
+// Init the behavior.
+func (b *forwarderBehavior) Init(env *cells.Environment, id cells.Id) error {
+	return nil
+}
+
+// ProcessEvent processes an event.
+func (b *forwarderBehavior) ProcessEvent(e cells.Event, emitter cells.EventEmitter) {
+	options := ebus.EmitOptions{Headers: map[string]string{TopicHeader: e.Topic()}}
+	err := ebus.EmitWith(options, e.Payload(), b.topic)
+	if err != nil && !ebus.IsNoSubscriberError(err) {
+		applog.Errorf("cannot forward event %q to event bus topic %q: %v", e.Topic(), b.topic, err)
+	}
+}
+
+// Recover from an error.
+func (b *forwarderBehavior) Recover(err interface{}, e cells.Event) {
+	applog.Errorf("cannot forward event %q to event bus topic %q: %v", e.Topic(), b.topic, err)
+}
+
+// Stop the behavior.
+func (b *forwarderBehavior) Stop() {}
+
+//--------------------
+// INJECTOR AGENT
+//--------------------
+
+// PayloadFunc is the signature of a function translating the
+// payload of an ebus event into the payload of a cells event.
+type PayloadFunc func(event ebus.Event) (interface{}, error)
+
+// NewPayloadFunc creates a payload function decoding the ebus
+// payloads into new values of the type of the prototype.
+func NewPayloadFunc(prototype interface{}) PayloadFunc {
+	t := reflect.TypeOf(prototype)
+	return func(event ebus.Event) (interface{}, error) {
+		value := reflect.New(t)
+		if err := event.Payload(value.Interface()); err != nil {
+			return nil, err
+		}
+		return value.Elem().Interface(), nil
+	}
+}
+
+// InjectorAgent is an ebus agent injecting the processed events
+// into a cell of an environment. The topic of the cells event is the
+// one passed in the header TopicHeader, otherwise the ebus topic.
+type InjectorAgent struct {
+	id          string
+	env         *cells.Environment
+	cellId      cells.Id
+	payloadFunc PayloadFunc
+}
+
+// NewInjectorAgent creates an agent injecting events into the cell.
+// The payloads are translated by the payload function. If it's nil the
+// ebus events themselves are the payloads, so that the behaviors can
+// decode them. Those payloads can't be encoded, so the events must not
+// reach a forwarder behavior without being translated.
+func NewInjectorAgent(id string, env *cells.Environment, cellId cells.Id, pf PayloadFunc) *InjectorAgent {
+	return &InjectorAgent{id, env, cellId, pf}
+}
+
+// Id returns the unique identifier of the agent.
+func (a *InjectorAgent) Id() string {
+	return a.id
+}
+
+// Process processes an event.
+func (a *InjectorAgent) Process(event ebus.Event) error {
+	var payload interface{} = event
+	if a.payloadFunc != nil {
+		var err error
+		if payload, err = a.payloadFunc(event); err != nil {
+			return err
+		}
+	}
+	topic := event.Header(TopicHeader)
+	if topic == "" {
+		topic = event.Topic()
+	}
+	_, err := a.env.EmitSimple(a.cellId, topic, payload)
+	return err
+}
+
+// Recover from an error during the processing of an event. The
+// agent logs the error and continues.
+func (a *InjectorAgent) Recover(r interface{}, event ebus.Event) error {
+	applog.Errorf("cannot inject event %q into cell %q: %v", event.Topic(), a.cellId, r)
+	return nil
+}
+
+// Stop tells the agent to cleanup.
+func (a *InjectorAgent) Stop() {}
+
+// Err returns the error the agent possibly stopped with.
+func (a *InjectorAgent) Err() error {
+	return nil
+}
+
+// EOF
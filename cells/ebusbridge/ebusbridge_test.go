@@ -0,0 +1,101 @@
+// Tideland Common Go Library - Cells - Event Bus Bridge - Unit Tests
+//
+// Copyright (C) 2010-2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package ebusbridge_test
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"github.com/denkhaus/tcgl/asserts"
+	"github.com/denkhaus/tcgl/cells"
+	"github.com/denkhaus/tcgl/cells/ebusbridge"
+	"github.com/denkhaus/tcgl/config"
+	"github.com/denkhaus/tcgl/ebus"
+	"strings"
+	"testing"
+	"time"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestBridge tests the forwarding of events between cells and ebus.
+func TestBridge(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	provider := config.NewMapConfigurationProvider()
+	cfg := config.New(provider)
+	cfg.Set("backend", "single")
+	err := ebus.Init(cfg)
+	assert.Nil(err, "Event bus started.")
+	defer ebus.Stop()
+	env := cells.NewEnvironment("ebus-bridge")
+	defer env.Shutdown()
+
+	injected := make(chan cells.Event, 10)
+	env.AddCell("forwarder", ebusbridge.NewForwarderBehaviorFactory("cells", "out"))
+	env.AddCell("receiver", cells.NewSimpleActionBehaviorFactory(func(e cells.Event, emitter cells.EventEmitter) {
+		injected <- e
+	}))
+	injector, err := ebus.Register(ebusbridge.NewInjectorAgent("cells-injector", env, "receiver", ebusbridge.NewPayloadFunc(0)))
+	assert.Nil(err, "Injector registered.")
+	err = ebus.Subscribe(injector, "cells", "out")
+	assert.Nil(err, "Injector subscribed.")
+	raw, err := ebus.Register(ebusbridge.NewInjectorAgent("cells-raw-injector", env, "receiver", nil))
+	assert.Nil(err, "Raw injector registered.")
+	err = ebus.Subscribe(raw, "external")
+	assert.Nil(err, "Raw injector subscribed.")
+
+	// Round trip from cells via ebus back to cells.
+	env.EmitSimple("forwarder", "value", 42)
+	e := receive(assert, injected)
+	assert.Equal(e.Topic(), "value", "Cells topic passed in header.")
+	assert.Equal(e.Payload(), 42, "Payload translated.")
+
+	// Ebus events as payload.
+	err = ebus.Emit("hello", "external")
+	assert.Nil(err, "Event emitted.")
+	e = receive(assert, injected)
+	assert.Equal(e.Topic(), "external", "Ebus topic used.")
+	var payload string
+	err = e.Payload().(ebus.Event).Payload(&payload)
+	assert.Nil(err, "Payload decoded.")
+	assert.Equal(payload, "hello", "Ebus event passed as payload.")
+
+	// Forwarder registered for topologies.
+	err = env.LoadTopology(strings.NewReader(`{topology
+		{cell {id topology-forwarder} {behavior ebus-forwarder} {parameters {topic cells/out}}}
+		{cell {id parts-forwarder} {behavior ebus-forwarder} {parameters {topic cells} {parts out}}}}`))
+	assert.Nil(err, "Topology with forwarder loaded.")
+	env.EmitSimple("topology-forwarder", "topology", 1)
+	e = receive(assert, injected)
+	assert.Equal(e.Topic(), "topology", "Event forwarded by topology cell.")
+	env.EmitSimple("parts-forwarder", "parts", 2)
+	e = receive(assert, injected)
+	assert.Equal(e.Topic(), "parts", "Event forwarded to topic with parts.")
+	err = env.LoadTopology(strings.NewReader(`{topology {cell {id invalid} {behavior ebus-forwarder}}}`))
+	assert.ErrorMatch(err, `.*missing parameter "topic"`, "Topic parameter is mandatory.")
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// receive returns the next injected event or fails after a deadline.
+func receive(assert *asserts.Asserts, injected chan cells.Event) cells.Event {
+	select {
+	case e := <-injected:
+		return e
+	case <-time.After(5 * time.Second):
+		assert.Fail("No event injected.")
+	}
+	return nil
+}
+
+// EOF
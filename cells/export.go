@@ -0,0 +1,159 @@
+// Tideland Common Go Library - Cells - Export
+//
+// Copyright (C) 2010-2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package cells
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"github.com/denkhaus/tcgl/identifier"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+//--------------------
+// EXPORT
+//--------------------
+
+// TopologyExport describes the live topology of an environment.
+type TopologyExport struct {
+	Id      Id              `json:"id"`
+	Cells   []*CellExport   `json:"cells"`
+	Tickers []*TickerExport `json:"tickers"`
+}
+
+// CellExport describes a live cell. The behavior and its parameters
+// are only set if the cell has been added by a topology, the type
+// is the one of the behavior implementation.
+type CellExport struct {
+	CellConfig
+	Type        string `json:"type"`
+	QueueLength int    `json:"queue-length"`
+}
+
+// TickerExport describes a live ticker.
+type TickerExport struct {
+	Id     Id     `json:"id"`
+	EmitId Id     `json:"emit"`
+	Period string `json:"period"`
+}
+
+// ExportTopology returns the cells with their subscriptions and queue
+// lengths as well as the tickers of the environment sorted by id. It
+// doesn't wait for the cells, so it may be called by behaviors too.
+// Subscriptions are contained once the cells have processed them,
+// cells stopping during the export are skipped.
+func (env *Environment) ExportTopology() (*TopologyExport, error) {
+	te, cells := env.exportCells()
+	ids := []string{}
+	for id := range cells {
+		ids = append(ids, string(id))
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		c := cells[Id(id)]
+		if c.queue.closed() {
+			continue
+		}
+		ce := &CellExport{Type: identifier.TypeAsIdentifierPart(c.currentBehavior())}
+		if c.config != nil {
+			ce.CellConfig = *c.config
+		}
+		ce.Id = c.id
+		ce.QueueLimit = c.queue.limit
+		ce.Overflow = ""
+		if c.queue.limit > 0 {
+			ce.Overflow = overflowNames[c.queue.strategy]
+		}
+		ce.Subscribers = c.subscriberIds()
+		ce.QueueLength = c.queue.length()
+		te.Cells = append(te.Cells, ce)
+	}
+	return te, nil
+}
+
+// exportCells returns the export containing the tickers and a
+// copy of the cells, so the cells are exported outside of the
+// locked environment.
+func (env *Environment) exportCells() (*TopologyExport, cellMap) {
+	env.mutex.RLock()
+	defer env.mutex.RUnlock()
+	te := &TopologyExport{Id: env.id, Cells: []*CellExport{}, Tickers: []*TickerExport{}}
+	cells := make(cellMap)
+	for id, c := range env.cells {
+		cells[id] = c
+	}
+	ids := []string{}
+	for id := range env.tickers {
+		ids = append(ids, string(id))
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		t := env.tickers[Id(id)]
+		te.Tickers = append(te.Tickers, &TickerExport{t.id, t.emitId, t.period.String()})
+	}
+	return te, cells
+}
+
+// WriteJSON writes the topology in JSON notation. It extends the
+// notation read by ReadTopology, so cells added by a topology can
+// be loaded again.
+func (te *TopologyExport) WriteJSON(w io.Writer) error {
+	data, err := json.MarshalIndent(te, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// WriteDOT writes the topology as Graphviz DOT directed graph. Cells
+// are labeled with id, behavior and queue length, tickers are drawn
+// as diamonds.
+func (te *TopologyExport) WriteDOT(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "digraph %s {\n", strconv.Quote(string(te.Id)))
+	for _, ce := range te.Cells {
+		behavior := ce.Type
+		if ce.Behavior != "" {
+			behavior = ce.Behavior
+		}
+		label := fmt.Sprintf("%s\n%s\nqueue: %d", ce.Id, behavior, ce.QueueLength)
+		if ce.QueueLimit > 0 {
+			label += fmt.Sprintf("/%d", ce.QueueLimit)
+		}
+		fmt.Fprintf(bw, "\t%s [shape=box,label=%s];\n", strconv.Quote(string(ce.Id)), strconv.Quote(label))
+	}
+	for _, ce := range te.Cells {
+		for _, sid := range ce.Subscribers {
+			fmt.Fprintf(bw, "\t%s -> %s;\n", strconv.Quote(string(ce.Id)), strconv.Quote(string(sid)))
+		}
+	}
+	for _, t := range te.Tickers {
+		node := strconv.Quote("ticker:" + string(t.Id))
+		label := strconv.Quote(fmt.Sprintf("%s\n%s", t.Id, t.Period))
+		fmt.Fprintf(bw, "\t%s [shape=diamond,label=%s];\n", node, label)
+		fmt.Fprintf(bw, "\t%s -> %s [style=dashed];\n", node, strconv.Quote(string(t.EmitId)))
+	}
+	fmt.Fprintf(bw, "}\n")
+	return bw.Flush()
+}
+
+// overflowNames maps the overflow strategies to their names.
+var overflowNames = map[OverflowStrategy]string{
+	OverflowBlock: "block",
+	OverflowDrop:  "drop",
+	OverflowFail:  "fail",
+}
+
+// EOF
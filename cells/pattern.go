@@ -0,0 +1,244 @@
+// Tideland Common Go Library - Cells - Pattern
+//
+// Copyright (C) 2010-2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package cells
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"time"
+)
+
+//--------------------
+// MATCH EVENT
+//--------------------
+
+// MatchEvent signals the match of a pattern.
+type MatchEvent struct {
+	id      string
+	events  []Event
+	context *Context
+}
+
+// Topic returns the topic of the event, here "match([id])"
+// with the id of the pattern.
+func (me MatchEvent) Topic() string {
+	return "match(" + me.id + ")"
+}
+
+// Payload returns the payload of the event, here the
+// captured events in their order.
+func (me MatchEvent) Payload() interface{} {
+	return me.events
+}
+
+// Context returns the context of a set of event processings.
+func (me MatchEvent) Context() *Context {
+	return me.context
+}
+
+// SetContext set the context of a set of event processings.
+func (me *MatchEvent) SetContext(c *Context) {
+	me.context = c
+}
+
+//--------------------
+// PATTERN
+//--------------------
+
+// PredicateFunc is the signature of a function checking
+// the payload or other details of an event.
+type PredicateFunc func(e Event) bool
+
+// patternCondition is a condition an event has to fulfill.
+type patternCondition struct {
+	topic     string
+	predicate PredicateFunc
+}
+
+// matches checks if the event fulfills the condition.
+func (pc *patternCondition) matches(e Event) bool {
+	if pc.topic != "" && pc.topic != e.Topic() {
+		return false
+	}
+	return pc.predicate == nil || pc.predicate(e)
+}
+
+// patternStep is one event of a pattern together with the
+// conditions of events which must not occur before it.
+type patternStep struct {
+	patternCondition
+	exclusions []*patternCondition
+}
+
+// excludes checks if the event matches one of the exclusions.
+func (ps *patternStep) excludes(e Event) bool {
+	for _, exclusion := range ps.exclusions {
+		if exclusion.matches(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultPatternRunLimit is the default maximum number of
+// partial matches of a pattern.
+const DefaultPatternRunLimit = 100
+
+// Pattern describes a sequence of events. It's built by chaining the
+// methods, e.g. "A followed by B within 30s without C in between" is
+//
+//     NewPattern("a-b").Match("A", nil).Without("C", nil).Match("B", nil).Within(30 * time.Second)
+//
+// Events between the matching ones are skipped if they are not excluded.
+type Pattern struct {
+	id       string
+	steps    []*patternStep
+	excluded []*patternCondition
+	within   time.Duration
+	limit    int
+}
+
+// NewPattern creates an empty pattern with the given id.
+func NewPattern(id string) *Pattern {
+	return &Pattern{id: id, limit: DefaultPatternRunLimit}
+}
+
+// Match appends the next event of the sequence. It matches events with
+// the topic, an empty one matches all, and for which the optional
+// predicate returns true.
+func (p *Pattern) Match(topic string, pf PredicateFunc) *Pattern {
+	p.steps = append(p.steps, &patternStep{patternCondition{topic, pf}, p.excluded})
+	p.excluded = nil
+	return p
+}
+
+// Without excludes events with the topic and for which the optional
+// predicate returns true between the last and the next matched event.
+func (p *Pattern) Without(topic string, pf PredicateFunc) *Pattern {
+	p.excluded = append(p.excluded, &patternCondition{topic, pf})
+	return p
+}
+
+// Within limits the duration between the first and the last
+// matched event.
+func (p *Pattern) Within(d time.Duration) *Pattern {
+	p.within = d
+	return p
+}
+
+// Limit sets the maximum number of partial matches. If a new one
+// exceeds it the oldest one is dropped.
+func (p *Pattern) Limit(n int) *Pattern {
+	p.limit = n
+	return p
+}
+
+// validate checks if the pattern is complete.
+func (p *Pattern) validate() error {
+	switch {
+	case len(p.steps) == 0:
+		return PatternError{p.id, "matches no event"}
+	case len(p.steps[0].exclusions) > 0:
+		return PatternError{p.id, "excludes events before its first match"}
+	case len(p.excluded) > 0:
+		return PatternError{p.id, "excludes events after its last match"}
+	case p.limit < 1:
+		return PatternError{p.id, "allows no partial match"}
+	}
+	return nil
+}
+
+//--------------------
+// PATTERN BEHAVIOR
+//--------------------
+
+// NewPatternBehaviorFactory creates a constructor for a pattern behavior.
+// It matches the processed events against the patterns and emits a
+// MatchEvent with the captured events for each match. Every event
+// matching the first step of a pattern starts a new partial match,
+// so overlapping sequences lead to multiple matches. Their number is
+// limited per pattern. The duration of a pattern is measured with
+// the time of processing.
+func NewPatternBehaviorFactory(patterns ...*Pattern) BehaviorFactory {
+	return func() Behavior {
+		return &patternBehavior{patterns, make([][]*patternRun, len(patterns))}
+	}
+}
+
+// patternRun is a partial match of a pattern.
+type patternRun struct {
+	start  time.Time
+	events []Event
+}
+
+// patternBehavior matches events against patterns.
+type patternBehavior struct {
+	patterns []*Pattern
+	runs     [][]*patternRun
+}
+
+// Init the behavior.
+func (b *patternBehavior) Init(env *Environment, id Id) error {
+	for _, p := range b.patterns {
+		if err := p.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ProcessEvent processes an event.
+func (b *patternBehavior) ProcessEvent(e Event, emitter EventEmitter) {
+	now := time.Now()
+	for i, p := range b.patterns {
+		runs := []*patternRun{}
+		// Continue the partial matches.
+		for _, r := range b.runs[i] {
+			if p.within > 0 && now.Sub(r.start) > p.within {
+				continue
+			}
+			step := p.steps[len(r.events)]
+			if step.excludes(e) {
+				continue
+			}
+			if step.matches(e) {
+				r.events = append(r.events, e)
+				if len(r.events) == len(p.steps) {
+					emitter.Emit(&MatchEvent{p.id, r.events, nil})
+					continue
+				}
+			}
+			runs = append(runs, r)
+		}
+		// Start a new partial match.
+		if p.steps[0].matches(e) {
+			if len(p.steps) == 1 {
+				emitter.Emit(&MatchEvent{p.id, []Event{e}, nil})
+			} else {
+				runs = append(runs, &patternRun{now, []Event{e}})
+			}
+		}
+		// Drop the oldest partial matches.
+		if len(runs) > p.limit {
+			runs = runs[len(runs)-p.limit:]
+		}
+		b.runs[i] = runs
+	}
+}
+
+// Recover from an error. All partial matches are dropped.
+func (b *patternBehavior) Recover(err interface{}, e Event) {
+	b.runs = make([][]*patternRun, len(b.patterns))
+}
+
+// Stop the behavior.
+func (b *patternBehavior) Stop() {}
+
+// EOF
@@ -0,0 +1,247 @@
+// Tideland Common Go Library - Cells - Rate Limiting
+//
+// Copyright (C) 2010-2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package cells
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"math"
+	"time"
+)
+
+//--------------------
+// DELAYED EVENT
+//--------------------
+
+// delayedEvent is an event emitted later in the context it has
+// been received in. The context stays active until then.
+type delayedEvent struct {
+	event   Event
+	context *Context
+}
+
+// delay creates a delayed event keeping its context active.
+func delay(e Event) *delayedEvent {
+	ctx := e.Context()
+	if ctx != nil {
+		ctx.incrActivity()
+	}
+	return &delayedEvent{e, ctx}
+}
+
+// release emits the event in its context if the emitter
+// isn't nil and stops keeping the context active.
+func (d *delayedEvent) release(emitter EventEmitter) {
+	if emitter != nil {
+		emitInContext(emitter, d.event, d.context)
+	}
+	if d.context != nil {
+		d.context.decrActivity()
+	}
+}
+
+//--------------------
+// RATE LIMIT BEHAVIOR
+//--------------------
+
+// DefaultDelayLimit is the default maximum number of events
+// delayed by a rate limiting behavior.
+const DefaultDelayLimit = 100
+
+// NewRateLimitBehaviorFactory creates a constructor for a token bucket
+// rate limiting behavior. The bucket holds up to burst tokens and is
+// refilled with rate tokens per second. Each passed event takes one
+// token. Excess events are dropped or, if delayLimit is positive, up
+// to delayLimit of them are queued and emitted in their order with
+// the ticker events the cell receives when enough tokens are available
+// again. Events beyond the limit are dropped. Delayed events are emitted
+// in the context they have been received in, it stays active until then.
+// Delayed events still queued when the behavior stops are dropped.
+func NewRateLimitBehaviorFactory(rate float64, burst, delayLimit int) BehaviorFactory {
+	if burst < 1 {
+		burst = 1
+	}
+	return func() Behavior {
+		return &rateLimitBehavior{rate: rate, burst: float64(burst), delayLimit: delayLimit, clock: time.Now}
+	}
+}
+
+// rateLimitBehavior limits the rate of events with a token bucket.
+// All times are taken from its clock.
+type rateLimitBehavior struct {
+	rate       float64
+	burst      float64
+	delayLimit int
+	tokens     float64
+	last       time.Time
+	delayed    []*delayedEvent
+	clock      func() time.Time
+}
+
+// Init the behavior.
+func (b *rateLimitBehavior) Init(env *Environment, id Id) error {
+	return nil
+}
+
+// ProcessEvent processes an event.
+func (b *rateLimitBehavior) ProcessEvent(e Event, emitter EventEmitter) {
+	b.refill(b.clock())
+	if _, ok := e.(*TickerEvent); ok {
+		for len(b.delayed) > 0 && b.tokens >= 1 {
+			b.tokens--
+			b.delayed[0].release(emitter)
+			b.delayed = b.delayed[1:]
+		}
+		return
+	}
+	switch {
+	case len(b.delayed) == 0 && b.tokens >= 1:
+		b.tokens--
+		emitter.Emit(e)
+	case len(b.delayed) < b.delayLimit:
+		b.delayed = append(b.delayed, delay(e))
+	}
+}
+
+// Recover from an error.
+func (b *rateLimitBehavior) Recover(err interface{}, e Event) {}
+
+// Stop the behavior.
+func (b *rateLimitBehavior) Stop() {
+	for _, d := range b.delayed {
+		d.release(nil)
+	}
+	b.delayed = nil
+}
+
+// refill adds the tokens for the time passed since the last refill.
+func (b *rateLimitBehavior) refill(t time.Time) {
+	if b.last.IsZero() {
+		b.tokens = b.burst
+		b.last = t
+		return
+	}
+	if elapsed := t.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+		b.last = t
+	}
+}
+
+//--------------------
+// DEBOUNCE BEHAVIOR
+//--------------------
+
+// NewDebounceBehaviorFactory creates a constructor for a debouncing
+// behavior. It keeps the latest event and emits it with the first
+// ticker event the cell receives after no new event arrived for the
+// quiet period. Like delayed events of the rate limiting behavior it's
+// emitted in the context it has been received in.
+func NewDebounceBehaviorFactory(quiet time.Duration) BehaviorFactory {
+	return func() Behavior { return &debounceBehavior{quiet: quiet, clock: time.Now} }
+}
+
+// debounceBehavior emits events after a quiet period. All
+// times are taken from its clock.
+type debounceBehavior struct {
+	quiet   time.Duration
+	pending *delayedEvent
+	arrival time.Time
+	clock   func() time.Time
+}
+
+// Init the behavior.
+func (b *debounceBehavior) Init(env *Environment, id Id) error {
+	return nil
+}
+
+// ProcessEvent processes an event.
+func (b *debounceBehavior) ProcessEvent(e Event, emitter EventEmitter) {
+	if _, ok := e.(*TickerEvent); ok {
+		if b.pending != nil && b.clock().Sub(b.arrival) >= b.quiet {
+			b.pending.release(emitter)
+			b.pending = nil
+		}
+		return
+	}
+	if b.pending != nil {
+		b.pending.release(nil)
+	}
+	b.pending = delay(e)
+	b.arrival = b.clock()
+}
+
+// Recover from an error.
+func (b *debounceBehavior) Recover(err interface{}, e Event) {}
+
+// Stop the behavior.
+func (b *debounceBehavior) Stop() {
+	if b.pending != nil {
+		b.pending.release(nil)
+		b.pending = nil
+	}
+}
+
+//--------------------
+// THROTTLE BEHAVIOR
+//--------------------
+
+// NewThrottleBehaviorFactory creates a constructor for a throttling
+// behavior. It emits at most one event per interval and key, others
+// are dropped. If the key function is nil the topic is the key. The
+// ticker events the cell receives remove outdated keys.
+func NewThrottleBehaviorFactory(interval time.Duration, kf KeyFunc) BehaviorFactory {
+	if kf == nil {
+		kf = func(e Event) string { return e.Topic() }
+	}
+	return func() Behavior {
+		return &throttleBehavior{interval, kf, make(map[string]time.Time), time.Now}
+	}
+}
+
+// throttleBehavior limits the events per key. All times
+// are taken from its clock.
+type throttleBehavior struct {
+	interval time.Duration
+	keyFunc  KeyFunc
+	emitted  map[string]time.Time
+	clock    func() time.Time
+}
+
+// Init the behavior.
+func (b *throttleBehavior) Init(env *Environment, id Id) error {
+	return nil
+}
+
+// ProcessEvent processes an event.
+func (b *throttleBehavior) ProcessEvent(e Event, emitter EventEmitter) {
+	now := b.clock()
+	if _, ok := e.(*TickerEvent); ok {
+		for key, t := range b.emitted {
+			if now.Sub(t) >= b.interval {
+				delete(b.emitted, key)
+			}
+		}
+		return
+	}
+	key := b.keyFunc(e)
+	if t, ok := b.emitted[key]; ok && now.Sub(t) < b.interval {
+		return
+	}
+	b.emitted[key] = now
+	emitter.Emit(e)
+}
+
+// Recover from an error.
+func (b *throttleBehavior) Recover(err interface{}, e Event) {}
+
+// Stop the behavior.
+func (b *throttleBehavior) Stop() {}
+
+// EOF
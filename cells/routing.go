@@ -0,0 +1,266 @@
+// Tideland Common Go Library - Cells - Routing
+//
+// Copyright (C) 2010-2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package cells
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"github.com/denkhaus/tcgl/applog"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+)
+
+//--------------------
+// ROUTER BEHAVIOR
+//--------------------
+
+// selectiveEmitter returns the emitter as SelectiveEventEmitter. The
+// routing behaviors drop the event if it isn't one.
+func selectiveEmitter(emitter EventEmitter, e Event) (SelectiveEventEmitter, bool) {
+	se, ok := emitter.(SelectiveEventEmitter)
+	if !ok {
+		applog.Errorf("cannot route event %q without selective event emitter", e.Topic())
+	}
+	return se, ok
+}
+
+// Route maps the events with the topic, an empty one matches all,
+// and for which the optional predicate returns true to the target
+// cells. Those have to be subscribers of the routing cell.
+type Route struct {
+	Topic     string
+	Predicate PredicateFunc
+	Targets   []Id
+}
+
+// NewRouterBehaviorFactory creates a constructor for a content based
+// router behavior. It emits each event to the targets of the first
+// matching route. Events matching no route are dropped, so a final
+// route without topic and predicate acts as default.
+func NewRouterBehaviorFactory(routes ...Route) BehaviorFactory {
+	return func() Behavior { return &routerBehavior{routes} }
+}
+
+// routerBehavior routes events by their content.
+type routerBehavior struct {
+	routes []Route
+}
+
+// Init the behavior.
+func (b *routerBehavior) Init(env *Environment, id Id) error {
+	return nil
+}
+
+// ProcessEvent processes an event.
+func (b *routerBehavior) ProcessEvent(e Event, emitter EventEmitter) {
+	se, ok := selectiveEmitter(emitter, e)
+	if !ok {
+		return
+	}
+	for _, route := range b.routes {
+		pc := &patternCondition{route.Topic, route.Predicate}
+		if pc.matches(e) {
+			se.EmitTo(e, route.Targets...)
+			return
+		}
+	}
+}
+
+// Recover from an error.
+func (b *routerBehavior) Recover(err interface{}, e Event) {}
+
+// Stop the behavior.
+func (b *routerBehavior) Stop() {}
+
+//--------------------
+// HASH PARTITION BEHAVIOR
+//--------------------
+
+// KeyFunc is the signature of a function returning the key
+// of an event used for partitioning.
+type KeyFunc func(e Event) string
+
+// NewHashPartitionBehaviorFactory creates a constructor for a behavior
+// partitioning the events by their key across the subscribers. It uses
+// consistent hashing with the number of replicas per subscriber on the
+// hash ring, so changing subscribers only moves a part of the keys.
+// Values below one mean 100 replicas.
+func NewHashPartitionBehaviorFactory(kf KeyFunc, replicas int) BehaviorFactory {
+	if replicas < 1 {
+		replicas = 100
+	}
+	return func() Behavior { return &hashPartitionBehavior{keyFunc: kf, replicas: replicas} }
+}
+
+// hashRingNode is one replica of a subscriber on the hash ring.
+type hashRingNode struct {
+	hash uint32
+	id   Id
+}
+
+// hashPartitionBehavior distributes events using consistent hashing.
+type hashPartitionBehavior struct {
+	keyFunc     KeyFunc
+	replicas    int
+	subscribers string
+	ring        []hashRingNode
+}
+
+// Init the behavior.
+func (b *hashPartitionBehavior) Init(env *Environment, id Id) error {
+	return nil
+}
+
+// ProcessEvent processes an event.
+func (b *hashPartitionBehavior) ProcessEvent(e Event, emitter EventEmitter) {
+	se, ok := selectiveEmitter(emitter, e)
+	if !ok {
+		return
+	}
+	b.updateRing(se.Subscribers())
+	if len(b.ring) == 0 {
+		return
+	}
+	hash := hashKey(b.keyFunc(e))
+	i := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= hash })
+	if i == len(b.ring) {
+		i = 0
+	}
+	se.EmitTo(e, b.ring[i].id)
+}
+
+// Recover from an error.
+func (b *hashPartitionBehavior) Recover(err interface{}, e Event) {}
+
+// Stop the behavior.
+func (b *hashPartitionBehavior) Stop() {}
+
+// updateRing rebuilds the hash ring if the subscribers changed.
+func (b *hashPartitionBehavior) updateRing(ids []Id) {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = string(id)
+	}
+	subscribers := strings.Join(parts, "\n")
+	if subscribers == b.subscribers && b.ring != nil {
+		return
+	}
+	b.subscribers = subscribers
+	b.ring = []hashRingNode{}
+	for _, id := range ids {
+		for r := 0; r < b.replicas; r++ {
+			b.ring = append(b.ring, hashRingNode{hashKey(fmt.Sprintf("%s#%d", id, r)), id})
+		}
+	}
+	sort.Sort(hashRing(b.ring))
+}
+
+// hashRing sorts the nodes by hash and id.
+type hashRing []hashRingNode
+
+// Len returns the number of nodes.
+func (r hashRing) Len() int {
+	return len(r)
+}
+
+// Swap swaps the nodes with the indexes i and j.
+func (r hashRing) Swap(i, j int) {
+	r[i], r[j] = r[j], r[i]
+}
+
+// Less returns true if the node with index i is less than the one
+// with index j.
+func (r hashRing) Less(i, j int) bool {
+	if r[i].hash == r[j].hash {
+		return r[i].id < r[j].id
+	}
+	return r[i].hash < r[j].hash
+}
+
+// hashKey returns the FNV-1a hash of the key. It's mixed like
+// the finalizer of MurmurHash3, so that similar keys spread
+// across the hash ring.
+func hashKey(key string) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	h := hash.Sum32()
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+//--------------------
+// WEIGHTED ROUND ROBIN BEHAVIOR
+//--------------------
+
+// NewWeightedRoundRobinBehaviorFactory creates a constructor for a behavior
+// distributing the events across the subscribers according to their weights.
+// Subscribers without weight have the weight one, those with a weight below
+// one receive no events. The distribution is smooth, so a subscriber with
+// weight three out of five gets three events interleaved with the others.
+func NewWeightedRoundRobinBehaviorFactory(weights map[Id]int) BehaviorFactory {
+	return func() Behavior {
+		return &weightedRoundRobinBehavior{weights, make(map[Id]int)}
+	}
+}
+
+// weightedRoundRobinBehavior distributes events by weight.
+type weightedRoundRobinBehavior struct {
+	weights map[Id]int
+	current map[Id]int
+}
+
+// Init the behavior.
+func (b *weightedRoundRobinBehavior) Init(env *Environment, id Id) error {
+	return nil
+}
+
+// ProcessEvent processes an event.
+func (b *weightedRoundRobinBehavior) ProcessEvent(e Event, emitter EventEmitter) {
+	se, ok := selectiveEmitter(emitter, e)
+	if !ok {
+		return
+	}
+	current := make(map[Id]int)
+	total := 0
+	var selected Id
+	for _, id := range se.Subscribers() {
+		weight, ok := b.weights[id]
+		if !ok {
+			weight = 1
+		}
+		if weight < 1 {
+			continue
+		}
+		current[id] = b.current[id] + weight
+		total += weight
+		if selected == "" || current[id] > current[selected] {
+			selected = id
+		}
+	}
+	if selected != "" {
+		current[selected] -= total
+		se.EmitTo(e, selected)
+	}
+	b.current = current
+}
+
+// Recover from an error.
+func (b *weightedRoundRobinBehavior) Recover(err interface{}, e Event) {}
+
+// Stop the behavior.
+func (b *weightedRoundRobinBehavior) Stop() {}
+
+// EOF
@@ -0,0 +1,287 @@
+// Tideland Common Go Library - Cells - Snapshot
+//
+// Copyright (C) 2010-2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package cells
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"github.com/denkhaus/tcgl/applog"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sort"
+)
+
+//--------------------
+// SNAPSHOT
+//--------------------
+
+// SnapshotableBehavior is the interface for behaviors which want
+// their state to be part of environment snapshots.
+type SnapshotableBehavior interface {
+	// Snapshot returns the state of the behavior.
+	Snapshot() ([]byte, error)
+	// Restore sets the state of the behavior.
+	Restore(data []byte) error
+}
+
+// environmentSnapshot is the persistent state of an environment.
+type environmentSnapshot struct {
+	Id      Id
+	Cells   []*cellSnapshot
+	Tickers []*TickerConfig
+}
+
+// cellSnapshot is the persistent state of a cell. The config is
+// only set if the cell has been added by a topology.
+type cellSnapshot struct {
+	Id          Id
+	Config      *CellConfig
+	Subscribers []Id
+	State       []byte
+}
+
+// Snapshot writes the cells, their subscriptions, the state of those
+// with a SnapshotableBehavior and the tickers of the environment. Each
+// cell takes its snapshot between the processing of two events, so it
+// must not be called by behaviors, their cells would wait for themselves.
+// Cells stopping during the snapshot are skipped.
+func (env *Environment) Snapshot(w io.Writer) error {
+	es, cells := env.snapshotCells()
+	ids := []string{}
+	for id := range cells {
+		ids = append(ids, string(id))
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		cs, err := cells[Id(id)].snapshot()
+		if IsQueueClosedError(err) {
+			delete(cells, Id(id))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		es.Cells = append(es.Cells, cs)
+	}
+	// Only keep subscribers which have not been removed.
+	for _, cs := range es.Cells {
+		subscribers := []Id{}
+		for _, sid := range cs.Subscribers {
+			if _, ok := cells[sid]; ok {
+				subscribers = append(subscribers, sid)
+			}
+		}
+		cs.Subscribers = subscribers
+	}
+	return gob.NewEncoder(w).Encode(es)
+}
+
+// snapshotCells returns the snapshot containing the tickers and a
+// copy of the cells. The cells take their snapshots outside of the
+// locked environment, their behaviors may use it.
+func (env *Environment) snapshotCells() (*environmentSnapshot, cellMap) {
+	env.mutex.RLock()
+	defer env.mutex.RUnlock()
+	es := &environmentSnapshot{Id: env.id}
+	cells := make(cellMap)
+	for id, c := range env.cells {
+		cells[id] = c
+	}
+	for _, t := range env.tickers {
+		es.Tickers = append(es.Tickers, &TickerConfig{t.id, t.emitId, t.period})
+	}
+	return es, cells
+}
+
+// Restore reads a snapshot written by Snapshot. Missing cells which
+// have been added by a topology are added again, all others have
+// to exist already. Afterwards the states are restored, the cells
+// subscribed and missing tickers started. Cells stopping during the
+// restore are skipped. If restoring fails the former states are
+// restored and the added cells are removed again. Like Snapshot it
+// must not be called by behaviors.
+func (env *Environment) Restore(r io.Reader) error {
+	var es environmentSnapshot
+	if err := gob.NewDecoder(r).Decode(&es); err != nil {
+		return err
+	}
+	cells, added, err := env.restoreCells(&es)
+	if err != nil {
+		return err
+	}
+	// Restore the states outside of the locked environment.
+	formerStates := make(map[Id][]byte)
+	for _, cs := range es.Cells {
+		if cs.State == nil {
+			continue
+		}
+		c := cells[cs.Id]
+		formerState, err := c.state()
+		if err == nil {
+			err = c.restore(cs.State)
+		}
+		if IsQueueClosedError(err) {
+			continue
+		}
+		if err != nil {
+			env.rollbackRestore(cells, formerStates, added)
+			return err
+		}
+		formerStates[cs.Id] = formerState
+	}
+	if err := env.restoreSubscriptions(&es); err != nil {
+		env.rollbackRestore(cells, formerStates, added)
+		return err
+	}
+	return nil
+}
+
+// restoreCells validates the snapshot, adds the missing cells
+// and returns the cells of the snapshot and the ids of the
+// added ones.
+func (env *Environment) restoreCells(es *environmentSnapshot) (cellMap, []Id, error) {
+	env.mutex.Lock()
+	defer env.mutex.Unlock()
+	missing := &Topology{}
+	added := []Id{}
+	for _, cs := range es.Cells {
+		if _, ok := env.cells[cs.Id]; ok {
+			continue
+		}
+		if cs.Config == nil {
+			return nil, nil, CellDoesNotExistError{cs.Id}
+		}
+		cc := *cs.Config
+		cc.Subscribers = nil
+		missing.Cells = append(missing.Cells, &cc)
+		added = append(added, cs.Id)
+	}
+	if err := env.applyTopology(missing); err != nil {
+		return nil, nil, err
+	}
+	cells := make(cellMap)
+	for _, cs := range es.Cells {
+		cells[cs.Id] = env.cells[cs.Id]
+	}
+	return cells, added, nil
+}
+
+// restoreSubscriptions subscribes the cells and starts the missing
+// tickers of the snapshot. All cells are checked before, so that
+// nothing is changed if one is missing.
+func (env *Environment) restoreSubscriptions(es *environmentSnapshot) error {
+	env.mutex.Lock()
+	defer env.mutex.Unlock()
+	for _, cs := range es.Cells {
+		if _, err := env.cells.subset(cs.Id); err != nil {
+			return err
+		}
+		if _, err := env.cells.subset(cs.Subscribers...); err != nil {
+			return err
+		}
+	}
+	for _, cs := range es.Cells {
+		if len(cs.Subscribers) > 0 {
+			if err := env.subscribe(cs.Id, cs.Subscribers...); err != nil && !IsQueueClosedError(err) {
+				return err
+			}
+		}
+	}
+	for _, tc := range es.Tickers {
+		if _, ok := env.tickers[tc.Id]; !ok {
+			env.tickers[tc.Id] = startTicker(env, tc.Id, tc.EmitId, tc.Period)
+		}
+	}
+	return nil
+}
+
+// rollbackRestore restores the former states of the cells and
+// removes the cells added by a failed restore.
+func (env *Environment) rollbackRestore(cells cellMap, formerStates map[Id][]byte, added []Id) {
+	for id, state := range formerStates {
+		if err := cells[id].restore(state); err != nil && !IsQueueClosedError(err) {
+			applog.Errorf("cell %q can't be rolled back: %v", id, err)
+		}
+	}
+	for _, id := range added {
+		env.removeRegisteredCell(cells[id])
+	}
+}
+
+// snapshot lets the cell take the snapshot of its
+// subscriptions and its behavior state.
+func (c *cell) snapshot() (*cellSnapshot, error) {
+	cs := &cellSnapshot{Id: c.id, Config: c.config}
+	var err error
+	derr := c.do(func() {
+		cs.Subscribers = c.subscriberIds()
+		if sb, ok := c.behavior.(SnapshotableBehavior); ok {
+			cs.State, err = sb.Snapshot()
+		}
+	})
+	if derr != nil {
+		return nil, derr
+	}
+	if err != nil {
+		return nil, CellSnapshotError{c.id, err}
+	}
+	return cs, nil
+}
+
+// state returns the state of the behavior.
+func (c *cell) state() ([]byte, error) {
+	sb, ok := c.currentBehavior().(SnapshotableBehavior)
+	if !ok {
+		return nil, CellSnapshotError{c.id, fmt.Errorf("behavior is not snapshotable")}
+	}
+	var state []byte
+	var err error
+	if derr := c.do(func() { state, err = sb.Snapshot() }); derr != nil {
+		return nil, derr
+	}
+	if err != nil {
+		return nil, CellSnapshotError{c.id, err}
+	}
+	return state, nil
+}
+
+// restore lets the cell restore its behavior state.
+func (c *cell) restore(state []byte) error {
+	sb, ok := c.currentBehavior().(SnapshotableBehavior)
+	if !ok {
+		return CellSnapshotError{c.id, fmt.Errorf("behavior is not snapshotable")}
+	}
+	var err error
+	if derr := c.do(func() { err = sb.Restore(state) }); derr != nil {
+		return derr
+	}
+	if err != nil {
+		return CellSnapshotError{c.id, err}
+	}
+	return nil
+}
+
+// encodeState encodes the state of a behavior using gob.
+func encodeState(state interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(state); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeState decodes the state of a behavior using gob.
+func decodeState(data []byte, state interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(state)
+}
+
+// EOF
@@ -0,0 +1,517 @@
+// Tideland Common Go Library - Cells - Topology
+//
+// Copyright (C) 2010-2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package cells
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"github.com/denkhaus/tcgl/markup"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//--------------------
+// BEHAVIOR REGISTRY
+//--------------------
+
+// BehaviorBuilder creates a behavior factory out of the
+// parameters of a topology.
+type BehaviorBuilder func(params map[string]string) (BehaviorFactory, error)
+
+// behaviors stores the behavior builders by name.
+var behaviors = struct {
+	mutex    sync.RWMutex
+	builders map[string]BehaviorBuilder
+}{
+	builders: map[string]BehaviorBuilder{
+		"collector": func(params map[string]string) (BehaviorFactory, error) {
+			return CollectorBehaviorFactory, nil
+		},
+		"log": func(params map[string]string) (BehaviorFactory, error) {
+			return LogBehaviorFactory, nil
+		},
+		"broadcast": func(params map[string]string) (BehaviorFactory, error) {
+			return BroadcastBehaviorFactory, nil
+		},
+		"threshold": buildThresholdBehavior,
+		"tumbling-window": func(params map[string]string) (BehaviorFactory, error) {
+			return buildWindowBehavior(params, NewTumblingWindowBehaviorFactory)
+		},
+		"sliding-window": func(params map[string]string) (BehaviorFactory, error) {
+			return buildWindowBehavior(params, NewSlidingWindowBehaviorFactory)
+		},
+		"weighted-round-robin": func(params map[string]string) (BehaviorFactory, error) {
+			weights := make(map[Id]int)
+			for id, value := range params {
+				weight, err := strconv.Atoi(value)
+				if err != nil {
+					return nil, fmt.Errorf("invalid parameter %q: %v", id, err)
+				}
+				weights[Id(id)] = weight
+			}
+			return NewWeightedRoundRobinBehaviorFactory(weights), nil
+		},
+		"rate-limit": buildRateLimitBehavior,
+		"debounce": func(params map[string]string) (BehaviorFactory, error) {
+			quiet, err := durationParameter(params, "quiet")
+			if err != nil {
+				return nil, err
+			}
+			return NewDebounceBehaviorFactory(quiet), nil
+		},
+		"throttle": func(params map[string]string) (BehaviorFactory, error) {
+			interval, err := durationParameter(params, "interval")
+			if err != nil {
+				return nil, err
+			}
+			return NewThrottleBehaviorFactory(interval, nil), nil
+		},
+	},
+}
+
+// RegisterBehavior makes a behavior available for topologies under
+// the given name. An already registered builder is replaced.
+func RegisterBehavior(name string, bb BehaviorBuilder) {
+	behaviors.mutex.Lock()
+	defer behaviors.mutex.Unlock()
+	behaviors.builders[name] = bb
+}
+
+// lookupBehavior returns the behavior builder with the name.
+func lookupBehavior(name string) (BehaviorBuilder, bool) {
+	behaviors.mutex.RLock()
+	defer behaviors.mutex.RUnlock()
+	bb, ok := behaviors.builders[name]
+	return bb, ok
+}
+
+// buildThresholdBehavior creates a threshold behavior factory. The
+// parameters are "initial-counter", "ticker-difference", "ticker-direction",
+// "upper-threshold" and "lower-threshold", all defaulting to 0.
+func buildThresholdBehavior(params map[string]string) (BehaviorFactory, error) {
+	names := []string{"initial-counter", "ticker-difference", "ticker-direction", "upper-threshold", "lower-threshold"}
+	values := make([]int64, len(names))
+	for i, name := range names {
+		value, ok := params[name]
+		if !ok {
+			continue
+		}
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid parameter %q: %v", name, err)
+		}
+		values[i] = v
+	}
+	return NewThresholdBehaviorFactory(values[0], values[1], values[2], values[3], values[4]), nil
+}
+
+// buildWindowBehavior creates a window behavior factory aggregating the
+// payloads. The parameters are "size" as duration, "count" and a comma
+// separated list of "percentiles", all optional.
+func buildWindowBehavior(params map[string]string, wbf func(time.Duration, int, ValueFunc, ...int) BehaviorFactory) (BehaviorFactory, error) {
+	var size time.Duration
+	var count int
+	var percentiles []int
+	var err error
+	if value, ok := params["size"]; ok {
+		if size, err = time.ParseDuration(value); err != nil {
+			return nil, fmt.Errorf("invalid parameter %q: %v", "size", err)
+		}
+	}
+	if value, ok := params["count"]; ok {
+		if count, err = strconv.Atoi(value); err != nil {
+			return nil, fmt.Errorf("invalid parameter %q: %v", "count", err)
+		}
+	}
+	if value, ok := params["percentiles"]; ok {
+		for _, field := range strings.Split(value, ",") {
+			p, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil || p < 0 || p > 100 {
+				return nil, fmt.Errorf("invalid parameter %q: percentile %q", "percentiles", field)
+			}
+			percentiles = append(percentiles, p)
+		}
+	}
+	return wbf(size, count, nil, percentiles...), nil
+}
+
+// buildRateLimitBehavior creates a rate limit behavior factory. The
+// parameters are "rate" in events per second, "burst" defaulting to 1
+// and "mode" as "drop", the default, or "delay". The latter allows the
+// "delay-limit" defaulting to DefaultDelayLimit.
+func buildRateLimitBehavior(params map[string]string) (BehaviorFactory, error) {
+	value, ok := params["rate"]
+	if !ok {
+		return nil, fmt.Errorf("missing parameter %q", "rate")
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid parameter %q: %v", "rate", err)
+	}
+	burst := 1
+	if value, ok := params["burst"]; ok {
+		if burst, err = strconv.Atoi(value); err != nil {
+			return nil, fmt.Errorf("invalid parameter %q: %v", "burst", err)
+		}
+	}
+	delayLimit := 0
+	switch params["mode"] {
+	case "", "drop":
+	case "delay":
+		delayLimit = DefaultDelayLimit
+		if value, ok := params["delay-limit"]; ok {
+			if delayLimit, err = strconv.Atoi(value); err != nil {
+				return nil, fmt.Errorf("invalid parameter %q: %v", "delay-limit", err)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("invalid parameter %q: mode %q", "mode", params["mode"])
+	}
+	return NewRateLimitBehaviorFactory(rate, burst, delayLimit), nil
+}
+
+// durationParameter returns the required duration parameter with the name.
+func durationParameter(params map[string]string, name string) (time.Duration, error) {
+	value, ok := params[name]
+	if !ok {
+		return 0, fmt.Errorf("missing parameter %q", name)
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid parameter %q: %v", name, err)
+	}
+	return d, nil
+}
+
+//--------------------
+// TOPOLOGY
+//--------------------
+
+// Topology describes a network of cells and tickers.
+type Topology struct {
+	Cells   []*CellConfig
+	Tickers []*TickerConfig
+}
+
+// CellConfig describes one cell of a topology. The behavior is the name
+// of a registered behavior builder, the parameters are passed to it.
+// A queue limit greater than zero limits the cell queue, overflows are
+// handled by the strategy "block", "drop" or "fail".
+type CellConfig struct {
+	Id          Id                `json:"id"`
+	Behavior    string            `json:"behavior"`
+	Parameters  map[string]string `json:"parameters,omitempty"`
+	Subscribers []Id              `json:"subscribers,omitempty"`
+	QueueLimit  int               `json:"queue-limit,omitempty"`
+	Overflow    string            `json:"overflow,omitempty"`
+}
+
+// TickerConfig describes one ticker of a topology.
+type TickerConfig struct {
+	Id     Id            `json:"id"`
+	EmitId Id            `json:"emit"`
+	Period time.Duration `json:"-"`
+}
+
+// overflowStrategies maps the names of the overflow strategies.
+var overflowStrategies = map[string]OverflowStrategy{
+	"":      OverflowBlock,
+	"block": OverflowBlock,
+	"drop":  OverflowDrop,
+	"fail":  OverflowFail,
+}
+
+// ReadTopology reads a topology in SML or JSON notation. The SML
+// notation looks like
+//
+//   {topology
+//     {cell {id counter} {behavior threshold}
+//       {parameters {upper-threshold 10}}
+//       {subscribers {id logger}}
+//       {queue-limit 100} {overflow drop}}
+//     {cell {id logger} {behavior log}}
+//     {ticker {id clock} {emit counter} {period 1s}}}
+//
+// while the JSON notation uses an object with the fields "cells" and
+// "tickers" containing the same fields per cell and ticker.
+func ReadTopology(reader io.Reader) (*Topology, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if isJSONTopology(data) {
+		return readJSONTopology(data)
+	}
+	builder := &topologyBuilder{topology: &Topology{}}
+	if err := markup.ReadSML(bytes.NewReader(data), builder); err != nil {
+		return nil, err
+	}
+	return builder.topology, nil
+}
+
+// LoadTopology reads a topology like ReadTopology and
+// applies it to the environment.
+func (env *Environment) LoadTopology(reader io.Reader) error {
+	topology, err := ReadTopology(reader)
+	if err != nil {
+		return err
+	}
+	return env.ApplyTopology(topology)
+}
+
+// ApplyTopology validates the topology, adds its cells, subscribes
+// them and starts the tickers. Subscribers may also be cells already
+// existing in the environment. Nothing is changed if the validation
+// or the start of a cell fails.
+func (env *Environment) ApplyTopology(topology *Topology) error {
+	env.mutex.Lock()
+	defer env.mutex.Unlock()
+	return env.applyTopology(topology)
+}
+
+// applyTopology applies the topology in a write-locked environment state.
+func (env *Environment) applyTopology(topology *Topology) error {
+	// Validate and build the behavior factories.
+	factories := make(map[Id]BehaviorFactory)
+	for _, cc := range topology.Cells {
+		if cc.Id == "" {
+			return TopologyError{Msg: "cell without id"}
+		}
+		if _, ok := factories[cc.Id]; ok {
+			return TopologyError{Id: cc.Id, Msg: "cell defined twice"}
+		}
+		if _, ok := env.cells[cc.Id]; ok {
+			return TopologyError{Id: cc.Id, Msg: "cell already exists"}
+		}
+		bb, ok := lookupBehavior(cc.Behavior)
+		if !ok {
+			return TopologyError{Id: cc.Id, Msg: fmt.Sprintf("unknown behavior %q", cc.Behavior)}
+		}
+		if _, ok := overflowStrategies[cc.Overflow]; !ok {
+			return TopologyError{Id: cc.Id, Msg: fmt.Sprintf("unknown overflow strategy %q", cc.Overflow)}
+		}
+		bf, err := bb(cc.Parameters)
+		if err != nil {
+			return TopologyError{Id: cc.Id, Msg: err.Error()}
+		}
+		factories[cc.Id] = bf
+	}
+	exists := func(id Id) bool {
+		_, inTopology := factories[id]
+		_, inEnvironment := env.cells[id]
+		return inTopology || inEnvironment
+	}
+	for _, cc := range topology.Cells {
+		for _, id := range cc.Subscribers {
+			if !exists(id) {
+				return TopologyError{Id: cc.Id, Msg: fmt.Sprintf("unknown subscriber %q", id)}
+			}
+		}
+	}
+	tickers := make(map[Id]bool)
+	for _, tc := range topology.Tickers {
+		switch {
+		case tc.Id == "":
+			return TopologyError{Msg: fmt.Sprintf("ticker emitting to %q without id", tc.EmitId), Ticker: true}
+		case tickers[tc.Id]:
+			return TopologyError{Id: tc.Id, Msg: "ticker defined twice", Ticker: true}
+		case env.tickers[tc.Id] != nil:
+			return TopologyError{Id: tc.Id, Msg: "ticker already exists", Ticker: true}
+		case !exists(tc.EmitId):
+			return TopologyError{Id: tc.Id, Msg: fmt.Sprintf("ticker emits to unknown cell %q", tc.EmitId), Ticker: true}
+		case tc.Period <= 0:
+			return TopologyError{Id: tc.Id, Msg: "ticker has no period", Ticker: true}
+		}
+		tickers[tc.Id] = true
+	}
+	// Start the cells, subscribe them and start the tickers. If one
+	// fails the already started cells are removed again. Only those
+	// emit, so their subscriptions are removed with them.
+	started := []*cell{}
+	rollback := func(id Id, err error) error {
+		for _, c := range started {
+			delete(env.cells, c.id)
+			c.stop()
+		}
+		return TopologyError{Id: id, Msg: err.Error()}
+	}
+	for _, cc := range topology.Cells {
+		if _, err := env.startCell(cc.Id, factories[cc.Id], cc.QueueLimit, overflowStrategies[cc.Overflow], nil); err != nil {
+			return rollback(cc.Id, err)
+		}
+		c := env.cells[cc.Id]
+		c.config = cc
+		started = append(started, c)
+	}
+	for _, cc := range topology.Cells {
+		if len(cc.Subscribers) > 0 {
+			if err := env.subscribe(cc.Id, cc.Subscribers...); err != nil {
+				return rollback(cc.Id, err)
+			}
+		}
+	}
+	for _, tc := range topology.Tickers {
+		env.tickers[tc.Id] = startTicker(env, tc.Id, tc.EmitId, tc.Period)
+	}
+	return nil
+}
+
+//--------------------
+// JSON
+//--------------------
+
+// jsonTopology is the JSON notation of a topology.
+type jsonTopology struct {
+	Cells   []*CellConfig `json:"cells"`
+	Tickers []*jsonTicker `json:"tickers"`
+}
+
+// jsonTicker is the JSON notation of a ticker with
+// the period as duration string.
+type jsonTicker struct {
+	TickerConfig
+	Period string `json:"period"`
+}
+
+// isJSONTopology checks if the data starts like a JSON object.
+func isJSONTopology(data []byte) bool {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return false
+	}
+	trimmed = bytes.TrimSpace(trimmed[1:])
+	return len(trimmed) > 0 && (trimmed[0] == '"' || trimmed[0] == '}')
+}
+
+// readJSONTopology reads a topology in JSON notation.
+func readJSONTopology(data []byte) (*Topology, error) {
+	var jt jsonTopology
+	if err := json.Unmarshal(data, &jt); err != nil {
+		return nil, err
+	}
+	topology := &Topology{Cells: jt.Cells}
+	for _, jtc := range jt.Tickers {
+		tc := jtc.TickerConfig
+		period, err := time.ParseDuration(jtc.Period)
+		if err != nil {
+			return nil, TopologyError{Id: tc.Id, Msg: fmt.Sprintf("ticker has invalid period: %v", err), Ticker: true}
+		}
+		tc.Period = period
+		topology.Tickers = append(topology.Tickers, &tc)
+	}
+	return topology, nil
+}
+
+//--------------------
+// SML
+//--------------------
+
+// topologyBuilder builds a topology while an SML document is read.
+type topologyBuilder struct {
+	topology *Topology
+	tags     []string
+	text     string
+	cell     *CellConfig
+	ticker   *TickerConfig
+}
+
+// BeginTagNode starts a cell, a ticker or one of their fields.
+func (b *topologyBuilder) BeginTagNode(tag string) error {
+	b.tags = append(b.tags, tag)
+	b.text = ""
+	path := strings.Join(b.tags, "/")
+	switch {
+	case path == "topology":
+	case path == "topology/cell":
+		b.cell = &CellConfig{Parameters: make(map[string]string)}
+		b.topology.Cells = append(b.topology.Cells, b.cell)
+	case path == "topology/ticker":
+		b.ticker = &TickerConfig{}
+		b.topology.Tickers = append(b.topology.Tickers, b.ticker)
+	case len(b.tags) == 3 || path == "topology/cell/subscribers/id":
+	case len(b.tags) == 4 && b.tags[2] == "parameters":
+	default:
+		return b.error(fmt.Sprintf("invalid tag %q", path))
+	}
+	return nil
+}
+
+// EndTagNode sets the field of the ending tag.
+func (b *topologyBuilder) EndTagNode() error {
+	path := strings.Join(b.tags, "/")
+	text := strings.TrimSpace(b.text)
+	b.tags = b.tags[:len(b.tags)-1]
+	b.text = ""
+	switch path {
+	case "topology", "topology/cell", "topology/ticker", "topology/cell/parameters", "topology/cell/subscribers":
+	case "topology/cell/id":
+		b.cell.Id = Id(text)
+	case "topology/cell/behavior":
+		b.cell.Behavior = text
+	case "topology/cell/subscribers/id":
+		b.cell.Subscribers = append(b.cell.Subscribers, Id(text))
+	case "topology/cell/queue-limit":
+		limit, err := strconv.Atoi(text)
+		if err != nil {
+			return b.error(fmt.Sprintf("invalid queue limit %q", text))
+		}
+		b.cell.QueueLimit = limit
+	case "topology/cell/overflow":
+		b.cell.Overflow = text
+	case "topology/ticker/id":
+		b.ticker.Id = Id(text)
+	case "topology/ticker/emit":
+		b.ticker.EmitId = Id(text)
+	case "topology/ticker/period":
+		period, err := time.ParseDuration(text)
+		if err != nil {
+			return b.error(fmt.Sprintf("invalid period %q", text))
+		}
+		b.ticker.Period = period
+	default:
+		if strings.HasPrefix(path, "topology/cell/parameters/") {
+			b.cell.Parameters[strings.TrimPrefix(path, "topology/cell/parameters/")] = text
+			return nil
+		}
+		return b.error(fmt.Sprintf("invalid tag %q", path))
+	}
+	return nil
+}
+
+// AppendTextNode collects the text of the current tag.
+func (b *topologyBuilder) AppendTextNode(text string) error {
+	b.text += text
+	return nil
+}
+
+// AppendRawNode collects raw text like normal text.
+func (b *topologyBuilder) AppendRawNode(raw string) error {
+	return b.AppendTextNode(raw)
+}
+
+// error returns a topology error for the current cell or ticker.
+func (b *topologyBuilder) error(msg string) error {
+	if len(b.tags) > 1 && b.tags[1] == "ticker" && b.ticker != nil {
+		return TopologyError{Id: b.ticker.Id, Msg: msg, Ticker: true}
+	}
+	if b.cell != nil {
+		return TopologyError{Id: b.cell.Id, Msg: msg}
+	}
+	return TopologyError{Msg: msg}
+}
+
+// EOF
@@ -14,6 +14,8 @@ package cells
 import (
 	"github.com/denkhaus/tcgl/identifier"
 	"fmt"
+	"reflect"
+	"sort"
 	"sync"
 	"time"
 )
@@ -51,6 +53,20 @@ func (cm cellMap) subset(ids ...Id) (cellMap, error) {
 	return scm, nil
 }
 
+// ids returns the sorted ids of the cells.
+func (cm cellMap) ids() []Id {
+	ids := []string{}
+	for id := range cm {
+		ids = append(ids, string(id))
+	}
+	sort.Strings(ids)
+	sids := make([]Id, len(ids))
+	for i, id := range ids {
+		sids[i] = Id(id)
+	}
+	return sids
+}
+
 //--------------------
 // CELL MESSAGE QUEUE
 //--------------------
@@ -61,6 +77,7 @@ type cellMessage struct {
 	event Event
 	cells cellMap
 	add   bool
+	do    func()
 }
 
 // String returns a readable representation of the message.
@@ -72,28 +89,101 @@ func (m cellMessage) String() string {
 	return fmt.Sprintf("<%v %v %v>", EventString(m.event), ids, m.add)
 }
 
-// cellMessageQueue provides an unlimitted message queue for the cells.
+// blockTimeout is the time an emitter waits for space in a
+// full queue with the strategy OverflowBlock.
+const blockTimeout = 5 * time.Second
+
+// cellMessageQueue provides a message queue for the cells. If it has
+// a limit only event messages are limited, subscription changes and
+// the stopping are always accepted. After the stopping has been
+// pushed no more messages are accepted.
 type cellMessageQueue struct {
-	cond   *sync.Cond
-	buffer []*cellMessage
+	cond     *sync.Cond
+	buffer   []*cellMessage
+	id       Id
+	limit    int
+	strategy OverflowStrategy
+	timeout  time.Duration
+	events   int
+	closing  bool
 }
 
-// newCellMessageQueue creates an empty message queue.
-func newCellMessageQueue() *cellMessageQueue {
+// newBoundedCellMessageQueue creates an empty message queue for the
+// cell with the id and the given number of events handling overflows
+// based on the strategy. A limit of zero or less means unlimited.
+func newBoundedCellMessageQueue(id Id, limit int, strategy OverflowStrategy) *cellMessageQueue {
 	var locker sync.Mutex
-	return &cellMessageQueue{sync.NewCond(&locker), make([]*cellMessage, 0)}
+	return &cellMessageQueue{
+		cond:     sync.NewCond(&locker),
+		buffer:   make([]*cellMessage, 0),
+		id:       id,
+		limit:    limit,
+		strategy: strategy,
+		timeout:  blockTimeout,
+	}
+}
+
+// push appends a new message to the queue. It returns true if
+// the event has been dropped due to the overflow strategy.
+func (q *cellMessageQueue) push(event Event, cells cellMap, add bool) (bool, error) {
+	return q.pushMessage(&cellMessage{event, cells, add, nil})
 }
 
-// push appends a new message to the queue.
-func (q *cellMessageQueue) push(event Event, cells cellMap, add bool) error {
+// pushDo appends a message with a function to be executed
+// by the cell between the processing of events.
+func (q *cellMessageQueue) pushDo(f func()) error {
+	_, err := q.pushMessage(&cellMessage{do: f})
+	return err
+}
+
+// pushMessage appends a message to the queue. With OverflowBlock
+// the push waits at most for the timeout of the queue, so cells
+// emitting into each others full queues can't deadlock.
+func (q *cellMessageQueue) pushMessage(message *cellMessage) (bool, error) {
+	event := message.event
 	q.cond.L.Lock()
 	defer q.cond.L.Unlock()
-	if q.buffer == nil {
-		return QueueClosedError{}
+	if event != nil && q.limit > 0 {
+		var deadline time.Time
+		for !q.closing && q.buffer != nil && q.events >= q.limit {
+			switch q.strategy {
+			case OverflowDrop:
+				return true, nil
+			case OverflowFail:
+				return true, QueueFullError{q.id, q.limit}
+			default:
+				if deadline.IsZero() {
+					deadline = time.Now().Add(q.timeout)
+					timer := time.AfterFunc(q.timeout, q.wakeup)
+					defer timer.Stop()
+				}
+				if !time.Now().Before(deadline) {
+					return true, QueueFullError{q.id, q.limit}
+				}
+				q.cond.Wait()
+			}
+		}
 	}
-	q.buffer = append(q.buffer, &cellMessage{event, cells, add})
-	q.cond.Signal()
-	return nil
+	if q.closing || q.buffer == nil {
+		return false, QueueClosedError{}
+	}
+	q.buffer = append(q.buffer, message)
+	switch {
+	case event != nil:
+		q.events++
+	case message.cells == nil && message.do == nil:
+		q.closing = true
+	}
+	q.cond.Broadcast()
+	return false, nil
+}
+
+// wakeup wakes up all waiting pushes and pulls so
+// that they can check their conditions again.
+func (q *cellMessageQueue) wakeup() {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.cond.Broadcast()
 }
 
 // pull retrieves a message out of the queue. If it's empty pull
@@ -110,14 +200,33 @@ func (q *cellMessageQueue) pull() (msg *cellMessage) {
 			break
 		}
 	}
+	if msg.event != nil {
+		q.events--
+		q.cond.Broadcast()
+	}
 	return
 }
 
+// length returns the number of queued events.
+func (q *cellMessageQueue) length() int {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return q.events
+}
+
+// closed returns true if the stopping has been pushed.
+func (q *cellMessageQueue) closed() bool {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return q.closing || q.buffer == nil
+}
+
 // close tells the queue to stop working.
 func (q *cellMessageQueue) close() {
 	q.cond.L.Lock()
 	defer q.cond.L.Unlock()
 	q.buffer = nil
+	q.cond.Broadcast()
 }
 
 //--------------------
@@ -126,18 +235,29 @@ func (q *cellMessageQueue) close() {
 
 // Context allows a number of coherent event processings to store
 // and retrieves values useful for an event emitter and wait for all
-// cells to end processing their events in this context.
+// cells to end processing their events in this context. Additionally
+// cells can set results, their errors are collected and the processing
+// can be canceled or limited by a deadline.
 type Context struct {
 	mutex           sync.RWMutex
 	values          map[Id]interface{}
+	results         map[Id]interface{}
+	errors          map[Id]error
+	contributors    map[Id]bool
+	canceled        bool
+	deadline        time.Time
 	activityCounter int
 	doneChan        chan bool
 }
 
-// newContext creates a new event processing context.
-func newContext() *Context {
+// NewContext creates a new event processing context. Usually
+// it is created when events are emitted to an environment.
+func NewContext() *Context {
 	return &Context{
 		values:          make(map[Id]interface{}),
+		results:         make(map[Id]interface{}),
+		errors:          make(map[Id]error),
+		contributors:    make(map[Id]bool),
 		activityCounter: 1,
 		doneChan:        make(chan bool, 1),
 	}
@@ -170,6 +290,126 @@ func (c *Context) Do(f func(key Id, value interface{})) {
 	}
 }
 
+// SetResult sets the result of the cell with the id.
+func (c *Context) SetResult(id Id, result interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.results[id] = result
+}
+
+// Result stores the result of the cell with the id in the value
+// the passed pointer points to. The result has to be assignable,
+// otherwise or if there's no result a ContextResultError is returned.
+func (c *Context) Result(id Id, result interface{}) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	r, ok := c.results[id]
+	if !ok {
+		return ContextResultError{id, "does not exist"}
+	}
+	rv := reflect.ValueOf(result)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return ContextResultError{id, fmt.Sprintf("needs a non-nil pointer, got %T", result)}
+	}
+	if r == nil {
+		rv.Elem().Set(reflect.Zero(rv.Elem().Type()))
+		return nil
+	}
+	if !reflect.TypeOf(r).AssignableTo(rv.Elem().Type()) {
+		return ContextResultError{id, fmt.Sprintf("is %T, not assignable to %s", r, rv.Elem().Type())}
+	}
+	rv.Elem().Set(reflect.ValueOf(r))
+	return nil
+}
+
+// Results returns a copy of the results of all cells.
+func (c *Context) Results() map[Id]interface{} {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	results := make(map[Id]interface{})
+	for id, result := range c.results {
+		results[id] = result
+	}
+	return results
+}
+
+// Errors returns the errors of those cells which had to recover
+// while processing an event of the context.
+func (c *Context) Errors() map[Id]error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	errors := make(map[Id]error)
+	for id, err := range c.errors {
+		errors[id] = err
+	}
+	return errors
+}
+
+// Contributors returns the sorted ids of the cells which
+// processed events of the context.
+func (c *Context) Contributors() []Id {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	cm := make(cellMap)
+	for id := range c.contributors {
+		cm[id] = nil
+	}
+	return cm.ids()
+}
+
+// Cancel cancels the processing of the context. Cells don't process
+// queued events of the context anymore and don't emit new ones.
+// Running processings can check Canceled.
+func (c *Context) Cancel() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.canceled = true
+}
+
+// SetDeadline sets the time after which the processing of the
+// context is canceled. An earlier deadline is kept.
+func (c *Context) SetDeadline(deadline time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.deadline.IsZero() || deadline.Before(c.deadline) {
+		c.deadline = deadline
+	}
+}
+
+// Deadline returns the deadline of the context and true if
+// one is set.
+func (c *Context) Deadline() (time.Time, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.deadline, !c.deadline.IsZero()
+}
+
+// Canceled returns true if the context has been canceled or
+// its deadline has passed.
+func (c *Context) Canceled() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.canceled || (!c.deadline.IsZero() && !time.Now().Before(c.deadline))
+}
+
+// contribute marks the cell as contributor.
+func (c *Context) contribute(id Id) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.contributors[id] = true
+}
+
+// setError stores the reason of a recovering cell as error.
+func (c *Context) setError(id Id, reason interface{}) {
+	err, ok := reason.(error)
+	if !ok {
+		err = fmt.Errorf("%v", reason)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.errors[id] = err
+}
+
 // incrActivity indicates, that one more cell is working in the context.
 func (c *Context) incrActivity() {
 	c.mutex.Lock()
@@ -253,6 +493,12 @@ func NewTickerEvent(id Id) *TickerEvent {
 	return &TickerEvent{id, time.Now(), nil}
 }
 
+// NewTickerEventAt creates a new ticker event instance with a
+// given id and time, e.g. for tests of behaviors.
+func NewTickerEventAt(id Id, t time.Time) *TickerEvent {
+	return &TickerEvent{id, t, nil}
+}
+
 // Topic returns the topic of the event, here "ticker([id])".
 func (te TickerEvent) Topic() string {
 	return fmt.Sprintf("ticker(%s)", te.id)
@@ -274,6 +520,78 @@ func (te *TickerEvent) SetContext(c *Context) {
 	te.context = c
 }
 
+//--------------------
+// RESTART
+//--------------------
+
+// restartFrequency checks the maximum number of restarts
+// of a cell in a given period.
+type restartFrequency struct {
+	intensity int
+	period    time.Duration
+	restarts  []time.Time
+}
+
+// newRestartFrequency returns an initialized restart frequency.
+func newRestartFrequency(intensity int, period time.Duration) *restartFrequency {
+	if intensity < 1 {
+		intensity = 1
+	}
+	return &restartFrequency{intensity, period, []time.Time{}}
+}
+
+// check stores a restart and checks the frequency. If the
+// limit is exceeded an error is returned.
+func (f *restartFrequency) check(id Id) error {
+	now := time.Now()
+	restarts := []time.Time{}
+	for _, restart := range f.restarts {
+		if now.Sub(restart) <= f.period {
+			restarts = append(restarts, restart)
+		}
+	}
+	f.restarts = append(restarts, now)
+	if len(f.restarts) > f.intensity {
+		f.restarts = []time.Time{}
+		return TooMuchRestartsError{id, f.intensity, f.period}
+	}
+	return nil
+}
+
+// RestartEvent signals the restart of a supervised cell to
+// the system cell.
+type RestartEvent struct {
+	Id      Id
+	Reason  interface{}
+	GaveUp  bool
+	context *Context
+}
+
+// Topic returns the topic of the event, here "restart([id])" or
+// "restart-failed([id])" if the cell gave up.
+func (re RestartEvent) Topic() string {
+	if re.GaveUp {
+		return fmt.Sprintf("restart-failed(%s)", re.Id)
+	}
+	return fmt.Sprintf("restart(%s)", re.Id)
+}
+
+// Payload returns the payload of the event, here the reason of the
+// restart or the error the cell gave up with.
+func (re RestartEvent) Payload() interface{} {
+	return re.Reason
+}
+
+// Context returns the context of a set of event processings.
+func (re RestartEvent) Context() *Context {
+	return re.context
+}
+
+// SetContext set the context of a set of event processings.
+func (re *RestartEvent) SetContext(c *Context) {
+	re.context = c
+}
+
 //--------------------
 // HELPER FUNCTIONS
 //--------------------
@@ -324,6 +642,23 @@ func IsCellAlreadyExistsError(err error) bool {
 	return ok
 }
 
+// CellIdReservedError will be returned if a cell shall be added
+// with a reserved id like the SystemCellId.
+type CellIdReservedError struct {
+	Id Id
+}
+
+// Error returns the error as string.
+func (e CellIdReservedError) Error() string {
+	return fmt.Sprintf("cell id %q is reserved", e.Id)
+}
+
+// IsCellIdReservedError checks if an error is a cell id reserved error.
+func IsCellIdReservedError(err error) bool {
+	_, ok := err.(CellIdReservedError)
+	return ok
+}
+
 // CellDoesNotExistError will be returned if a cell does not exist.
 type CellDoesNotExistError struct {
 	Id Id
@@ -357,6 +692,123 @@ func IsCellStoppedError(err error) bool {
 	return ok
 }
 
+// QueueFullError will be returned if the message queue of a cell
+// with the overflow strategy OverflowFail is full.
+type QueueFullError struct {
+	Id    Id
+	Limit int
+}
+
+// Error returns the error as string.
+func (e QueueFullError) Error() string {
+	return fmt.Sprintf("queue of cell %q is full with %d events", e.Id, e.Limit)
+}
+
+// IsQueueFullError checks if an error is a queue full error.
+func IsQueueFullError(err error) bool {
+	_, ok := err.(QueueFullError)
+	return ok
+}
+
+// TopologyError will be returned if a topology is invalid. The
+// id is the one of the offending cell or, if Ticker is true, of
+// the offending ticker.
+type TopologyError struct {
+	Id     Id
+	Msg    string
+	Ticker bool
+}
+
+// Error returns the error as string.
+func (e TopologyError) Error() string {
+	switch {
+	case e.Id == "":
+		return fmt.Sprintf("invalid topology: %s", e.Msg)
+	case e.Ticker:
+		return fmt.Sprintf("invalid topology at ticker %q: %s", e.Id, e.Msg)
+	}
+	return fmt.Sprintf("invalid topology at cell %q: %s", e.Id, e.Msg)
+}
+
+// IsTopologyError checks if an error is a topology error.
+func IsTopologyError(err error) bool {
+	_, ok := err.(TopologyError)
+	return ok
+}
+
+// PatternError will be returned if a pattern of a pattern
+// behavior is invalid.
+type PatternError struct {
+	Id  string
+	Msg string
+}
+
+// Error returns the error as string.
+func (e PatternError) Error() string {
+	return fmt.Sprintf("pattern %q %s", e.Id, e.Msg)
+}
+
+// IsPatternError checks if an error is a pattern error.
+func IsPatternError(err error) bool {
+	_, ok := err.(PatternError)
+	return ok
+}
+
+// CellSnapshotError will be returned if the state of a cell
+// can't be taken or restored.
+type CellSnapshotError struct {
+	Id  Id
+	Err error
+}
+
+// Error returns the error as string.
+func (e CellSnapshotError) Error() string {
+	return fmt.Sprintf("cell %q can't snapshot: %v", e.Id, e.Err)
+}
+
+// IsCellSnapshotError checks if an error is a cell snapshot error.
+func IsCellSnapshotError(err error) bool {
+	_, ok := err.(CellSnapshotError)
+	return ok
+}
+
+// TooMuchRestartsError will be returned if a supervised cell
+// exceeds the restart frequency of its policy.
+type TooMuchRestartsError struct {
+	Id       Id
+	Restarts int
+	Period   time.Duration
+}
+
+// Error returns the error as string.
+func (e TooMuchRestartsError) Error() string {
+	return fmt.Sprintf("cell %q had more than %d restarts in %s", e.Id, e.Restarts, e.Period)
+}
+
+// IsTooMuchRestartsError checks if an error is a too much restarts error.
+func IsTooMuchRestartsError(err error) bool {
+	_, ok := err.(TooMuchRestartsError)
+	return ok
+}
+
+// ContextResultError will be returned if the result of a cell
+// doesn't exist in a context or can't be assigned.
+type ContextResultError struct {
+	Id  Id
+	Msg string
+}
+
+// Error returns the error as string.
+func (e ContextResultError) Error() string {
+	return fmt.Sprintf("context result for %q %s", e.Id, e.Msg)
+}
+
+// IsContextResultError checks if an error is a context result error.
+func IsContextResultError(err error) bool {
+	_, ok := err.(ContextResultError)
+	return ok
+}
+
 // QueueClosedError will be returned if a cell message queue is
 // closed and a message shall be pushed or pulled.
 type QueueClosedError struct{}
@@ -0,0 +1,346 @@
+// Tideland Common Go Library - Cells - Windows
+//
+// Copyright (C) 2010-2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package cells
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"github.com/denkhaus/tcgl/numerics"
+	"math"
+	"sort"
+	"time"
+)
+
+//--------------------
+// AGGREGATE EVENT
+//--------------------
+
+// Aggregate contains the aggregated values of a window. Start and
+// end are the timestamps of the first and the last value. The
+// percentiles are mapped by the requested percentile.
+type Aggregate struct {
+	Start       time.Time
+	End         time.Time
+	Count       int
+	Sum         float64
+	Min         float64
+	Max         float64
+	Average     float64
+	Percentiles map[int]float64
+}
+
+// AggregateEvent signals the closing of a window.
+type AggregateEvent struct {
+	id        Id
+	aggregate *Aggregate
+	context   *Context
+}
+
+// Topic returns the topic of the event, here "aggregate([id])"
+// with the id of the emitting cell.
+func (ae AggregateEvent) Topic() string {
+	return "aggregate(" + string(ae.id) + ")"
+}
+
+// Payload returns the payload of the event, here the aggregate.
+func (ae AggregateEvent) Payload() interface{} {
+	return ae.aggregate
+}
+
+// Context returns the context of a set of event processings.
+func (ae AggregateEvent) Context() *Context {
+	return ae.context
+}
+
+// SetContext set the context of a set of event processings.
+func (ae *AggregateEvent) SetContext(c *Context) {
+	ae.context = c
+}
+
+//--------------------
+// WINDOW
+//--------------------
+
+// ValueFunc is the signature of a function which extracts the value
+// to aggregate and its timestamp out of an event. A zero timestamp
+// means the time of processing, events are ignored if ok is false.
+type ValueFunc func(e Event) (value float64, timestamp time.Time, ok bool)
+
+// PayloadValue is the default value function. It accepts numeric
+// payloads and uses the time of processing.
+func PayloadValue(e Event) (float64, time.Time, bool) {
+	switch p := e.Payload().(type) {
+	case int:
+		return float64(p), time.Time{}, true
+	case int16:
+		return float64(p), time.Time{}, true
+	case int32:
+		return float64(p), time.Time{}, true
+	case int64:
+		return float64(p), time.Time{}, true
+	case float32:
+		return float64(p), time.Time{}, true
+	case float64:
+		return p, time.Time{}, true
+	}
+	return 0, time.Time{}, false
+}
+
+// windowValue is one value of a window with its timestamp.
+type windowValue struct {
+	Value float64
+	Time  time.Time
+}
+
+// window contains the configuration and the values shared
+// by the window behaviors.
+type window struct {
+	id          Id
+	size        time.Duration
+	count       int
+	valueFunc   ValueFunc
+	percentiles []int
+	values      []windowValue
+}
+
+// newWindow creates a window. The value function defaults to
+// PayloadValue.
+func newWindow(size time.Duration, count int, vf ValueFunc, percentiles []int) window {
+	if vf == nil {
+		vf = PayloadValue
+	}
+	return window{size: size, count: count, valueFunc: vf, percentiles: percentiles}
+}
+
+// add inserts the value in the order of the timestamps.
+func (w *window) add(v windowValue) {
+	i := sort.Search(len(w.values), func(i int) bool { return w.values[i].Time.After(v.Time) })
+	w.values = append(w.values, windowValue{})
+	copy(w.values[i+1:], w.values[i:])
+	w.values[i] = v
+}
+
+// value extracts the value of an event.
+func (w *window) value(e Event) (windowValue, bool) {
+	value, timestamp, ok := w.valueFunc(e)
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	return windowValue{value, timestamp}, ok
+}
+
+// emit emits the aggregate of the values if there are any.
+func (w *window) emit(emitter EventEmitter) {
+	if len(w.values) == 0 {
+		return
+	}
+	emitter.Emit(&AggregateEvent{w.id, w.aggregate(), nil})
+}
+
+// aggregate calculates the aggregate of the values. The percentiles
+// are interpolated linearly between the sorted values.
+func (w *window) aggregate() *Aggregate {
+	a := &Aggregate{
+		Start:       w.values[0].Time,
+		End:         w.values[len(w.values)-1].Time,
+		Count:       len(w.values),
+		Percentiles: make(map[int]float64),
+	}
+	ps := numerics.NewPoints()
+	for _, v := range w.values {
+		a.Sum += v.Value
+		ps = append(ps, numerics.NewPoint(v.Value, 0))
+	}
+	sort.Sort(ps)
+	a.Min = ps.XAt(0)
+	a.Max = ps.XAt(ps.Len() - 1)
+	a.Average = a.Sum / float64(a.Count)
+	for _, p := range w.percentiles {
+		rank := math.Min(math.Max(float64(p), 0), 100) / 100 * float64(ps.Len()-1)
+		lower := int(math.Floor(rank))
+		upper := int(math.Ceil(rank))
+		a.Percentiles[p] = ps.XAt(lower) - ps.XDifference(lower, upper)*(rank-float64(lower))
+	}
+	return a
+}
+
+// Snapshot returns the values of the window.
+func (w *window) Snapshot() ([]byte, error) {
+	return encodeState(w.values)
+}
+
+// Restore sets the values of the window.
+func (w *window) Restore(data []byte) error {
+	values := []windowValue{}
+	if err := decodeState(data, &values); err != nil {
+		return err
+	}
+	w.values = values
+	return nil
+}
+
+//--------------------
+// TUMBLING WINDOW BEHAVIOR
+//--------------------
+
+// NewTumblingWindowBehaviorFactory creates a constructor for a tumbling
+// window behavior. It collects the values returned by the value function
+// and emits their aggregate as AggregateEvent when the window closes. This
+// happens if the window contains count values or if the size duration
+// has passed since its first value, checked with the timestamps of the
+// values and ticker events. If neither size nor count are set each ticker
+// event closes the window. Empty windows are not emitted. Values may arrive
+// out of order, but values older than the first one of the window or, if
+// it's empty, than the last one of the closed window are dropped.
+func NewTumblingWindowBehaviorFactory(size time.Duration, count int, vf ValueFunc, percentiles ...int) BehaviorFactory {
+	return func() Behavior {
+		return &tumblingWindowBehavior{window: newWindow(size, count, vf, percentiles)}
+	}
+}
+
+// tumblingWindowBehavior aggregates the values of non-overlapping windows.
+type tumblingWindowBehavior struct {
+	window
+	closed time.Time
+}
+
+// Init the behavior.
+func (b *tumblingWindowBehavior) Init(env *Environment, id Id) error {
+	b.id = id
+	return nil
+}
+
+// ProcessEvent processes an event.
+func (b *tumblingWindowBehavior) ProcessEvent(e Event, emitter EventEmitter) {
+	if te, ok := e.(*TickerEvent); ok {
+		if (b.size == 0 && b.count == 0) || b.expired(te.time) {
+			b.close(emitter)
+		}
+		return
+	}
+	v, ok := b.value(e)
+	if !ok || b.late(v.Time) {
+		return
+	}
+	if b.expired(v.Time) {
+		b.close(emitter)
+	}
+	b.add(v)
+	if b.count > 0 && len(b.values) >= b.count {
+		b.close(emitter)
+	}
+}
+
+// Recover from an error.
+func (b *tumblingWindowBehavior) Recover(err interface{}, e Event) {}
+
+// Stop the behavior.
+func (b *tumblingWindowBehavior) Stop() {}
+
+// expired checks if the size duration of the window has passed.
+func (b *tumblingWindowBehavior) expired(t time.Time) bool {
+	if b.size == 0 || len(b.values) == 0 {
+		return false
+	}
+	return !t.Before(b.values[0].Time.Add(b.size))
+}
+
+// late checks if a value belongs to an already closed window.
+func (b *tumblingWindowBehavior) late(t time.Time) bool {
+	if len(b.values) > 0 {
+		return t.Before(b.values[0].Time)
+	}
+	return t.Before(b.closed)
+}
+
+// close emits the aggregate and starts a new window.
+func (b *tumblingWindowBehavior) close(emitter EventEmitter) {
+	if len(b.values) > 0 {
+		b.closed = b.values[len(b.values)-1].Time
+	}
+	b.emit(emitter)
+	b.values = nil
+}
+
+//--------------------
+// SLIDING WINDOW BEHAVIOR
+//--------------------
+
+// NewSlidingWindowBehaviorFactory creates a constructor for a sliding
+// window behavior. It keeps the values returned by the value function
+// which are not older than the size duration, measured against the
+// latest value or ticker event, and not more than count values. Each
+// ticker event emits the aggregate of the kept values as AggregateEvent,
+// so the ticker period is the slide of the window. Empty windows are
+// not emitted. Values may arrive out of order, but values which would
+// already have been evicted are dropped.
+func NewSlidingWindowBehaviorFactory(size time.Duration, count int, vf ValueFunc, percentiles ...int) BehaviorFactory {
+	return func() Behavior {
+		return &slidingWindowBehavior{window: newWindow(size, count, vf, percentiles)}
+	}
+}
+
+// slidingWindowBehavior aggregates the values of overlapping windows.
+type slidingWindowBehavior struct {
+	window
+	latest time.Time
+}
+
+// Init the behavior.
+func (b *slidingWindowBehavior) Init(env *Environment, id Id) error {
+	b.id = id
+	return nil
+}
+
+// ProcessEvent processes an event.
+func (b *slidingWindowBehavior) ProcessEvent(e Event, emitter EventEmitter) {
+	if te, ok := e.(*TickerEvent); ok {
+		b.evict(te.time)
+		b.emit(emitter)
+		return
+	}
+	v, ok := b.value(e)
+	if !ok || b.late(v.Time) {
+		return
+	}
+	b.add(v)
+	b.evict(v.Time)
+}
+
+// Recover from an error.
+func (b *slidingWindowBehavior) Recover(err interface{}, e Event) {}
+
+// Stop the behavior.
+func (b *slidingWindowBehavior) Stop() {}
+
+// late checks if a value is older than the size duration
+// measured against the latest value or ticker event.
+func (b *slidingWindowBehavior) late(t time.Time) bool {
+	return b.size > 0 && !b.latest.IsZero() && !t.After(b.latest.Add(-b.size))
+}
+
+// evict removes the values which are too old, measured against
+// the latest value or ticker event, or too many.
+func (b *slidingWindowBehavior) evict(t time.Time) {
+	if t.After(b.latest) {
+		b.latest = t
+	}
+	if b.size > 0 {
+		limit := b.latest.Add(-b.size)
+		for len(b.values) > 0 && !b.values[0].Time.After(limit) {
+			b.values = b.values[1:]
+		}
+	}
+	if b.count > 0 && len(b.values) > b.count {
+		b.values = b.values[len(b.values)-b.count:]
+	}
+}
+
+// EOF
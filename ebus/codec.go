@@ -0,0 +1,206 @@
+// Tideland Common Go Library - Event Bus - Codecs
+//
+// Copyright (C) 2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package ebus
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+//--------------------
+// CONSTANTS
+//--------------------
+
+// Names of the built-in codecs.
+const (
+	GobCodecName  = "gob"
+	JSONCodecName = "json"
+	RawCodecName  = "raw"
+)
+
+//--------------------
+// CODEC
+//--------------------
+
+// Codec encodes and decodes event payloads.
+type Codec interface {
+	// Name returns the name the codec is registered with
+	// and recorded in the events.
+	Name() string
+	// Encode encodes a payload.
+	Encode(payload interface{}) ([]byte, error)
+	// Decode decodes the data into the value.
+	Decode(data []byte, value interface{}) error
+}
+
+// codecs stores the registered codecs and the codecs
+// configured for topics.
+var codecs = struct {
+	mutex  sync.RWMutex
+	codecs map[string]Codec
+	topics []*topicCodec
+}{
+	codecs: map[string]Codec{
+		GobCodecName:  gobCodec{},
+		JSONCodecName: jsonCodec{},
+		RawCodecName:  rawCodec{},
+	},
+}
+
+// topicCodec is the name of the codec for a topic pattern.
+type topicCodec struct {
+	pattern string
+	name    string
+}
+
+// RegisterCodec registers a codec by its name. An already
+// registered codec with the same name is replaced.
+func RegisterCodec(codec Codec) {
+	codecs.mutex.Lock()
+	defer codecs.mutex.Unlock()
+	codecs.codecs[codec.Name()] = codec
+}
+
+// SetTopicCodec sets the codec used for payloads emitted to topics
+// matching the pattern. If multiple patterns match the first one set
+// is used. An empty name removes the codec of the pattern again.
+func SetTopicCodec(pattern, name string) error {
+	if _, err := splitTopic(pattern); err != nil {
+		return err
+	}
+	codecs.mutex.Lock()
+	defer codecs.mutex.Unlock()
+	if _, ok := codecs.codecs[name]; !ok && name != "" {
+		return &UnknownCodecError{name}
+	}
+	for i, tc := range codecs.topics {
+		if tc.pattern == pattern {
+			if name == "" {
+				codecs.topics = append(codecs.topics[:i], codecs.topics[i+1:]...)
+			} else {
+				tc.name = name
+			}
+			return nil
+		}
+	}
+	if name != "" {
+		codecs.topics = append(codecs.topics, &topicCodec{pattern, name})
+	}
+	return nil
+}
+
+// lookupCodec returns the codec with the given name. An empty name
+// returns the codec set for the topic, otherwise the gob codec.
+func lookupCodec(name, topic string) (Codec, error) {
+	codecs.mutex.RLock()
+	defer codecs.mutex.RUnlock()
+	if name == "" {
+		name = GobCodecName
+		for _, tc := range codecs.topics {
+			if matchTopic(tc.pattern, topic) {
+				name = tc.name
+				break
+			}
+		}
+	}
+	codec, ok := codecs.codecs[name]
+	if !ok {
+		return nil, &UnknownCodecError{name}
+	}
+	return codec, nil
+}
+
+//--------------------
+// BUILT-IN CODECS
+//--------------------
+
+// gobCodec encodes payloads using encoding/gob.
+type gobCodec struct{}
+
+// Name returns the name of the codec.
+func (c gobCodec) Name() string {
+	return GobCodecName
+}
+
+// Encode encodes a payload.
+func (c gobCodec) Encode(payload interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	enc := gob.NewEncoder(buf)
+	if err := enc.Encode(payload); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode decodes the data into the value.
+func (c gobCodec) Decode(data []byte, value interface{}) error {
+	dec := gob.NewDecoder(bytes.NewBuffer(data))
+	return dec.Decode(value)
+}
+
+// jsonCodec encodes payloads using encoding/json.
+type jsonCodec struct{}
+
+// Name returns the name of the codec.
+func (c jsonCodec) Name() string {
+	return JSONCodecName
+}
+
+// Encode encodes a payload.
+func (c jsonCodec) Encode(payload interface{}) ([]byte, error) {
+	return json.Marshal(payload)
+}
+
+// Decode decodes the data into the value.
+func (c jsonCodec) Decode(data []byte, value interface{}) error {
+	return json.Unmarshal(data, value)
+}
+
+// rawCodec passes byte slices and strings through.
+type rawCodec struct{}
+
+// Name returns the name of the codec.
+func (c rawCodec) Name() string {
+	return RawCodecName
+}
+
+// Encode encodes a payload.
+func (c rawCodec) Encode(payload interface{}) ([]byte, error) {
+	switch p := payload.(type) {
+	case []byte:
+		data := make([]byte, len(p))
+		copy(data, p)
+		return data, nil
+	case string:
+		return []byte(p), nil
+	}
+	return nil, &InvalidRawPayloadError{fmt.Sprintf("%T", payload)}
+}
+
+// Decode decodes the data into the value.
+func (c rawCodec) Decode(data []byte, value interface{}) error {
+	switch v := value.(type) {
+	case *[]byte:
+		*v = make([]byte, len(data))
+		copy(*v, data)
+		return nil
+	case *string:
+		*v = string(data)
+		return nil
+	}
+	return &InvalidRawPayloadError{fmt.Sprintf("%T", value)}
+}
+
+// EOF
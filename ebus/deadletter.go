@@ -0,0 +1,101 @@
+// Tideland Common Go Library - Event Bus - Dead Letters
+//
+// Copyright (C) 2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package ebus
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"github.com/denkhaus/tcgl/applog"
+	"sync"
+)
+
+//--------------------
+// DEAD LETTER
+//--------------------
+
+// deadLetters stores the topic dead letters are emitted to. It's
+// empty if dead letters are not configured.
+var deadLetters = struct {
+	mutex sync.RWMutex
+	topic string
+}{}
+
+// setDeadLetterTopic sets the topic dead letters are emitted to.
+func setDeadLetterTopic(topic string) {
+	deadLetters.mutex.Lock()
+	defer deadLetters.mutex.Unlock()
+	deadLetters.topic = topic
+}
+
+// deadLetterTopic returns the topic dead letters are emitted to.
+func deadLetterTopic() string {
+	deadLetters.mutex.RLock()
+	defer deadLetters.mutex.RUnlock()
+	return deadLetters.topic
+}
+
+// DeadLetter is the payload of the events emitted to the dead
+// letter topic. It wraps events nobody has subscribed to or which
+// made an agent unrecoverable.
+type DeadLetter struct {
+	Topic   string
+	AgentId string
+	Err     string
+	Data    []byte
+}
+
+// Event returns the original event.
+func (d *DeadLetter) Event() (Event, error) {
+	return unmarshalEvent(d.Topic, d.Data)
+}
+
+// Reemit emits the original event again. Unlike with Emit a
+// NoSubscriberError is returned if nobody subscribed yet.
+func (d *DeadLetter) Reemit() error {
+	if eventBus == nil {
+		panic("event bus is not initialized")
+	}
+	event, err := unmarshalEvent(d.Topic, d.Data)
+	if err != nil {
+		return err
+	}
+	return emit(event)
+}
+
+// emitDeadLetter wraps the event into a dead letter and emits it to
+// the dead letter topic if configured. The id of the agent is empty
+// if the event couldn't be routed.
+func emitDeadLetter(event Event, id string, reason error) {
+	topic := deadLetterTopic()
+	if topic == "" || event.Topic() == topic {
+		return
+	}
+	se, ok := event.(*simpeEvent)
+	if !ok {
+		applog.Errorf("cannot create dead letter for event type %T", event)
+		return
+	}
+	data, err := se.marshal()
+	if err != nil {
+		applog.Errorf("cannot create dead letter for event with topic %q: %v", se.topic, err)
+		return
+	}
+	letter, err := newCausedEvent(se, "", &DeadLetter{se.topic, id, reason.Error(), data}, topic)
+	if err != nil {
+		applog.Errorf("cannot create dead letter for event with topic %q: %v", se.topic, err)
+		return
+	}
+	letter.emitterId = id
+	if err := emit(letter); err != nil && !IsNoSubscriberError(err) {
+		applog.Errorf("cannot emit dead letter for event with topic %q: %v", se.topic, err)
+	}
+}
+
+// EOF
@@ -9,6 +9,14 @@
 //
 // Agent behaviors are defined based on an interface. After
 // deployment they subscribe to individual topics or topic patters.
+// Topics are paths of segments separated by slashes. In patterns the
+// segment "*" matches one segment while a final "#" matches any number
+// of remaining segments.
+// Events carry meta data like an id, a timestamp and headers. Events
+// emitted with EmitCaused continue the flow of their cause, so chains
+// of events can be traced by their causation and correlation ids. The
+// bus doesn't know which event an agent is processing, so events
+// emitted with Emit always start a new flow.
 // Contexts help to bundle the results of event processings and
 // to retrieve them later.
 package ebus
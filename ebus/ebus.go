@@ -13,7 +13,9 @@ package ebus
 
 import (
 	"github.com/denkhaus/tcgl/config"
-	"fmt"
+	"sort"
+	"sync"
+	"time"
 )
 
 //--------------------
@@ -30,6 +32,30 @@ type Event interface {
 	Payload(value interface{}) error
 	// Topic returns the topic of the event.
 	Topic() string
+	// Codec returns the name of the codec the payload
+	// has been encoded with.
+	Codec() string
+	// Id returns the unique identifier of the event.
+	Id() string
+	// Timestamp returns the time the event has been created.
+	Timestamp() time.Time
+	// EmitterId returns the id of the agent which emitted the
+	// event while processing its cause. It's empty for events
+	// emitted without a cause.
+	EmitterId() string
+	// CausationId returns the id of the event which caused
+	// this one. It's empty for events starting a flow.
+	CausationId() string
+	// CorrelationId returns the id correlating all events of
+	// a flow. It's the id of the event starting the flow.
+	CorrelationId() string
+	// ReplyTo returns the topic replies to a request have to
+	// be emitted to. It's empty for other events.
+	ReplyTo() string
+	// Header returns the value of the header with the key.
+	Header(key string) string
+	// Headers returns a copy of all headers of the event.
+	Headers() map[string]string
 }
 
 // Agent is the interface that has to be implemented
@@ -48,44 +74,193 @@ type Agent interface {
 	Err() error
 }
 
+// BoundedAgent is the interface for agents which want to
+// configure the capacity of their inbox and the policy for
+// overflows on their own.
+type BoundedAgent interface {
+	InboxConfig() (capacity int, policy InboxPolicy)
+}
+
+//--------------------
+// AGENT STATE
+//--------------------
+
+// AgentState describes the state of a registered agent. The
+// inbox length is the number of queued events.
+type AgentState struct {
+	Id              string
+	Topics          []string
+	InboxLength     int
+	Processed       int64
+	Failed          int64
+	LastError       error
+	AverageDuration time.Duration
+}
+
+//--------------------
+// INBOX POLICY
+//--------------------
+
+// InboxPolicy defines how an emitting is handled if the inbox
+// of a subscribed agent is full. With InboxBlock the emitter waits
+// at most for the inbox timeout, afterwards the event is handled
+// like with InboxFail. So agents emitting to their own full inbox
+// or to each others can't block forever.
+type InboxPolicy int
+
+const (
+	InboxBlock      InboxPolicy = iota // Block the emitter until there's space or the timeout.
+	InboxDropOldest                    // Drop the oldest event in the inbox.
+	InboxDropNewest                    // Drop the emitted event.
+	InboxFail                          // Drop the emitted event and return an error.
+)
+
+// inboxPolicyNames maps the policies to their configuration names.
+var inboxPolicyNames = map[InboxPolicy]string{
+	InboxBlock:      "block",
+	InboxDropOldest: "drop-oldest",
+	InboxDropNewest: "drop-newest",
+	InboxFail:       "fail",
+}
+
+// ParseInboxPolicy returns the policy for a configuration
+// name like "block" or "drop-oldest".
+func ParseInboxPolicy(name string) (InboxPolicy, error) {
+	for policy, policyName := range inboxPolicyNames {
+		if policyName == name {
+			return policy, nil
+		}
+	}
+	return InboxBlock, &InvalidInboxPolicyError{name}
+}
+
+// String returns the configuration name of the policy.
+func (p InboxPolicy) String() string {
+	return inboxPolicyNames[p]
+}
+
 //--------------------
 // BACKEND
 //--------------------
 
-// backend defines the methods a backend has to implement to be
+// Backend defines the methods a backend has to implement to be
 // used as event bus.
-type backend interface {
+type Backend interface {
+	// Init initializes the backend with the given configuration.
 	Init(config *config.Configuration) error
+	// Stop shuts the backend down.
 	Stop() error
+	// Register adds an agent.
 	Register(agent Agent) (Agent, error)
+	// Deregister stops and removes the agent.
 	Deregister(agent Agent) error
+	// Lookup retrieves a registered agent by id.
 	Lookup(id string) (Agent, error)
+	// Subscribe subscribes the agent to the topic or topic pattern.
 	Subscribe(agent Agent, topic string) error
+	// Unsubscribe removes the subscription of the agent from the topic.
 	Unsubscribe(agent Agent, topic string) error
+	// Emit delivers the event to all subscribed agents. If there
+	// are none it returns a NoSubscriberError, which is used for
+	// dead letters but not returned by the Emit functions.
 	Emit(event Event) error
 }
 
+// InspectableBackend is optionally implemented by backends
+// supporting the inspection of their agents and topics.
+type InspectableBackend interface {
+	Backend
+	// Agents returns the ids of all registered agents.
+	Agents() []string
+	// AgentInfo returns the state of the agent with the id.
+	AgentInfo(id string) (*AgentState, error)
+	// Topics returns all subscribed topics and topic patterns.
+	Topics() []string
+}
+
+// BackendFactory is a function that creates a backend instance.
+type BackendFactory func() Backend
+
+// backends stores the factories of all known backends.
+var backends = struct {
+	mutex     sync.RWMutex
+	factories map[string]BackendFactory
+}{
+	factories: map[string]BackendFactory{
+		"single": newSingleNodeBackend,
+		"redis":  newRedisBackend,
+	},
+}
+
 // eventBus is the backend used by the API functions.
-var eventBus backend
+var eventBus Backend
 
 //--------------------
 // FUNCTIONS
 //--------------------
 
+// RegisterBackend makes a backend available under the given name
+// for the "backend" configuration key. An already registered backend
+// with the same name is replaced.
+func RegisterBackend(name string, factory BackendFactory) {
+	backends.mutex.Lock()
+	defer backends.mutex.Unlock()
+	backends.factories[name] = factory
+}
+
 // Init initializes the event bus with the given configuration. If this
-// isn't done all further operation will fail.
+// isn't done all further operation will fail. The key "backend" selects
+// the "single" node backend (default), the "redis" backend for multiple
+// nodes or any backend added with RegisterBackend. The bundled backends
+// also use "inbox-capacity" (default 0 for unbounded) and "inbox-policy"
+// (default "block") for the inboxes of all agents not being a BoundedAgent
+// and "inbox-timeout" (default 5s) for the time blocked emitters wait.
+// If "journal-dir" is set all emitted events are journaled in that
+// directory and can be replayed. Each event is synced to disk unless
+// "journal-sync" sets a duration for syncing the events in batches. If
+// "dead-letter-topic" is set events without subscribers or making an
+// agent unrecoverable are emitted to this topic wrapped as DeadLetter.
+// An unknown backend name returns an UnknownBackendError. The journal
+// and the dead letter topic are only changed if the backend has been
+// initialized successfully.
 func Init(config *config.Configuration) error {
 	backend, err := config.GetDefault("backend", "single")
 	if err != nil {
 		return err
 	}
-	switch backend {
-	case "single":
-		eventBus = newSingleNodeBackend()
-	default:
-		panic(fmt.Sprintf("invalid backend %q", backend))
+	journalDir, err := config.GetDefault("journal-dir", "")
+	if err != nil {
+		return err
+	}
+	journalSync, err := config.GetDurationDefault("journal-sync", 0)
+	if err != nil {
+		return err
+	}
+	letterTopic, err := config.GetDefault("dead-letter-topic", "")
+	if err != nil {
+		return err
+	}
+	backends.mutex.RLock()
+	factory, ok := backends.factories[backend]
+	backends.mutex.RUnlock()
+	if !ok {
+		return &UnknownBackendError{backend}
+	}
+	bus := factory()
+	if err := bus.Init(config); err != nil {
+		return err
+	}
+	var j *journal
+	if journalDir != "" {
+		if j, err = openJournal(journalDir, journalSync); err != nil {
+			bus.Stop()
+			return err
+		}
 	}
-	return eventBus.Init(config)
+	replaceJournal(j)
+	setDeadLetterTopic(letterTopic)
+	eventBus = bus
+	return nil
 }
 
 // Stop shuts the event bus down.
@@ -93,6 +268,8 @@ func Stop() error {
 	if eventBus == nil {
 		panic("event bus is not initialized")
 	}
+	stopSchedules()
+	replaceJournal(nil)
 	return eventBus.Stop()
 }
 
@@ -120,35 +297,145 @@ func Lookup(id string) (Agent, error) {
 	return eventBus.Lookup(id)
 }
 
+// Agents returns the sorted ids of all registered agents. It's
+// empty if the backend isn't an InspectableBackend.
+func Agents() []string {
+	if eventBus == nil {
+		panic("event bus is not initialized")
+	}
+	ib, ok := eventBus.(InspectableBackend)
+	if !ok {
+		return []string{}
+	}
+	ids := ib.Agents()
+	sort.Strings(ids)
+	return ids
+}
+
+// AgentInfo returns the subscribed topics, the inbox length and
+// the processing statistics of the agent with the id. If the
+// backend isn't an InspectableBackend a NotInspectableError
+// is returned.
+func AgentInfo(id string) (*AgentState, error) {
+	if eventBus == nil {
+		panic("event bus is not initialized")
+	}
+	ib, ok := eventBus.(InspectableBackend)
+	if !ok {
+		return nil, &NotInspectableError{}
+	}
+	return ib.AgentInfo(id)
+}
+
+// Topics returns the sorted topics and topic patterns agents are
+// subscribed to. It's empty if the backend isn't an InspectableBackend.
+func Topics() []string {
+	if eventBus == nil {
+		panic("event bus is not initialized")
+	}
+	ib, ok := eventBus.(InspectableBackend)
+	if !ok {
+		return []string{}
+	}
+	topics := ib.Topics()
+	sort.Strings(topics)
+	return topics
+}
+
 // Subscribe subscribes the agent to the topic created out of 
-// the stem and the parts.
+// the stem and the parts. A part "*" matches exactly one segment
+// of an event topic, a final part "#" matches all remaining ones,
+// e.g. "sensor/*/temperature" or "orders/#".
 func Subscribe(agent Agent, stem string, parts ...interface{}) error {
 	if eventBus == nil {
 		panic("event bus is not initialized")
 	}
-	return eventBus.Subscribe(agent, Id(stem, parts...))
+	topic := Id(stem, parts...)
+	if err := eventBus.Subscribe(agent, topic); err != nil {
+		return err
+	}
+	supervisions.subscribe(agent.Id(), topic)
+	return nil
 }
 
 // Unsubscribe removes the subscription of the agent from the topic 
-// created out of the stem and the parts.
+// created out of the stem and the parts. Patterns have to be passed
+// the same way as they have been subscribed.
 func Unsubscribe(agent Agent, stem string, parts ...interface{}) error {
 	if eventBus == nil {
 		panic("event bus is not initialized")
 	}
-	return eventBus.Unsubscribe(agent, Id(stem, parts...))
+	topic := Id(stem, parts...)
+	if err := eventBus.Unsubscribe(agent, topic); err != nil {
+		return err
+	}
+	supervisions.unsubscribe(agent.Id(), topic)
+	return nil
 }
 
 // Emit emits new event with the given payload and the topic
-// created out of the stem and the parts to the event bus.
+// created out of the stem and the parts to the event bus. Having
+// no subscribers is no error, the event is only passed to the dead
+// letter topic if configured. The event starts a new flow, also if
+// it's emitted by an agent while processing an event. The meta data
+// isn't propagated automatically, agents use EmitCaused for it.
 func Emit(payload interface{}, stem string, parts ...interface{}) error {
 	if eventBus == nil {
 		panic("event bus is not initialized")
 	}
-	event, err := newSimpleEvent(payload, Id(stem, parts...))
+	return EmitWith(EmitOptions{}, payload, stem, parts...)
+}
+
+// EmitOptions contains the optional meta data of an emitted event.
+type EmitOptions struct {
+	// Cause is the event whose processing leads to the emission.
+	// The new event continues its flow and inherits its headers.
+	Cause Event
+	// Headers are set in addition to those of the cause.
+	Headers map[string]string
+	// Codec is the name of the codec encoding the payload. If
+	// empty the codec set for the topic or gob is used.
+	Codec string
+}
+
+// EmitWith emits a new event like Emit but with the meta
+// data of the options.
+func EmitWith(options EmitOptions, payload interface{}, stem string, parts ...interface{}) error {
+	if eventBus == nil {
+		panic("event bus is not initialized")
+	}
+	event, err := newCausedEvent(options.Cause, options.Codec, payload, Id(stem, parts...))
 	if err != nil {
 		return err
 	}
-	return eventBus.Emit(event)
+	for key, value := range options.Headers {
+		event.headers[key] = value
+	}
+	if err := emit(event); err != nil && !IsNoSubscriberError(err) {
+		return err
+	}
+	return nil
+}
+
+// EmitCaused emits a new event like Emit while processing the cause.
+// The id of the processing agent, the causation and correlation ids
+// as well as the headers are propagated to the new event. Agents pass
+// the processed event as cause, also in goroutines they start.
+func EmitCaused(cause Event, payload interface{}, stem string, parts ...interface{}) error {
+	return EmitWith(EmitOptions{Cause: cause}, payload, stem, parts...)
+}
+
+// emit journals the event if configured and emits it
+// to the event bus.
+func emit(event *simpeEvent) error {
+	if err := writeJournal(event); err != nil {
+		return err
+	}
+	err := eventBus.Emit(event)
+	if IsNoSubscriberError(err) {
+		emitDeadLetter(event, "", err)
+	}
+	return err
 }
 
 // EOF
@@ -16,6 +16,13 @@ import (
 	"github.com/denkhaus/tcgl/asserts"
 	"github.com/denkhaus/tcgl/config"
 	"github.com/denkhaus/tcgl/ebus"
+	"github.com/denkhaus/tcgl/monitoring"
+	"github.com/denkhaus/tcgl/supervisor"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -170,8 +177,854 @@ func TestTicker(t *testing.T) {
 	assert.True(ebus.IsTickerNotFoundError(err), "ticker foo is removed by ebus stopping")
 }
 
+// TestRegisterBackend tests the usage of an own backend.
+func TestRegisterBackend(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	provider := config.NewMapConfigurationProvider()
+	config := config.New(provider)
+	recorder := &RecordingBackend{}
+
+	ebus.RegisterBackend("recording", func() ebus.Backend { return recorder })
+	config.Set("backend", "recording")
+
+	err := ebus.Init(config)
+	assert.Nil(err, "recording backend started")
+	assert.True(recorder.Initialized, "recording backend initialized")
+
+	err = ebus.Emit(ebus.EmptyPayload, "foo", 1)
+	assert.Nil(err, "first event emitted")
+	err = ebus.Emit(ebus.EmptyPayload, "bar", 2)
+	assert.Nil(err, "second event emitted")
+	assert.Equal(recorder.Emitted, []string{"foo/1", "bar/2"}, "emitted events are recorded")
+	assert.Length(ebus.Agents(), 0, "recording backend is not inspectable")
+	_, err = ebus.AgentInfo("foo")
+	assert.True(ebus.IsNotInspectableError(err), "recording backend is not inspectable")
+
+	err = ebus.Stop()
+	assert.Nil(err, "stopped the bus")
+	assert.True(recorder.Stopped, "recording backend stopped")
+
+	config.Set("backend", "unknown")
+	err = ebus.Init(config)
+	assert.True(ebus.IsUnknownBackendError(err), "unknown backend not started")
+
+	// A failing backend leaves the global state untouched.
+	dir, err := ioutil.TempDir("", "ebus-failing-backend")
+	assert.Nil(err, "temporary directory created")
+	defer os.RemoveAll(dir)
+	journalDir := filepath.Join(dir, "journal")
+	ebus.RegisterBackend("failing", func() ebus.Backend {
+		return &RecordingBackend{InitErr: errors.New("cannot connect")}
+	})
+	config.Set("backend", "failing")
+	config.Set("journal-dir", journalDir)
+	err = ebus.Init(config)
+	assert.ErrorMatch(err, "cannot connect", "failing backend not started")
+	_, err = os.Stat(journalDir)
+	assert.True(os.IsNotExist(err), "no journal opened for failing backend")
+}
+
+// TestRequestReply tests requests with single and multiple replies.
+func TestRequestReply(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	provider := config.NewMapConfigurationProvider()
+	config := config.New(provider)
+
+	config.Set("backend", "single")
+
+	err := ebus.Init(config)
+	assert.Nil(err, "single node backend started")
+	defer ebus.Stop()
+
+	for i := 1; i <= 3; i++ {
+		factor := i
+		agent := ebus.NewSimpleFuncAgent(ebus.Id("multiplier", i), func(event ebus.Event) error {
+			var value int
+			if err := event.Payload(&value); err != nil {
+				return err
+			}
+			return ebus.Reply(event, value*factor)
+		})
+		_, err = ebus.Register(agent)
+		assert.Nil(err, "multiplier registered")
+		assert.Nil(ebus.Subscribe(agent, "multiply"), "multiplier subscribed")
+	}
+
+	applog.Debugf("requesting one reply")
+	reply, err := ebus.Request(7, time.Second, "multiply")
+	assert.Nil(err, "request replied")
+	assert.NotEmpty(reply.CorrelationId(), "reply has correlation id")
+	var value int
+	assert.Nil(reply.Payload(&value), "reply payload")
+	assert.True(value == 7 || value == 14 || value == 21, "reply value")
+
+	applog.Debugf("gathering all replies")
+	replies, err := ebus.Gather(7, 100*time.Millisecond, "multiply")
+	assert.Nil(err, "request gathered")
+	assert.Length(replies, 3, "all replies gathered")
+	sum := 0
+	for _, reply := range replies {
+		assert.Equal(reply.CorrelationId(), replies[0].CorrelationId(), "same correlation id")
+		assert.Nil(reply.Payload(&value), "reply payload")
+		sum += value
+	}
+	assert.Equal(sum, 42, "all reply values")
+
+	applog.Debugf("replying with the codec of the request")
+	assert.Nil(ebus.SetTopicCodec("multiply", ebus.JSONCodecName), "json codec set for requests")
+	reply, err = ebus.Request(7, time.Second, "multiply")
+	ebus.SetTopicCodec("multiply", "")
+	assert.Nil(err, "json request replied")
+	assert.Equal(reply.Codec(), ebus.JSONCodecName, "reply encoded like request")
+
+	applog.Debugf("requesting without subscribers")
+	_, err = ebus.Request(7, time.Second, "divide")
+	assert.True(ebus.IsNoSubscriberError(err), "no subscriber for request")
+
+	applog.Debugf("requesting without reply")
+	silent := ebus.NewSimpleFuncAgent("silent", func(event ebus.Event) error { return nil })
+	ebus.Register(silent)
+	ebus.Subscribe(silent, "ignore")
+	_, err = ebus.Request(7, 50*time.Millisecond, "ignore")
+	assert.True(ebus.IsRequestTimeoutError(err), "request timed out")
+
+	applog.Debugf("replying a simple event")
+	replyErrs := make(chan error, 1)
+	replier := ebus.NewSimpleFuncAgent("replier", func(event ebus.Event) error {
+		err := ebus.Reply(event, 0)
+		replyErrs <- err
+		return err
+	})
+	ebus.Register(replier)
+	ebus.Subscribe(replier, "no-request")
+	assert.Nil(ebus.Emit(0, "no-request"), "simple event emitted")
+	assert.True(ebus.IsNoReplyTopicError(<-replyErrs), "simple event can't be replied")
+}
+
+// TestJournalReplay tests the journaling and replaying of events.
+func TestJournalReplay(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	dir, err := ioutil.TempDir("", "ebus-journal")
+	assert.Nil(err, "journal directory created")
+	defer os.RemoveAll(dir)
+	provider := config.NewMapConfigurationProvider()
+	config := config.New(provider)
+
+	config.Set("backend", "single")
+	config.Set("journal-dir", dir)
+
+	applog.Debugf("emitting journaled events")
+	err = ebus.Init(config)
+	assert.Nil(err, "single node backend with journal started")
+	topics := make(chan string, 100)
+	newAgent := func(id string) ebus.Agent {
+		return ebus.NewSimpleFuncAgent(id, func(event ebus.Event) error {
+			topics <- event.Topic()
+			return nil
+		})
+	}
+	agent := newAgent("live")
+	ebus.Register(agent)
+	ebus.Subscribe(agent, "#")
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		assert.Nil(ebus.Emit(ebus.EmptyPayload, "sensor", i), "sensor event emitted")
+		ebus.Emit(ebus.EmptyPayload, "order", i)
+	}
+	ebus.Emit(ebus.EmptyPayload, "unsubscribed")
+	end := time.Now()
+	assert.Equal(receiveTopics(topics, 11), []string{
+		"sensor/0", "order/0", "sensor/1", "order/1", "sensor/2", "order/2",
+		"sensor/3", "order/3", "sensor/4", "order/4", "unsubscribed",
+	}, "live events processed")
+	assert.Nil(ebus.Stop(), "stopped the bus")
+
+	applog.Debugf("replaying journaled events")
+	config.Set("journal-sync", "10ms")
+	err = ebus.Init(config)
+	assert.Nil(err, "single node backend with journal restarted")
+	defer ebus.Stop()
+	agent = newAgent("replayed")
+	ebus.Register(agent)
+	ebus.Subscribe(agent, "sensor", "*")
+	replayed, err := ebus.Replay(start, end, "sensor/*", "unsubscribed")
+	assert.Nil(err, "events replayed")
+	assert.Equal(replayed, 6, "matching events replayed")
+	replayed, err = ebus.Replay(end, time.Now())
+	assert.Nil(err, "events replayed")
+	assert.Equal(replayed, 0, "no events in time range")
+	assert.Equal(receiveTopics(topics, 5), []string{
+		"sensor/0", "sensor/1", "sensor/2", "sensor/3", "sensor/4",
+	}, "only matching events replayed")
+}
+
+// TestDeadLetters tests the emitting of dead letters.
+func TestDeadLetters(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	provider := config.NewMapConfigurationProvider()
+	config := config.New(provider)
+
+	config.Set("backend", "single")
+	config.Set("dead-letter-topic", "dead-letter")
+
+	err := ebus.Init(config)
+	assert.Nil(err, "single node backend started")
+	defer ebus.Stop()
+
+	letters := make(chan *ebus.DeadLetter, 10)
+	collector := ebus.NewSimpleFuncAgent("collector", func(event ebus.Event) error {
+		var letter ebus.DeadLetter
+		if err := event.Payload(&letter); err != nil {
+			return err
+		}
+		letters <- &letter
+		return nil
+	})
+	ebus.Register(collector)
+	ebus.Subscribe(collector, "dead-letter")
+	failing := ebus.NewSimpleFuncAgent("failing", func(event ebus.Event) error {
+		return fmt.Errorf("cannot handle it")
+	})
+	ebus.Register(failing)
+	ebus.Subscribe(failing, "fail")
+
+	applog.Debugf("emitting event without subscriber")
+	err = ebus.Emit(ebus.EmptyPayload, "nobody", "there")
+	assert.Nil(err, "no subscriber is no error")
+	letter := <-letters
+	assert.Equal(letter.Topic, "nobody/there", "dead letter topic")
+	assert.Equal(letter.AgentId, "", "dead letter without agent")
+	assert.ErrorMatch(errors.New(letter.Err), "no agent subscribed.*", "dead letter error")
+	event, err := letter.Event()
+	assert.Nil(err, "original event")
+	var payload struct {
+		A int
+		B string
+	}
+	assert.Nil(event.Payload(&payload), "original payload")
+	assert.Equal(payload.A, 4711, "original payload")
+
+	applog.Debugf("emitting event making an agent unrecoverable")
+	err = ebus.Emit(ebus.EmptyPayload, "fail")
+	assert.Nil(err, "failing event emitted")
+	letter = <-letters
+	assert.Equal(letter.Topic, "fail", "dead letter topic")
+	assert.Equal(letter.AgentId, "failing", "dead letter agent")
+	assert.Equal(letter.Err, "cannot handle it", "dead letter error")
+
+	applog.Debugf("reemitting dead letter")
+	assert.True(waitFor(func() bool {
+		_, err := ebus.Lookup("failing")
+		return ebus.IsAgentNotRegisteredError(err)
+	}), "failing agent deregistered")
+	err = letter.Reemit()
+	assert.True(ebus.IsNoSubscriberError(err), "failing agent is gone")
+	letter = <-letters
+	assert.Equal(letter.Topic, "fail", "reemitted dead letter topic")
+	assert.Equal(letter.AgentId, "", "reemitted dead letter without agent")
+
+	applog.Debugf("replying after the requester stopped waiting")
+	release := make(chan bool)
+	replied := make(chan error)
+	late := ebus.NewSimpleFuncAgent("late", func(event ebus.Event) error {
+		<-release
+		replied <- ebus.Reply(event, 0)
+		return nil
+	})
+	ebus.Register(late)
+	ebus.Subscribe(late, "late")
+	_, err = ebus.Request(0, 10*time.Millisecond, "late")
+	assert.True(ebus.IsRequestTimeoutError(err), "request timed out")
+	close(release)
+	assert.Nil(<-replied, "late reply is no error")
+	select {
+	case letter = <-letters:
+		assert.Fail("late reply passed to dead letters: " + letter.Topic)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// TestSupervisedAgent tests the restart of supervised agents.
+func TestSupervisedAgent(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	provider := config.NewMapConfigurationProvider()
+	config := config.New(provider)
+
+	config.Set("backend", "single")
+
+	err := ebus.Init(config)
+	assert.Nil(err, "single node backend started")
+	defer ebus.Stop()
+
+	sup := supervisor.NewSupervisor("agents", supervisor.OneForOne, 2, time.Second)
+	instances := make(chan int, 10)
+	instance := 0
+	factory := func() ebus.Agent {
+		instance++
+		no := instance
+		return ebus.NewSimpleFuncAgent("crashing", func(event ebus.Event) error {
+			if event.Topic() == "crash" {
+				return fmt.Errorf("crashed")
+			}
+			select {
+			case instances <- no:
+			default:
+			}
+			return nil
+		})
+	}
+	// work emits work until an instance is working on it. Events
+	// emitted during a restart are lost.
+	work := func() int {
+		deadline := time.After(5 * time.Second)
+		for {
+			ebus.Emit(0, "work")
+			select {
+			case no := <-instances:
+				return no
+			case <-time.After(10 * time.Millisecond):
+			case <-deadline:
+				return 0
+			}
+		}
+	}
+
+	applog.Debugf("registering supervised agent")
+	agent, err := ebus.RegisterSupervised(sup, factory)
+	assert.Nil(err, "supervised agent registered")
+	assert.Nil(ebus.Subscribe(agent, "crash"), "subscribed to crash")
+	assert.Nil(ebus.Subscribe(agent, "work"), "subscribed to work")
+	assert.Nil(ebus.Emit(0, "work"), "work emitted")
+	assert.Equal(<-instances, 1, "first instance is working")
+	first := agent.Current()
+
+	applog.Debugf("crashing supervised agent")
+	assert.Nil(ebus.Emit(0, "crash"), "crash emitted")
+	assert.Equal(work(), 2, "second instance is working")
+	assert.True(agent.Current() != first, "handle refers to restarted instance")
+
+	applog.Debugf("crashing supervised agent too often")
+	ebus.Emit(0, "crash")
+	assert.Equal(work(), 3, "third instance is working")
+	ebus.Emit(0, "crash")
+	assert.True(waitFor(func() bool {
+		return supervisor.IsTooMuchRestartsError(sup.Err())
+	}), "too much restarts")
+	assert.True(waitFor(func() bool {
+		_, err := ebus.Lookup("crashing")
+		return ebus.IsAgentNotRegisteredError(err)
+	}), "agent is gone")
+}
+
+// TestSchedules tests delayed and scheduled emissions.
+func TestSchedules(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	provider := config.NewMapConfigurationProvider()
+	config := config.New(provider)
+
+	config.Set("backend", "single")
+
+	err := ebus.Init(config)
+	assert.Nil(err, "single node backend started")
+	defer ebus.Stop()
+
+	received := make(chan string, 10)
+	agent := ebus.NewSimpleFuncAgent("scheduled", func(event ebus.Event) error {
+		var value string
+		if err := event.Payload(&value); err != nil {
+			return err
+		}
+		received <- value
+		return nil
+	})
+	ebus.Register(agent)
+	ebus.Subscribe(agent, "reminder")
+
+	applog.Debugf("emitting delayed events")
+	start := time.Now()
+	after, err := ebus.EmitAfter(100*time.Millisecond, "after", "reminder")
+	assert.Nil(err, "delayed emission scheduled")
+	at, err := ebus.EmitAt(start.Add(50*time.Millisecond), "at", "reminder")
+	assert.Nil(err, "timed emission scheduled")
+	assert.Equal(<-received, "at", "timed event received first")
+	assert.Equal(<-received, "after", "delayed event received second")
+	assert.True(time.Now().Sub(start) >= 100*time.Millisecond, "delay has been respected")
+	assert.False(after.Active(), "delayed emission ended")
+	assert.False(at.Cancel(), "ended emission can't be cancelled")
+
+	applog.Debugf("cancelling delayed event")
+	cancelled, err := ebus.EmitAfter(50*time.Millisecond, "cancelled", "reminder")
+	assert.Nil(err, "delayed emission scheduled")
+	assert.True(cancelled.Cancel(), "delayed emission cancelled")
+	assert.False(cancelled.Cancel(), "delayed emission can't be cancelled twice")
+	select {
+	case value := <-received:
+		assert.Fail("cancelled event received: " + value)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	applog.Debugf("emitting scheduled events")
+	count := 0
+	check := func(now time.Time) (bool, bool) {
+		count++
+		return true, count == 2
+	}
+	scheduled, err := ebus.EmitScheduled(check, "scheduled", "reminder")
+	assert.Nil(err, "scheduled emission started")
+	assert.Equal(<-received, "scheduled", "first scheduled event received")
+	assert.Equal(<-received, "scheduled", "second scheduled event received")
+	assert.True(waitFor(func() bool { return !scheduled.Active() }), "scheduled emission ended")
+
+	applog.Debugf("changing payload after scheduling")
+	value := "unchanged"
+	_, err = ebus.EmitAfter(20*time.Millisecond, &value, "reminder")
+	assert.Nil(err, "delayed emission scheduled")
+	value = "changed"
+	assert.Equal(<-received, "unchanged", "payload encoded when scheduled")
+
+	applog.Debugf("emitting invalid payload")
+	_, err = ebus.EmitAfter(time.Millisecond, func() {}, "reminder")
+	assert.NotNil(err, "invalid payload can't be scheduled")
+}
+
+// TestEventMetadata tests the meta data of events and its propagation.
+func TestEventMetadata(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	provider := config.NewMapConfigurationProvider()
+	config := config.New(provider)
+
+	config.Set("backend", "single")
+
+	err := ebus.Init(config)
+	assert.Nil(err, "single node backend started")
+	defer ebus.Stop()
+
+	orders := make(chan ebus.Event, 1)
+	invoices := make(chan ebus.Event, 1)
+	orderer := ebus.NewSimpleFuncAgent("orderer", func(event ebus.Event) error {
+		orders <- event
+		return ebus.EmitCaused(event, "invoice", "invoice")
+	})
+	invoicer := ebus.NewSimpleFuncAgent("invoicer", func(event ebus.Event) error {
+		invoices <- event
+		return nil
+	})
+	ebus.Register(orderer)
+	ebus.Register(invoicer)
+	ebus.Subscribe(orderer, "order")
+	ebus.Subscribe(invoicer, "invoice")
+
+	applog.Debugf("emitting event with headers")
+	start := time.Now()
+	options := ebus.EmitOptions{Headers: map[string]string{"tenant": "foo"}}
+	err = ebus.EmitWith(options, "order", "order")
+	assert.Nil(err, "event with headers emitted")
+
+	order := <-orders
+	assert.NotEmpty(order.Id(), "order has an id")
+	assert.False(order.Timestamp().Before(start), "order has a timestamp")
+	assert.Equal(order.EmitterId(), "", "order has no emitter")
+	assert.Equal(order.CausationId(), "", "order has no cause")
+	assert.Equal(order.CorrelationId(), order.Id(), "order starts the flow")
+	assert.Equal(order.Header("tenant"), "foo", "order has header")
+
+	invoice := <-invoices
+	assert.Different(invoice.Id(), order.Id(), "invoice has an own id")
+	assert.Equal(invoice.EmitterId(), "orderer", "invoice emitted by orderer")
+	assert.Equal(invoice.CausationId(), order.Id(), "invoice caused by order")
+	assert.Equal(invoice.CorrelationId(), order.Id(), "invoice continues the flow")
+	assert.Equal(invoice.Header("tenant"), "foo", "header propagated")
+
+	applog.Debugf("changing returned headers")
+	headers := invoice.Headers()
+	headers["tenant"] = "bar"
+	assert.Equal(invoice.Header("tenant"), "foo", "headers are a copy")
+}
+
+// TestCodecs tests the encoding of payloads with different codecs.
+func TestCodecs(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	provider := config.NewMapConfigurationProvider()
+	config := config.New(provider)
+
+	config.Set("backend", "single")
+
+	err := ebus.Init(config)
+	assert.Nil(err, "single node backend started")
+	defer ebus.Stop()
+
+	events := make(chan ebus.Event, 1)
+	agent := ebus.NewSimpleFuncAgent("decoder", func(event ebus.Event) error {
+		events <- event
+		return nil
+	})
+	ebus.Register(agent)
+	ebus.Subscribe(agent, "codec/#")
+
+	applog.Debugf("emitting with default codec")
+	assert.Nil(ebus.Emit(CodecPayload{"gob", 1}, "codec", "gob"), "gob event emitted")
+	event := <-events
+	assert.Equal(event.Codec(), ebus.GobCodecName, "gob is default")
+	var payload CodecPayload
+	assert.Nil(event.Payload(&payload), "gob payload decoded")
+	assert.Equal(payload, CodecPayload{"gob", 1}, "gob payload")
+
+	applog.Debugf("emitting with codec per emit")
+	options := ebus.EmitOptions{Codec: ebus.JSONCodecName}
+	assert.Nil(ebus.EmitWith(options, CodecPayload{"json", 2}, "codec", "json"), "json event emitted")
+	event = <-events
+	assert.Equal(event.Codec(), ebus.JSONCodecName, "json chosen per emit")
+	assert.Nil(event.Payload(&payload), "json payload decoded")
+	assert.Equal(payload, CodecPayload{"json", 2}, "json payload")
+
+	applog.Debugf("emitting with codec per topic")
+	assert.Nil(ebus.SetTopicCodec("codec/raw/#", ebus.RawCodecName), "raw codec set for topic")
+	defer ebus.SetTopicCodec("codec/raw/#", "")
+	assert.Nil(ebus.Emit([]byte("raw bytes"), "codec", "raw", "bytes"), "raw event emitted")
+	event = <-events
+	assert.Equal(event.Codec(), ebus.RawCodecName, "raw chosen per topic")
+	var raw string
+	assert.Nil(event.Payload(&raw), "raw payload decoded")
+	assert.Equal(raw, "raw bytes", "raw payload")
+	err = ebus.Emit(42, "codec", "raw", "int")
+	assert.True(ebus.IsInvalidRawPayloadError(err), "raw codec only passes bytes and strings")
+
+	applog.Debugf("using unknown codec")
+	options = ebus.EmitOptions{Codec: "unknown"}
+	err = ebus.EmitWith(options, 0, "codec", "unknown")
+	assert.True(ebus.IsUnknownCodecError(err), "unknown codec for emit")
+	err = ebus.SetTopicCodec("codec/unknown", "unknown")
+	assert.True(ebus.IsUnknownCodecError(err), "unknown codec for topic")
+}
+
+// TestIntrospection tests the retrieval of agent states and topics.
+func TestIntrospection(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	provider := config.NewMapConfigurationProvider()
+	config := config.New(provider)
+
+	config.Set("backend", "single")
+
+	err := ebus.Init(config)
+	assert.Nil(err, "single node backend started")
+	defer ebus.Stop()
+
+	done := make(chan bool, 10)
+	worker := ebus.NewSimpleFuncAgent("inspected/worker", func(event ebus.Event) error {
+		defer func() { done <- true }()
+		if event.Topic() == "inspect/fail" {
+			panic("failing")
+		}
+		time.Sleep(5 * time.Millisecond)
+		return nil
+	})
+	idler := ebus.NewSimpleFuncAgent("inspected/idler", func(event ebus.Event) error {
+		return nil
+	})
+	ebus.Register(worker)
+	ebus.Register(idler)
+	ebus.Subscribe(worker, "inspect/work")
+	ebus.Subscribe(worker, "inspect/fail")
+	ebus.Subscribe(idler, "inspect/#")
+	ebus.Unsubscribe(idler, "inspect/#")
+	ebus.Subscribe(idler, "idle")
+
+	applog.Debugf("inspecting agents and topics")
+	assert.Equal(ebus.Agents(), []string{"inspected/idler", "inspected/worker"}, "registered agents")
+	assert.Equal(ebus.Topics(), []string{"idle", "inspect/fail", "inspect/work"}, "subscribed topics")
+
+	applog.Debugf("inspecting processing statistics")
+	for i := 0; i < 3; i++ {
+		ebus.Emit(i, "inspect/work")
+	}
+	ebus.Emit(0, "inspect/fail")
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+	assert.True(waitFor(func() bool {
+		info, err := ebus.AgentInfo("inspected/worker")
+		return err == nil && info.Processed == 4
+	}), "worker processings recorded")
+	info, err := ebus.AgentInfo("inspected/worker")
+	assert.Nil(err, "worker state retrieved")
+	assert.Equal(info.Id, "inspected/worker", "worker id")
+	assert.Equal(info.Topics, []string{"inspect/fail", "inspect/work"}, "worker topics")
+	assert.Equal(info.InboxLength, 0, "worker inbox is empty")
+	assert.Equal(info.Processed, int64(4), "worker processed events")
+	assert.Equal(info.Failed, int64(1), "worker failed once")
+	assert.ErrorMatch(info.LastError, "panic: failing", "worker last error")
+	assert.True(info.AverageDuration >= 3*time.Millisecond, "worker average duration")
+
+	assert.True(waitFor(func() bool {
+		processed, err := monitoring.ReadVariable("agent/inspected/worker/processed")
+		return err == nil && processed.ActValue == 4
+	}), "processed variable published")
+
+	applog.Debugf("registering an agent with the same id again")
+	assert.Nil(ebus.Deregister(worker), "worker deregistered")
+	worker = ebus.NewSimpleFuncAgent("inspected/worker", func(event ebus.Event) error {
+		return nil
+	})
+	_, err = ebus.Register(worker)
+	assert.Nil(err, "worker registered again")
+	info, err = ebus.AgentInfo("inspected/worker")
+	assert.Nil(err, "new worker state retrieved")
+	assert.Equal(info.Processed, int64(0), "new worker starts counting")
+	assert.True(waitFor(func() bool {
+		processed, err := monitoring.ReadVariable("agent/inspected/worker/processed")
+		return err == nil && processed.ActValue == 0
+	}), "processed variable reset")
+
+	_, err = ebus.AgentInfo("inspected/unknown")
+	assert.True(ebus.IsAgentNotRegisteredError(err), "unknown agent has no state")
+}
+
+// TestPool tests the concurrent processing of pooled agents.
+func TestPool(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	provider := config.NewMapConfigurationProvider()
+	config := config.New(provider)
+
+	config.Set("backend", "single")
+
+	err := ebus.Init(config)
+	assert.Nil(err, "single node backend started")
+	defer ebus.Stop()
+
+	type processing struct {
+		instance int
+		key      string
+	}
+	processings := make(chan processing, 100)
+	newFactory := func(id string) ebus.AgentFactory {
+		instance := 0
+		return func() ebus.Agent {
+			instance++
+			no := instance
+			return ebus.NewSimpleFuncAgent(id, func(event ebus.Event) error {
+				var key string
+				if err := event.Payload(&key); err != nil {
+					return err
+				}
+				if key == "fail" {
+					return fmt.Errorf("failing")
+				}
+				time.Sleep(20 * time.Millisecond)
+				processings <- processing{no, key}
+				return nil
+			})
+		}
+	}
+
+	applog.Debugf("processing round robin")
+	pool, err := ebus.RegisterPool(newFactory("pooled/round-robin"), 4, nil)
+	assert.Nil(err, "round robin pool registered")
+	assert.Equal(pool.Id(), "pooled/round-robin", "pool has id of its agents")
+	looked, err := ebus.Lookup("pooled/round-robin")
+	assert.Nil(err, "pool looked up")
+	assert.Equal(looked, pool, "lookup returns pool")
+	ebus.Subscribe(pool, "pool/round-robin")
+	start := time.Now()
+	for i := 0; i < 8; i++ {
+		ebus.Emit(ebus.Id("key", i), "pool/round-robin")
+	}
+	instances := make(map[int]int)
+	for i := 0; i < 8; i++ {
+		p := <-processings
+		instances[p.instance]++
+	}
+	assert.True(time.Now().Sub(start) < 8*20*time.Millisecond, "events processed concurrently")
+	assert.Equal(instances, map[int]int{1: 2, 2: 2, 3: 2, 4: 2}, "events distributed round robin")
+	assert.True(waitFor(func() bool {
+		info, err := ebus.AgentInfo("pooled/round-robin")
+		return err == nil && info.Processed == 8
+	}), "worker processings recorded")
+
+	applog.Debugf("processing with key affinity")
+	key := func(event ebus.Event) string {
+		var key string
+		event.Payload(&key)
+		return key
+	}
+	pool, err = ebus.RegisterPool(newFactory("pooled/affinity"), 4, key)
+	assert.Nil(err, "affinity pool registered")
+	ebus.Subscribe(pool, "pool/affinity")
+	for i := 0; i < 12; i++ {
+		ebus.Emit(ebus.Id("key", i%3), "pool/affinity")
+	}
+	keys := make(map[string]int)
+	for i := 0; i < 12; i++ {
+		p := <-processings
+		if instance, ok := keys[p.key]; ok {
+			assert.Equal(p.instance, instance, "same key processed by same worker")
+		}
+		keys[p.key] = p.instance
+	}
+	assert.Length(keys, 3, "all keys processed")
+
+	applog.Debugf("stopping pool after unrecoverable error")
+	_, err = ebus.RegisterPool(newFactory("pooled/affinity"), 2, nil)
+	assert.True(ebus.IsDuplicateAgentIdError(err), "pool id is unique")
+	ebus.Emit("fail", "pool/affinity")
+	assert.True(waitFor(func() bool { return pool.Err() != nil }), "pool failed")
+	assert.ErrorMatch(pool.Err(), "failing", "pool failed")
+	ebus.Emit("key/0", "pool/affinity")
+	assert.True(waitFor(func() bool {
+		_, err := ebus.Lookup("pooled/affinity")
+		return ebus.IsAgentNotRegisteredError(err)
+	}), "failed pool is deregistered")
+}
+
+// TestRedisBackend tests the delivery of events via Redis. It needs
+// a running Redis server, so it's only done if its address is set
+// in the environment variable EBUS_REDIS_ADDRESS.
+func TestRedisBackend(t *testing.T) {
+	address := os.Getenv("EBUS_REDIS_ADDRESS")
+	if address == "" {
+		t.Skip("EBUS_REDIS_ADDRESS is not set")
+	}
+	assert := asserts.NewTestingAsserts(t, true)
+	provider := config.NewMapConfigurationProvider()
+	config := config.New(provider)
+
+	config.Set("backend", "redis")
+	config.Set("redis-address", address)
+	config.Set("redis-prefix", "ebus-test")
+	config.Set("inbox-capacity", "1")
+
+	err := ebus.Init(config)
+	assert.Nil(err, "redis backend started")
+	defer ebus.Stop()
+
+	release := make(chan bool)
+	received := make(chan string, 100)
+	slow := ebus.NewSimpleFuncAgent("redis/slow", func(event ebus.Event) error {
+		<-release
+		return nil
+	})
+	fast := ebus.NewSimpleFuncAgent("redis/fast", func(event ebus.Event) error {
+		received <- event.Topic()
+		return nil
+	})
+	ebus.Register(slow)
+	ebus.Register(fast)
+	assert.Nil(ebus.Subscribe(slow, "sensor", "*", "temperature"), "slow agent subscribed")
+	assert.Nil(ebus.Subscribe(fast, "sensor", "#"), "fast agent subscribed")
+	assert.Nil(ebus.Subscribe(fast, "sensor", 0, "temperature"), "fast agent subscribed twice")
+
+	applog.Debugf("emitting more events than a slow agent takes")
+	for i := 0; i < 50; i++ {
+		assert.Nil(ebus.Emit(i, "sensor", i, "temperature"), "event emitted")
+	}
+	close(release)
+	for i := 0; i < 50; i++ {
+		select {
+		case topic := <-received:
+			assert.Equal(topic, ebus.Id("sensor", i, "temperature"), "event received once and in order")
+		case <-time.After(5 * time.Second):
+			assert.Fail("event not received")
+			return
+		}
+	}
+
+	applog.Debugf("emitting after unsubscribing")
+	assert.Nil(ebus.Unsubscribe(fast, "sensor", "#"), "fast agent unsubscribed from pattern")
+	assert.Nil(ebus.Emit(0, "sensor", 0, "temperature"), "event for channel emitted")
+	assert.Nil(ebus.Emit(0, "sensor", 1, "humidity"), "event for pattern emitted")
+	select {
+	case topic := <-received:
+		assert.Equal(topic, "sensor/0/temperature", "event of channel still received")
+	case <-time.After(5 * time.Second):
+		assert.Fail("event not received")
+	}
+	select {
+	case topic := <-received:
+		assert.Fail("event of unsubscribed pattern received: " + topic)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
 //--------------------
 // HELPER
 //--------------------
 
+// waitFor polls the condition until it's true or a
+// deadline is reached. It returns the last result.
+func waitFor(condition func() bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+// receiveTopics receives the number of topics or
+// as many as possible until a deadline is reached.
+func receiveTopics(topics chan string, count int) []string {
+	received := []string{}
+	deadline := time.After(5 * time.Second)
+	for len(received) < count {
+		select {
+		case topic := <-topics:
+			received = append(received, topic)
+		case <-deadline:
+			return received
+		}
+	}
+	return received
+}
+
+// CodecPayload is used to test the payload codecs.
+type CodecPayload struct {
+	Name  string
+	Value int
+}
+
+// RecordingBackend is a backend only recording the topics
+// of the emitted events.
+type RecordingBackend struct {
+	Initialized bool
+	Stopped     bool
+	Emitted     []string
+	InitErr     error
+}
+
+func (b *RecordingBackend) Init(config *config.Configuration) error {
+	b.Initialized = b.InitErr == nil
+	return b.InitErr
+}
+
+func (b *RecordingBackend) Stop() error {
+	b.Stopped = true
+	return nil
+}
+
+func (b *RecordingBackend) Register(agent ebus.Agent) (ebus.Agent, error) {
+	return agent, nil
+}
+
+func (b *RecordingBackend) Deregister(agent ebus.Agent) error {
+	return nil
+}
+
+func (b *RecordingBackend) Lookup(id string) (ebus.Agent, error) {
+	return nil, &ebus.AgentNotRegisteredError{id}
+}
+
+func (b *RecordingBackend) Subscribe(agent ebus.Agent, topic string) error {
+	return nil
+}
+
+func (b *RecordingBackend) Unsubscribe(agent ebus.Agent, topic string) error {
+	return nil
+}
+
+func (b *RecordingBackend) Emit(event ebus.Event) error {
+	b.Emitted = append(b.Emitted, event.Topic())
+	return nil
+}
+
 // EOF
@@ -13,6 +13,7 @@ package ebus
 
 import (
 	"fmt"
+	"time"
 )
 
 //--------------------
@@ -51,6 +52,23 @@ func IsTickerNotFoundError(err error) bool {
 	return ok
 }
 
+// UnknownBackendError will be returned if the configured
+// backend is not registered.
+type UnknownBackendError struct {
+	Name string
+}
+
+// Error returns the error as string.
+func (e *UnknownBackendError) Error() string {
+	return fmt.Sprintf("backend %q is not registered", e.Name)
+}
+
+// IsUnknownBackendError tests the error type.
+func IsUnknownBackendError(err error) bool {
+	_, ok := err.(*UnknownBackendError)
+	return ok
+}
+
 // DuplicateAgentIdError will be returned if an agent id is already
 // known at registration.
 type DuplicateAgentIdError struct {
@@ -85,6 +103,23 @@ func IsAgentNotRegisteredError(err error) bool {
 	return ok
 }
 
+// InvalidTopicPatternError will be returned if a topic pattern
+// uses the multi segment wildcard not as last segment.
+type InvalidTopicPatternError struct {
+	Topic string
+}
+
+// Error returns the error as string.
+func (e *InvalidTopicPatternError) Error() string {
+	return fmt.Sprintf("invalid topic pattern %q", e.Topic)
+}
+
+// IsInvalidTopicPatternError tests the error type.
+func IsInvalidTopicPatternError(err error) bool {
+	_, ok := err.(*InvalidTopicPatternError)
+	return ok
+}
+
 // NoSubscriberError will be returned if no agent has subscribed 
 // to the topic.
 type NoSubscriberError struct {
@@ -102,4 +137,156 @@ func IsNoSubscriberError(err error) bool {
 	return ok
 }
 
+// ChannelSubscriptionError will be returned if the Redis backend
+// cannot subscribe the channel for a topic.
+type ChannelSubscriptionError struct {
+	Channel string
+}
+
+// Error returns the error as string.
+func (e *ChannelSubscriptionError) Error() string {
+	return fmt.Sprintf("cannot subscribe Redis channel %q", e.Channel)
+}
+
+// IsChannelSubscriptionError tests the error type.
+func IsChannelSubscriptionError(err error) bool {
+	_, ok := err.(*ChannelSubscriptionError)
+	return ok
+}
+
+// NoReplyTopicError will be returned if an event shall be replied
+// that has not been emitted as request.
+type NoReplyTopicError struct {
+	Topic string
+}
+
+// Error returns the error as string.
+func (e *NoReplyTopicError) Error() string {
+	return fmt.Sprintf("event with topic %q has no reply topic", e.Topic)
+}
+
+// IsNoReplyTopicError tests the error type.
+func IsNoReplyTopicError(err error) bool {
+	_, ok := err.(*NoReplyTopicError)
+	return ok
+}
+
+// RequestTimeoutError will be returned if no reply to a request
+// has been received in time.
+type RequestTimeoutError struct {
+	Topic   string
+	Timeout time.Duration
+}
+
+// Error returns the error as string.
+func (e *RequestTimeoutError) Error() string {
+	return fmt.Sprintf("no reply to request with topic %q within %v", e.Topic, e.Timeout)
+}
+
+// IsRequestTimeoutError tests the error type.
+func IsRequestTimeoutError(err error) bool {
+	_, ok := err.(*RequestTimeoutError)
+	return ok
+}
+
+// InboxFullError will be returned if an event can't be delivered
+// because the inbox of an agent with the policy InboxFail is full
+// or the inbox timeout of the policy InboxBlock has been reached.
+type InboxFullError struct {
+	Id       string
+	Capacity int
+}
+
+// Error returns the error as string.
+func (e *InboxFullError) Error() string {
+	return fmt.Sprintf("inbox of agent %q with capacity %d is full", e.Id, e.Capacity)
+}
+
+// IsInboxFullError tests the error type.
+func IsInboxFullError(err error) bool {
+	_, ok := err.(*InboxFullError)
+	return ok
+}
+
+// InvalidInboxPolicyError will be returned if an inbox policy
+// name is unknown.
+type InvalidInboxPolicyError struct {
+	Name string
+}
+
+// Error returns the error as string.
+func (e *InvalidInboxPolicyError) Error() string {
+	return fmt.Sprintf("invalid inbox policy %q", e.Name)
+}
+
+// IsInvalidInboxPolicyError tests the error type.
+func IsInvalidInboxPolicyError(err error) bool {
+	_, ok := err.(*InvalidInboxPolicyError)
+	return ok
+}
+
+// JournalNotConfiguredError will be returned if events shall be
+// replayed without a configured journal.
+type JournalNotConfiguredError struct{}
+
+// Error returns the error as string.
+func (e *JournalNotConfiguredError) Error() string {
+	return "no event journal configured"
+}
+
+// IsJournalNotConfiguredError tests the error type.
+func IsJournalNotConfiguredError(err error) bool {
+	_, ok := err.(*JournalNotConfiguredError)
+	return ok
+}
+
+// UnknownCodecError will be returned if a payload codec
+// is not registered.
+type UnknownCodecError struct {
+	Name string
+}
+
+// Error returns the error as string.
+func (e *UnknownCodecError) Error() string {
+	return fmt.Sprintf("codec %q is not registered", e.Name)
+}
+
+// IsUnknownCodecError tests the error type.
+func IsUnknownCodecError(err error) bool {
+	_, ok := err.(*UnknownCodecError)
+	return ok
+}
+
+// InvalidRawPayloadError will be returned if the raw codec shall
+// encode or decode other types than byte slices or strings.
+type InvalidRawPayloadError struct {
+	Type string
+}
+
+// Error returns the error as string.
+func (e *InvalidRawPayloadError) Error() string {
+	return fmt.Sprintf("raw codec cannot handle payload type %s", e.Type)
+}
+
+// IsInvalidRawPayloadError tests the error type.
+func IsInvalidRawPayloadError(err error) bool {
+	_, ok := err.(*InvalidRawPayloadError)
+	return ok
+}
+
+// NotInspectableError will be returned if the agents of a
+// backend not implementing InspectableBackend shall be inspected.
+type NotInspectableError struct{}
+
+// Error returns the error as string.
+func (e *NotInspectableError) Error() string {
+	return "event bus backend cannot be inspected"
+}
+
+// IsNotInspectableError tests the error type.
+func IsNotInspectableError(err error) bool {
+	_, ok := err.(*NotInspectableError)
+	return ok
+}
+
 // EOF
@@ -16,6 +16,7 @@ import (
 	"github.com/denkhaus/tcgl/asserts"
 	"github.com/denkhaus/tcgl/config"
 	"fmt"
+	"sort"
 	"testing"
 	"time"
 )
@@ -51,6 +52,100 @@ func TestEventBox(t *testing.T) {
 	assert.Equal(inbox.pop().event.Topic(), Id("Event", 5), "fifth event")
 }
 
+// TestBoundedBox tests the overflow policies of bounded boxes.
+func TestBoundedBox(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	topics := func(inbox *box) []string {
+		ts := []string{}
+		for inbox.len() > 0 {
+			ts = append(ts, inbox.pop().event.Topic())
+		}
+		return ts
+	}
+
+	inbox := newBoundedBox(2, InboxDropNewest)
+	inbox.push(EventMessage(EmptyPayload, "Event", 1))
+	inbox.push(EventMessage(EmptyPayload, "Event", 2))
+	dropped, err := inbox.push(EventMessage(EmptyPayload, "Event", 3))
+	assert.True(dropped, "newest event dropped")
+	assert.Nil(err, "no error when dropping newest")
+	assert.Equal(topics(inbox), []string{"Event/1", "Event/2"}, "newest event dropped")
+
+	inbox = newBoundedBox(2, InboxDropOldest)
+	inbox.push(EventMessage(EmptyPayload, "Event", 1))
+	inbox.push(&boxMessage{msgSubscribe, nil, "foo"})
+	inbox.push(EventMessage(EmptyPayload, "Event", 2))
+	dropped, err = inbox.push(EventMessage(EmptyPayload, "Event", 3))
+	assert.True(dropped, "oldest event dropped")
+	assert.Nil(err, "no error when dropping oldest")
+	assert.Equal(inbox.pop().kind, msgSubscribe, "control message not dropped")
+	assert.Equal(topics(inbox), []string{"Event/2", "Event/3"}, "oldest event dropped")
+
+	inbox = newBoundedBox(1, InboxFail)
+	inbox.push(EventMessage(EmptyPayload, "Event", 1))
+	dropped, err = inbox.push(EventMessage(EmptyPayload, "Event", 2))
+	assert.True(dropped, "failed event dropped")
+	assert.True(IsInboxFullError(err), "error when inbox is full")
+
+	inbox = newBoundedBox(1, InboxBlock)
+	inbox.push(EventMessage(EmptyPayload, "Event", 1))
+	pushed := make(chan bool)
+	go func() {
+		inbox.push(EventMessage(EmptyPayload, "Event", 2))
+		pushed <- true
+	}()
+	select {
+	case <-pushed:
+		assert.Fail("push has not been blocked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(inbox.pop().event.Topic(), "Event/1", "first event")
+	<-pushed
+	assert.Equal(inbox.pop().event.Topic(), "Event/2", "blocked event")
+
+	inbox.limit(1, InboxBlock, 20*time.Millisecond)
+	inbox.push(EventMessage(EmptyPayload, "Event", 3))
+	dropped, err = inbox.push(EventMessage(EmptyPayload, "Event", 4))
+	assert.True(dropped, "push not blocked after timeout")
+	assert.True(IsInboxFullError(err), "error when timeout is reached")
+
+	policy, err := ParseInboxPolicy("drop-oldest")
+	assert.Nil(err, "policy parsed")
+	assert.Equal(policy, InboxDropOldest, "policy parsed")
+	_, err = ParseInboxPolicy("drop-all")
+	assert.True(IsInvalidInboxPolicyError(err), "invalid policy")
+}
+
+// TestEventEnvelope tests the serialization of events.
+func TestEventEnvelope(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+
+	event, err := newEncodedEvent(JSONCodecName, map[string]int{"a": 1}, "envelope")
+	assert.Nil(err, "json event created")
+	event.headers["tenant"] = "foo"
+	data, err := event.marshal()
+	assert.Nil(err, "json event marshalled")
+	assert.Substring(string(data), `"payload":{"a":1}`, "json payload embedded")
+	unmarshalled, err := unmarshalEvent("envelope", data)
+	assert.Nil(err, "json event unmarshalled")
+	assert.Equal(unmarshalled.Id(), event.Id(), "id unmarshalled")
+	assert.Equal(unmarshalled.Header("tenant"), "foo", "header unmarshalled")
+	var payload map[string]int
+	assert.Nil(unmarshalled.Payload(&payload), "json payload decoded")
+	assert.Equal(payload["a"], 1, "json payload unmarshalled")
+
+	event, err = newEncodedEvent(RawCodecName, "raw bytes", "envelope")
+	assert.Nil(err, "raw event created")
+	data, err = event.marshal()
+	assert.Nil(err, "raw event marshalled")
+	assert.Substring(string(data), `"data":"cmF3IGJ5dGVz"`, "raw payload as data")
+	unmarshalled, err = unmarshalEvent("envelope", data)
+	assert.Nil(err, "raw event unmarshalled")
+	var raw string
+	assert.Nil(unmarshalled.Payload(&raw), "raw payload decoded")
+	assert.Equal(raw, "raw bytes", "raw payload unmarshalled")
+}
+
 // TestAgentRunner tests the runtime for an agent.
 func TestAgentRunner(t *testing.T) {
 	assert := asserts.NewTestingAsserts(t, true)
@@ -91,6 +186,64 @@ func TestAgentRunner(t *testing.T) {
 	runner.stop()
 
 	assert.ErrorMatch(agent.Err(), "hard panic is too hard for me", "hard panic")
+
+	// Inbox configuration of wrapped agents.
+	runner = newAgentRunner(newSupervisedAgent(&boundedTestAgent{NewTestAgent(2)}))
+	defer runner.stop()
+	assert.Equal(runner.inbox.capacity, 5, "inbox capacity of supervised agent")
+	assert.Equal(runner.inbox.policy, InboxFail, "inbox policy of supervised agent")
+
+	// Inbox length without control messages.
+	idle := &agentRunner{agent: NewTestAgent(3), inbox: newBox()}
+	idle.subscribe("one")
+	runnerPush(assert, idle, EmptyPayload, "one")
+	assert.Equal(idle.info(nil).InboxLength, 1, "only events counted")
+}
+
+// TestPoolAgent tests the inboxes and statistics of the pool workers.
+func TestPoolAgent(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+
+	InitSingle()
+	defer Stop()
+
+	release := make(chan bool)
+	factory := func() Agent {
+		return NewSimpleFuncAgent("pooled", func(event Event) error {
+			if event.Topic() == "fail" {
+				return fmt.Errorf("failing")
+			}
+			<-release
+			return nil
+		})
+	}
+	pool := newPoolAgent(factory, 1, nil)
+	capacity, policy := pool.configureInbox(1, InboxBlock, 20*time.Millisecond)
+	assert.Equal(capacity, 1, "default inbox capacity used")
+	assert.Equal(policy, InboxBlock, "default inbox policy used")
+	results := make(chan error, 10)
+	pool.setRecorder(func(duration time.Duration, failure error) {
+		results <- failure
+	}, nil)
+
+	// Bounded worker inbox.
+	event, _ := newSimpleEvent(EmptyPayload, "block")
+	assert.Nil(pool.Process(event), "first event processed")
+	assert.True(waitFor(func() bool { return pool.workers[0].inbox.queued() == 0 }), "first event taken")
+	assert.Nil(pool.Process(event), "second event queued")
+	err := pool.Process(event)
+	assert.True(IsInboxFullError(err), "third event rejected after timeout")
+	release <- true
+	release <- true
+	assert.Nil(<-results, "first processing recorded")
+	assert.Nil(<-results, "second processing recorded")
+
+	// Dead worker.
+	event, _ = newSimpleEvent(EmptyPayload, "fail")
+	assert.Nil(pool.Process(event), "failing event passed")
+	assert.ErrorMatch(<-results, "failing", "failure recorded")
+	assert.True(waitFor(func() bool { return pool.Err() != nil }), "worker died")
+	assert.ErrorMatch(pool.Process(event), "failing", "dead worker reported")
 }
 
 // TestNodeRouter tests the event router for one node.
@@ -175,6 +328,70 @@ func TestNodeRouter(t *testing.T) {
 	}
 }
 
+// TestTopicTrie tests the matching of topics and topic patterns.
+func TestTopicTrie(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	trie := newTopicTrie()
+	runner := func(no int) *agentRunner {
+		return &agentRunner{agent: NewTestAgent(no)}
+	}
+	ids := func(topic string) []string {
+		matched := []string{}
+		for id := range trie.match(topic) {
+			matched = append(matched, id)
+		}
+		sort.Strings(matched)
+		return matched
+	}
+
+	assert.Nil(trie.add("sensor/kitchen/temperature", runner(1)), "exact topic added")
+	assert.Nil(trie.add("sensor/*/temperature", runner(2)), "segment pattern added")
+	assert.Nil(trie.add("sensor/#", runner(3)), "multi segment pattern added")
+	assert.Nil(trie.add("#", runner(4)), "catch all pattern added")
+	assert.Nil(trie.add("orders/*", runner(5)), "segment pattern added")
+
+	err := trie.add("sensor/#/temperature", runner(6))
+	assert.True(IsInvalidTopicPatternError(err), "multi segment wildcard must be last")
+
+	assert.Equal(ids("sensor/kitchen/temperature"), []string{"TestAgent/1", "TestAgent/2", "TestAgent/3", "TestAgent/4"}, "all matching")
+	assert.Equal(ids("sensor/garage/temperature"), []string{"TestAgent/2", "TestAgent/3", "TestAgent/4"}, "patterns matching")
+	assert.Equal(ids("sensor/garage/humidity"), []string{"TestAgent/3", "TestAgent/4"}, "multi segment matching")
+	assert.Equal(ids("sensor"), []string{"TestAgent/3", "TestAgent/4"}, "multi segment matches no segment")
+	assert.Equal(ids("orders/4711"), []string{"TestAgent/4", "TestAgent/5"}, "single segment matching")
+	assert.Equal(ids("orders/4711/items"), []string{"TestAgent/4"}, "single segment not matching more")
+
+	trie.remove("#", "TestAgent/4")
+	trie.remove("sensor/*/temperature", "TestAgent/2")
+	trie.remove("orders/*", "TestAgent/5")
+	assert.Equal(ids("sensor/garage/temperature"), []string{"TestAgent/3"}, "removed patterns")
+	assert.Equal(ids("orders/4711"), []string{}, "no more matching")
+	assert.Length(trie.root.children, 1, "empty nodes pruned")
+}
+
+// TestRedisChannels tests the mapping of topics to Redis channels
+// and the selection of one channel per received value.
+func TestRedisChannels(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	b := &redisBackend{prefix: "ebus", channels: make(map[string]string)}
+
+	assert.Equal(b.channel("orders/new"), "ebus:orders/new", "exact topic")
+	assert.Equal(b.channel("sensor/*/temperature"), "ebus:sensor/*/temperature", "segment wildcard")
+	assert.Equal(b.channel("orders/#"), "ebus:orders*", "multi segment wildcard")
+	assert.Equal(b.channel("#"), "ebus:*", "catch all")
+	assert.Equal(b.channel("what?/a*b"), `ebus:what\?/a\*b`, "escaped glob characters")
+
+	for _, topic := range []string{"sensor/kitchen/temperature", "sensor/*/temperature", "sensor/#"} {
+		b.channels[b.channel(topic)] = topic
+	}
+	assert.False(b.isFirstMatch("ebus:sensor/kitchen/temperature", "sensor/kitchen/temperature"), "not first")
+	assert.False(b.isFirstMatch("ebus:sensor/*/temperature", "sensor/kitchen/temperature"), "not first")
+	assert.True(b.isFirstMatch("ebus:sensor*", "sensor/kitchen/temperature"), "first")
+	delete(b.channels, "ebus:sensor*")
+	assert.True(b.isFirstMatch("ebus:sensor/*/temperature", "sensor/garage/temperature"), "first")
+	assert.True(b.isFirstMatch("ebus:sensor/*/temperature", "sensor/kitchen/temperature"), "first")
+	assert.False(b.isFirstMatch("ebus:sensor*", "sensors"), "wider Redis pattern not matching")
+}
+
 //--------------------
 // HELPERS
 //--------------------
@@ -192,6 +409,19 @@ func routerPush(a *asserts.Asserts, r *nodeRouter, p interface{}, topic string)
 	a.Nil(err, "no error during push")
 }
 
+// waitFor polls the condition until it's true or a
+// deadline is reached. It returns the last result.
+func waitFor(condition func() bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
 var EmptyPayload = struct {
 	A int
 	B string
@@ -275,4 +505,14 @@ func (t *TestAgent) Err() error {
 	return t.err
 }
 
+// boundedTestAgent is a test agent with an own inbox configuration.
+type boundedTestAgent struct {
+	*TestAgent
+}
+
+// InboxConfig returns the capacity and the policy of the inbox.
+func (b *boundedTestAgent) InboxConfig() (int, InboxPolicy) {
+	return 5, InboxFail
+}
+
 // EOF
@@ -0,0 +1,251 @@
+// Tideland Common Go Library - Event Bus - Journal
+//
+// Copyright (C) 2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package ebus
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"github.com/denkhaus/tcgl/applog"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+//--------------------
+// FUNCTIONS
+//--------------------
+
+// Replay emits all journaled events emitted between from and to
+// again. If topics are passed only the events matching one of those
+// topics or topic patterns are replayed. It returns the number of
+// replayed events. Replayed events are not journaled again.
+func Replay(from, to time.Time, topics ...string) (int, error) {
+	if eventBus == nil {
+		panic("event bus is not initialized")
+	}
+	eventJournal.mutex.RLock()
+	j := eventJournal.journal
+	eventJournal.mutex.RUnlock()
+	if j == nil {
+		return 0, &JournalNotConfiguredError{}
+	}
+	replayed := 0
+	err := j.read(func(entry *journalEntry) error {
+		if entry.Time.Before(from) || entry.Time.After(to) || !matchAnyTopic(topics, entry.Topic) {
+			return nil
+		}
+		event, err := unmarshalEvent(entry.Topic, entry.Event)
+		if err != nil {
+			return err
+		}
+		if err := eventBus.Emit(event); err != nil && !IsNoSubscriberError(err) {
+			return err
+		}
+		replayed++
+		return nil
+	})
+	return replayed, err
+}
+
+// matchAnyTopic checks if one of the topics or topic patterns
+// matches the topic. No topics match every topic.
+func matchAnyTopic(patterns []string, topic string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matchTopic(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+//--------------------
+// JOURNAL
+//--------------------
+
+// journalFileExt is the extension of the journal files.
+const journalFileExt = ".journal"
+
+// eventJournal guards the journal used by the API functions.
+// It's nil if journaling is not configured.
+var eventJournal struct {
+	mutex   sync.RWMutex
+	journal *journal
+}
+
+// replaceJournal sets the journal used by the API functions
+// and closes the one used before.
+func replaceJournal(j *journal) {
+	eventJournal.mutex.Lock()
+	defer eventJournal.mutex.Unlock()
+	if eventJournal.journal != nil {
+		if err := eventJournal.journal.close(); err != nil {
+			applog.Errorf("cannot close event journal: %v", err)
+		}
+	}
+	eventJournal.journal = j
+}
+
+// writeJournal writes the event into the journal if configured.
+func writeJournal(event *simpeEvent) error {
+	eventJournal.mutex.RLock()
+	defer eventJournal.mutex.RUnlock()
+	if eventJournal.journal == nil {
+		return nil
+	}
+	return eventJournal.journal.write(event)
+}
+
+// journalEntry is one journaled event. The entries are written
+// as one JSON object per line.
+type journalEntry struct {
+	Topic string          `json:"topic"`
+	Time  time.Time       `json:"time"`
+	Event json.RawMessage `json:"event"`
+}
+
+// journal writes all emitted events into a file per start inside
+// of a directory. Replays read all files of the directory. Written
+// events are synced to disk at once or, with an interval, in batches.
+type journal struct {
+	mutex    sync.Mutex
+	dir      string
+	file     *os.File
+	encoder  *json.Encoder
+	interval time.Duration
+	dirty    bool
+	stopChan chan bool
+}
+
+// openJournal creates a new journal file in the directory.
+func openJournal(dir string, interval time.Duration) (*journal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	name := "ebus-" + time.Now().UTC().Format("20060102-150405.000000000") + journalFileExt
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	j := &journal{
+		dir:      dir,
+		file:     file,
+		encoder:  json.NewEncoder(file),
+		interval: interval,
+		stopChan: make(chan bool),
+	}
+	if interval > 0 {
+		go j.backend()
+	}
+	return j, nil
+}
+
+// write appends the event to the journal.
+func (j *journal) write(event *simpeEvent) error {
+	data, err := event.marshal()
+	if err != nil {
+		return err
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if err := j.encoder.Encode(&journalEntry{event.topic, time.Now(), data}); err != nil {
+		return err
+	}
+	if j.interval > 0 {
+		j.dirty = true
+		return nil
+	}
+	return j.file.Sync()
+}
+
+// sync syncs the events written since the last sync to disk.
+func (j *journal) sync() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if !j.dirty {
+		return nil
+	}
+	j.dirty = false
+	return j.file.Sync()
+}
+
+// backend syncs the written events in the interval.
+func (j *journal) backend() {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := j.sync(); err != nil {
+				applog.Errorf("cannot sync event journal: %v", err)
+			}
+		case <-j.stopChan:
+			return
+		}
+	}
+}
+
+// read calls f for each entry of all journal files in the
+// order they have been written.
+func (j *journal) read(f func(entry *journalEntry) error) error {
+	names, err := filepath.Glob(filepath.Join(j.dir, "*"+journalFileExt))
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := j.readFile(name, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readFile calls f for each entry of one journal file. A
+// truncated last entry, e.g. after a crash, is ignored.
+func (j *journal) readFile(name string, f func(entry *journalEntry) error) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	for {
+		var entry journalEntry
+		switch err := decoder.Decode(&entry); err {
+		case nil:
+			if err := f(&entry); err != nil {
+				return err
+			}
+		case io.EOF, io.ErrUnexpectedEOF:
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+// close syncs and closes the journal file.
+func (j *journal) close() error {
+	close(j.stopChan)
+	if err := j.sync(); err != nil {
+		j.file.Close()
+		return err
+	}
+	return j.file.Close()
+}
+
+// EOF
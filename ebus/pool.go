@@ -0,0 +1,245 @@
+// Tideland Common Go Library - Event Bus - Pool
+//
+// Copyright (C) 2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package ebus
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"github.com/denkhaus/tcgl/applog"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+//--------------------
+// FUNCTIONS
+//--------------------
+
+// KeyFunc returns the key of an event. Events with the same key
+// are processed by the same worker of a pool in their order.
+type KeyFunc func(event Event) string
+
+// RegisterPool registers a pool of agents created by the factory
+// under the id of the first instance. The events are distributed
+// to the workers round robin or, if a key function is passed, by
+// the key of the events. The inboxes of the workers are configured
+// like the inbox of the pool. The processings of the workers are
+// counted in the statistics of the pool. If one worker isn't
+// recoverable after an error the whole pool stops.
+func RegisterPool(factory AgentFactory, poolSize int, key KeyFunc) (Agent, error) {
+	if eventBus == nil {
+		panic("event bus is not initialized")
+	}
+	pool := newPoolAgent(factory, poolSize, key)
+	if _, err := Register(pool); err != nil {
+		pool.Stop()
+		return nil, err
+	}
+	return pool, nil
+}
+
+//--------------------
+// POOL AGENT
+//--------------------
+
+// poolAgent distributes the events to a number of workers.
+type poolAgent struct {
+	mutex   sync.Mutex
+	id      string
+	workers []*poolWorker
+	key     KeyFunc
+	next    int
+	err     error
+	record  func(duration time.Duration, failure error)
+	drop    func()
+}
+
+// newPoolAgent creates a pool agent and starts its workers.
+func newPoolAgent(factory AgentFactory, poolSize int, key KeyFunc) *poolAgent {
+	if poolSize < 1 {
+		poolSize = 1
+	}
+	p := &poolAgent{key: key}
+	for i := 0; i < poolSize; i++ {
+		w := &poolWorker{p, factory(), newBox()}
+		p.workers = append(p.workers, w)
+		go w.backend()
+	}
+	p.id = p.workers[0].agent.Id()
+	return p
+}
+
+// Id returns the unique identifier of the agent.
+func (p *poolAgent) Id() string {
+	return p.id
+}
+
+// Process passes the event to a worker. It returns the error
+// of a worker which hasn't been recoverable or an InboxFullError
+// if the event can't be queued into the full inbox of the worker.
+func (p *poolAgent) Process(event Event) error {
+	worker, err := p.selectWorker(event)
+	if err != nil {
+		return err
+	}
+	dropped, err := worker.inbox.push(&boxMessage{msgEvent, event, ""})
+	switch {
+	case err == errBoxClosed:
+		// The worker died after the selection.
+		return p.Err()
+	case IsInboxFullError(err):
+		return &InboxFullError{p.id, err.(*InboxFullError).Capacity}
+	case err != nil:
+		return err
+	case dropped:
+		p.recordDrop()
+	}
+	return nil
+}
+
+// Recover from an error during the processing of an event. The
+// pool isn't recoverable if one of its workers isn't.
+func (p *poolAgent) Recover(r interface{}, event Event) error {
+	return p.Err()
+}
+
+// Stop tells the agent to stop all workers.
+func (p *poolAgent) Stop() {
+	for _, worker := range p.workers {
+		worker.inbox.push(&boxMessage{msgStop, nil, ""})
+	}
+}
+
+// Err returns the error the agent possibly stopped with.
+func (p *poolAgent) Err() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.err
+}
+
+// configureInbox limits the inboxes of the workers like the inbox
+// of the pool. The pooled agents may configure it on their own,
+// otherwise the passed defaults are used. It returns the used
+// configuration.
+func (p *poolAgent) configureInbox(capacity int, policy InboxPolicy, timeout time.Duration) (int, InboxPolicy) {
+	if ba, ok := p.workers[0].agent.(BoundedAgent); ok {
+		capacity, policy = ba.InboxConfig()
+	}
+	for _, worker := range p.workers {
+		worker.inbox.limit(capacity, policy, timeout)
+	}
+	return capacity, policy
+}
+
+// setRecorder sets the functions recording the results of the
+// workers and the events dropped by their inboxes in the statistics
+// of the pool.
+func (p *poolAgent) setRecorder(record func(duration time.Duration, failure error), drop func()) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.record = record
+	p.drop = drop
+}
+
+// selectWorker returns the worker for the event. The mutex
+// isn't held while pushing, so a dying worker can fail the pool.
+func (p *poolAgent) selectWorker(event Event) (*poolWorker, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.err != nil {
+		return nil, p.err
+	}
+	if p.key != nil {
+		hash := fnv.New32a()
+		hash.Write([]byte(p.key(event)))
+		return p.workers[hash.Sum32()%uint32(len(p.workers))], nil
+	}
+	worker := p.workers[p.next]
+	p.next = (p.next + 1) % len(p.workers)
+	return worker, nil
+}
+
+// recordWorker passes the result of a worker processing
+// to the recorder if it's set.
+func (p *poolAgent) recordWorker(duration time.Duration, failure error) {
+	p.mutex.Lock()
+	record := p.record
+	p.mutex.Unlock()
+	if record != nil {
+		record(duration, failure)
+	}
+}
+
+// recordDrop passes an event dropped by the inbox of a
+// worker to the recorder if it's set.
+func (p *poolAgent) recordDrop() {
+	p.mutex.Lock()
+	drop := p.drop
+	p.mutex.Unlock()
+	if drop != nil {
+		drop()
+	}
+}
+
+// fail keeps the first error of a worker which
+// isn't recoverable.
+func (p *poolAgent) fail(err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+//--------------------
+// POOL WORKER
+//--------------------
+
+// poolWorker lets one agent instance of a pool process
+// its part of the events.
+type poolWorker struct {
+	pool  *poolAgent
+	agent Agent
+	inbox *box
+}
+
+// backend runs the endless processing loop. If the worker isn't
+// recoverable the events still in its inbox are passed to the dead
+// letter topic together with the one it failed on.
+func (w *poolWorker) backend() {
+	defer w.agent.Stop()
+	defer w.inbox.close()
+	for {
+		message := w.inbox.pop()
+		if message.kind == msgStop {
+			return
+		}
+		if err := w.process(message.event); err != nil {
+			applog.Errorf("worker of pool %q is not recoverable after error: %v", w.pool.id, err)
+			w.pool.fail(err)
+			w.inbox.close()
+			emitDeadLetter(message.event, w.pool.id, err)
+			for _, event := range w.inbox.drain() {
+				emitDeadLetter(event, w.pool.id, err)
+			}
+			return
+		}
+	}
+}
+
+// process processes one event and records the result
+// in the statistics of the pool.
+func (w *poolWorker) process(event Event) error {
+	name := fmt.Sprintf("worker of pool %q", w.pool.id)
+	return processEvent(name, w.agent, event, w.pool.recordWorker)
+}
+
+// EOF
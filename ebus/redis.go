@@ -0,0 +1,430 @@
+// Tideland Common Go Library - Event Bus - Redis Backend
+//
+// Copyright (C) 2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed 
+// by the new BSD license.
+
+package ebus
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"github.com/denkhaus/tcgl/applog"
+	"github.com/denkhaus/tcgl/config"
+	"github.com/denkhaus/tcgl/redis"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+//--------------------
+// REDIS BACKEND
+//--------------------
+
+// resubscribeDelay is the time to wait between the
+// attempts to subscribe again after a subscription ended.
+const resubscribeDelay = time.Second
+
+// redisBackend implements the event bus backend for multiple nodes
+// connected via Redis. Agents are registered locally, their topics
+// are subscribed as Redis channels. Received events are queued and
+// delivered by a local node router, so slow agents don't stop the
+// receiving. The mutex guards the maps and the subscription, the
+// Redis calls to change the subscription are serialized by their
+// own mutex so that receiving isn't blocked by them.
+type redisBackend struct {
+	mutex        sync.Mutex
+	subscribing  sync.Mutex
+	router       *nodeRouter
+	database     *redis.Database
+	subscription *redis.Subscription
+	deliveries   *box
+	delivered    chan bool
+	prefix       string
+	channels     map[string]string
+	subscribers  map[string]map[string]bool
+	stopped      bool
+}
+
+func newRedisBackend() Backend {
+	b := &redisBackend{
+		router:      newNodeRouter(),
+		deliveries:  newBox(),
+		delivered:   make(chan bool),
+		channels:    make(map[string]string),
+		subscribers: make(map[string]map[string]bool),
+	}
+	go b.deliver()
+	return b
+}
+
+// Init initializes the Redis event bus with the given configuration. The
+// keys are "redis-address", "redis-database", "redis-auth", "redis-timeout"
+// and "redis-prefix" for the prefix of the channels.
+func (b *redisBackend) Init(config *config.Configuration) error {
+	address, err := config.GetDefault("redis-address", "127.0.0.1:6379")
+	if err != nil {
+		return err
+	}
+	database, err := config.GetIntDefault("redis-database", 0)
+	if err != nil {
+		return err
+	}
+	auth, err := config.GetDefault("redis-auth", "")
+	if err != nil {
+		return err
+	}
+	timeout, err := config.GetDurationDefault("redis-timeout", 5*time.Second)
+	if err != nil {
+		return err
+	}
+	b.prefix, err = config.GetDefault("redis-prefix", "ebus")
+	if err != nil {
+		return err
+	}
+	b.database = redis.Connect(redis.Configuration{
+		Address:  address,
+		Database: database,
+		Auth:     auth,
+		Timeout:  timeout,
+	})
+	return b.router.configure(config)
+}
+
+// Stop shuts the event bus down. The events already
+// received are delivered before the router stops.
+func (b *redisBackend) Stop() error {
+	stopTickers()
+	b.subscribing.Lock()
+	defer b.subscribing.Unlock()
+	b.mutex.Lock()
+	b.stopped = true
+	subscription := b.subscription
+	b.subscription = nil
+	b.mutex.Unlock()
+	if subscription != nil {
+		subscription.Stop()
+	}
+	b.deliveries.push(&boxMessage{msgStop, nil, ""})
+	<-b.delivered
+	b.router.stop()
+	b.database.Close()
+	return nil
+}
+
+// Register adds an agent.
+func (b *redisBackend) Register(agent Agent) (Agent, error) {
+	err := b.router.register(agent)
+	return agent, err
+}
+
+// Deregister stops and removes the agent.
+func (b *redisBackend) Deregister(agent Agent) error {
+	if err := b.router.deregister(agent); err != nil {
+		return err
+	}
+	b.subscribing.Lock()
+	defer b.subscribing.Unlock()
+	b.mutex.Lock()
+	channels := []string{}
+	for topic := range b.subscribers {
+		if channel := b.removeSubscriber(agent.Id(), topic); channel != "" {
+			channels = append(channels, channel)
+		}
+	}
+	subscription := b.subscription
+	b.mutex.Unlock()
+	b.unsubscribeChannels(subscription, channels)
+	return nil
+}
+
+// Lookup retrieves a registered agent by id.
+func (b *redisBackend) Lookup(id string) (Agent, error) {
+	return b.router.lookup(id)
+}
+
+// Subscribe subscribes the agent to the topic. The first
+// subscription of the node subscribes the Redis channel. If
+// this fails the local subscription is removed again.
+func (b *redisBackend) Subscribe(agent Agent, topic string) error {
+	if err := b.router.subscribe(agent, topic); err != nil {
+		return err
+	}
+	b.subscribing.Lock()
+	defer b.subscribing.Unlock()
+	b.mutex.Lock()
+	subscribed := b.subscribers[topic] != nil
+	subscription := b.subscription
+	b.mutex.Unlock()
+	if !subscribed {
+		if err := b.subscribeChannel(subscription, topic); err != nil {
+			b.router.unsubscribe(agent, topic)
+			return err
+		}
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.subscribers[topic][agent.Id()] = true
+	return nil
+}
+
+// subscribeChannel subscribes the Redis channel for the topic. If
+// there's no subscription yet a new one is started. The subscribing
+// mutex has to be locked by the caller, the mutex must not.
+func (b *redisBackend) subscribeChannel(subscription *redis.Subscription, topic string) error {
+	channel := b.channel(topic)
+	if subscription == nil {
+		subscription, err := b.database.Subscribe(channel)
+		if err != nil {
+			return err
+		}
+		if subscription.ChannelCount() == 0 {
+			subscription.Stop()
+			return &ChannelSubscriptionError{channel}
+		}
+		b.mutex.Lock()
+		b.subscription = subscription
+		b.mutex.Unlock()
+		go b.receive(subscription)
+	} else if subscription.Subscribe(channel) == 0 {
+		return &ChannelSubscriptionError{channel}
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.channels[channel] = topic
+	b.subscribers[topic] = make(map[string]bool)
+	return nil
+}
+
+// Unsubscribe removes the subscription of the agent from the topic. The
+// last unsubscription of the node unsubscribes the Redis channel.
+func (b *redisBackend) Unsubscribe(agent Agent, topic string) error {
+	if err := b.router.unsubscribe(agent, topic); err != nil {
+		return err
+	}
+	b.subscribing.Lock()
+	defer b.subscribing.Unlock()
+	b.mutex.Lock()
+	channel := b.removeSubscriber(agent.Id(), topic)
+	subscription := b.subscription
+	b.mutex.Unlock()
+	if channel != "" {
+		b.unsubscribeChannels(subscription, []string{channel})
+	}
+	return nil
+}
+
+// Emit emits new event to the event bus by publishing it
+// to the channel of its topic.
+func (b *redisBackend) Emit(event Event) error {
+	se, ok := event.(*simpeEvent)
+	if !ok {
+		return fmt.Errorf("event type %T cannot be published", event)
+	}
+	data, err := se.marshal()
+	if err != nil {
+		return err
+	}
+	receivers, err := b.database.Publish(b.prefix+":"+se.topic, data)
+	if err != nil {
+		return err
+	}
+	if receivers == 0 {
+		return &NoSubscriberError{se.topic}
+	}
+	return nil
+}
+
+// removeSubscriber removes the agent from the subscribers of the
+// topic. If it has been the last one the channel of the topic is
+// returned to be unsubscribed, otherwise an empty string. The mutex
+// has to be locked by the caller.
+func (b *redisBackend) removeSubscriber(id, topic string) string {
+	if b.subscribers[topic] == nil || !b.subscribers[topic][id] {
+		return ""
+	}
+	delete(b.subscribers[topic], id)
+	if len(b.subscribers[topic]) > 0 {
+		return ""
+	}
+	channel := b.channel(topic)
+	delete(b.subscribers, topic)
+	delete(b.channels, channel)
+	return channel
+}
+
+// unsubscribeChannels unsubscribes the Redis channels. The subscribing
+// mutex has to be locked by the caller, the mutex must not.
+func (b *redisBackend) unsubscribeChannels(subscription *redis.Subscription, channels []string) {
+	if subscription == nil {
+		return
+	}
+	for _, channel := range channels {
+		subscription.Unsubscribe(channel)
+	}
+}
+
+// channel returns the Redis channel for a topic. Topic patterns
+// are mapped to Redis patterns, all other glob characters are
+// escaped. The Redis patterns may be wider than the topic patterns,
+// so the local router does the exact matching.
+func (b *redisBackend) channel(topic string) string {
+	segments := strings.Split(topic, "/")
+	last := len(segments) - 1
+	multi := segments[last] == WildcardMultiSegment
+	for i, segment := range segments {
+		switch segment {
+		case WildcardSegment, WildcardMultiSegment:
+			segments[i] = "*"
+		default:
+			for _, c := range []string{`\`, "*", "?", "[", "]"} {
+				segment = strings.Replace(segment, c, `\`+c, -1)
+			}
+			segments[i] = segment
+		}
+	}
+	channel := strings.Join(segments, "/")
+	if multi && last > 0 {
+		// Multi segment wildcard also matches no segment.
+		channel = strings.Join(segments[:last], "/") + "*"
+	}
+	return b.prefix + ":" + channel
+}
+
+// receive queues the values received by the subscription for the
+// delivery to the local router. If the subscription ends without
+// being stopped the channels are subscribed again.
+func (b *redisBackend) receive(subscription *redis.Subscription) {
+	for sv := range subscription.Values() {
+		if sv == nil {
+			continue
+		}
+		topic := strings.TrimPrefix(sv.Channel, b.prefix+":")
+		key := sv.Channel
+		if sv.ChannelPattern != "*" {
+			key = sv.ChannelPattern
+		}
+		if !b.isFirstMatch(key, topic) {
+			continue
+		}
+		event, err := unmarshalEvent(topic, sv.Value.Bytes())
+		if err != nil {
+			applog.Errorf("cannot unmarshal event with topic %q: %v", topic, err)
+			continue
+		}
+		b.deliveries.push(&boxMessage{msgEvent, event, ""})
+	}
+	b.resubscribe(subscription)
+}
+
+// deliver pushes the received events to the local router
+// until the backend stops.
+func (b *redisBackend) deliver() {
+	defer close(b.delivered)
+	for {
+		message := b.deliveries.pop()
+		if message.kind == msgStop {
+			return
+		}
+		if err := b.router.push(message.event); err != nil && !IsNoSubscriberError(err) {
+			applog.Errorf("cannot deliver event with topic %q: %v", message.event.Topic(), err)
+		}
+	}
+}
+
+// resubscribe replaces the ended subscription by a new one for
+// all subscribed channels. Failing attempts are retried until
+// it succeeds or the backend stops.
+func (b *redisBackend) resubscribe(ended *redis.Subscription) {
+	b.subscribing.Lock()
+	defer b.subscribing.Unlock()
+	b.mutex.Lock()
+	if b.stopped || b.subscription != ended {
+		// Stopped or already replaced.
+		b.mutex.Unlock()
+		return
+	}
+	b.subscription = nil
+	b.mutex.Unlock()
+	applog.Errorf("redis subscription has ended: %v", ended.Err())
+	ended.Stop()
+	for {
+		b.mutex.Lock()
+		channels := []string{}
+		for channel := range b.channels {
+			channels = append(channels, channel)
+		}
+		stopped := b.stopped
+		b.mutex.Unlock()
+		if stopped || len(channels) == 0 {
+			return
+		}
+		subscription, err := b.subscribeChannels(channels)
+		if err == nil {
+			b.mutex.Lock()
+			b.subscription = subscription
+			b.mutex.Unlock()
+			go b.receive(subscription)
+			return
+		}
+		applog.Errorf("cannot resubscribe redis channels: %v", err)
+		b.subscribing.Unlock()
+		time.Sleep(resubscribeDelay)
+		b.subscribing.Lock()
+	}
+}
+
+// subscribeChannels starts a new subscription for the channels.
+// They are subscribed one by one, because Redis handles channels
+// and patterns with different commands.
+func (b *redisBackend) subscribeChannels(channels []string) (*redis.Subscription, error) {
+	subscription, err := b.database.Subscribe(channels[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, channel := range channels[1:] {
+		subscription.Subscribe(channel)
+	}
+	if subscription.ChannelCount() < len(channels) {
+		subscription.Stop()
+		return nil, &ChannelSubscriptionError{strings.Join(channels, " ")}
+	}
+	return subscription, nil
+}
+
+// isFirstMatch checks if the channel key the value has been received
+// for is the first one of the node matching the topic. Redis delivers
+// a published value once per matching channel and pattern, but the
+// local router already delivers it to all matching agents.
+func (b *redisBackend) isFirstMatch(key, topic string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	first := ""
+	for channel, pattern := range b.channels {
+		if matchTopic(pattern, topic) && (first == "" || channel < first) {
+			first = channel
+		}
+	}
+	return first == key
+}
+
+// Agents returns the ids of all registered agents.
+func (b *redisBackend) Agents() []string {
+	return b.router.agents()
+}
+
+// AgentInfo returns the state of the agent with the id.
+func (b *redisBackend) AgentInfo(id string) (*AgentState, error) {
+	return b.router.agentInfo(id)
+}
+
+// Topics returns all subscribed topics and topic patterns.
+func (b *redisBackend) Topics() []string {
+	return b.router.subscribedTopics()
+}
+
+// EOF
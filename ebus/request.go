@@ -0,0 +1,166 @@
+// Tideland Common Go Library - Event Bus - Request and Reply
+//
+// Copyright (C) 2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package ebus
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"github.com/denkhaus/tcgl/applog"
+	"time"
+)
+
+//--------------------
+// FUNCTIONS
+//--------------------
+
+// Request emits a new event with the given payload and the topic
+// created out of the stem and the parts. The subscribers can answer
+// it using Reply. The replies are caused by the request and so
+// carry its correlation id. The first reply is returned, if none is received
+// in time a RequestTimeoutError is returned. Unlike with Emit a request
+// without subscribers returns a NoSubscriberError immediately.
+func Request(payload interface{}, timeout time.Duration, stem string, parts ...interface{}) (Event, error) {
+	agent, err := emitRequest(1, payload, stem, parts...)
+	if err != nil {
+		return nil, err
+	}
+	defer agent.close()
+	select {
+	case reply := <-agent.replies:
+		return reply, nil
+	case <-time.After(timeout):
+		return nil, &RequestTimeoutError{Id(stem, parts...), timeout}
+	}
+}
+
+// Gather emits a new event like Request but collects all replies
+// until the timeout.
+func Gather(payload interface{}, timeout time.Duration, stem string, parts ...interface{}) ([]Event, error) {
+	agent, err := emitRequest(16, payload, stem, parts...)
+	if err != nil {
+		return nil, err
+	}
+	defer agent.close()
+	replies := []Event{}
+	deadline := time.After(timeout)
+	for {
+		select {
+		case reply := <-agent.replies:
+			replies = append(replies, reply)
+		case <-deadline:
+			return replies, nil
+		}
+	}
+}
+
+// Reply emits the payload as reply to the request event. The reply
+// is caused by the request like with EmitCaused and encoded with the
+// codec of the request. A requester which stopped waiting is no error,
+// the reply is dropped instead of being passed to the dead letters.
+func Reply(request Event, payload interface{}) error {
+	if eventBus == nil {
+		panic("event bus is not initialized")
+	}
+	if request.ReplyTo() == "" {
+		return &NoReplyTopicError{request.Topic()}
+	}
+	event, err := newCausedEvent(request, request.Codec(), payload, request.ReplyTo())
+	if err != nil {
+		return err
+	}
+	if err := writeJournal(event); err != nil {
+		return err
+	}
+	err = eventBus.Emit(event)
+	if IsNoSubscriberError(err) {
+		applog.Debugf("dropping reply to request %q, the requester stopped waiting", request.Id())
+		return nil
+	}
+	return err
+}
+
+// emitRequest registers a reply agent for a new correlation id
+// and emits the request.
+func emitRequest(capacity int, payload interface{}, stem string, parts ...interface{}) (*replyAgent, error) {
+	if eventBus == nil {
+		panic("event bus is not initialized")
+	}
+	event, err := newSimpleEvent(payload, Id(stem, parts...))
+	if err != nil {
+		return nil, err
+	}
+	event.replyTo = Id("ebus", "reply", event.id)
+	agent := newReplyAgent(event.replyTo, capacity)
+	if _, err := eventBus.Register(agent); err != nil {
+		return nil, err
+	}
+	if err := eventBus.Subscribe(agent, event.replyTo); err != nil {
+		agent.close()
+		return nil, err
+	}
+	if err := emit(event); err != nil {
+		agent.close()
+		return nil, err
+	}
+	return agent, nil
+}
+
+//--------------------
+// REPLY AGENT
+//--------------------
+
+// replyAgent receives the replies to one request.
+type replyAgent struct {
+	id      string
+	replies chan Event
+	done    chan bool
+}
+
+// newReplyAgent creates a new reply agent.
+func newReplyAgent(id string, capacity int) *replyAgent {
+	return &replyAgent{id, make(chan Event, capacity), make(chan bool)}
+}
+
+// Id returns the unique identifier of the agent.
+func (a *replyAgent) Id() string {
+	return a.id
+}
+
+// Process passes the reply to the waiting requester as long
+// as it is waiting.
+func (a *replyAgent) Process(event Event) error {
+	select {
+	case a.replies <- event:
+	case <-a.done:
+	}
+	return nil
+}
+
+// Recover from an error during the processing of an event.
+func (a *replyAgent) Recover(r interface{}, event Event) error {
+	return nil
+}
+
+// Stop tells the agent to cleanup.
+func (a *replyAgent) Stop() {}
+
+// Err returns the error the agent possibly stopped with.
+func (a *replyAgent) Err() error {
+	return nil
+}
+
+// close releases a possibly blocked processing and removes
+// the agent from the event bus.
+func (a *replyAgent) close() {
+	close(a.done)
+	eventBus.Deregister(a)
+}
+
+// EOF
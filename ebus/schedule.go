@@ -0,0 +1,189 @@
+// Tideland Common Go Library - Event Bus - Schedule
+//
+// Copyright (C) 2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package ebus
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"github.com/denkhaus/tcgl/applog"
+	ctime "github.com/denkhaus/tcgl/time"
+	"sync"
+	"time"
+)
+
+//--------------------
+// FUNCTIONS
+//--------------------
+
+// EmitAfter emits a new event with the given payload and the topic
+// created out of the stem and the parts after the delay. The payload
+// is encoded at once, so later changes are not emitted. The returned
+// schedule can be used to cancel the emission.
+func EmitAfter(delay time.Duration, payload interface{}, stem string, parts ...interface{}) (*Schedule, error) {
+	if eventBus == nil {
+		panic("event bus is not initialized")
+	}
+	scheduled, err := newSimpleEvent(payload, Id(stem, parts...))
+	if err != nil {
+		return nil, err
+	}
+	return startSchedule(func(s *Schedule) {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			if s.fire(true) {
+				emitScheduled(scheduled)
+			}
+		case <-s.stopChan:
+		}
+	}), nil
+}
+
+// EmitAt emits a new event like EmitAfter but at the given time. A
+// time in the past leads to an immediate emission.
+func EmitAt(at time.Time, payload interface{}, stem string, parts ...interface{}) (*Schedule, error) {
+	return EmitAfter(at.Sub(time.Now()), payload, stem, parts...)
+}
+
+// EmitScheduled emits a new event with the given payload and the topic
+// created out of the stem and the parts each time the check function
+// returns true. It's called once a second with the current UTC time
+// like the check functions of a crontab. If it also returns true as
+// second value the schedule ends after the emission.
+func EmitScheduled(check ctime.CheckFunc, payload interface{}, stem string, parts ...interface{}) (*Schedule, error) {
+	if eventBus == nil {
+		panic("event bus is not initialized")
+	}
+	scheduled, err := newSimpleEvent(payload, Id(stem, parts...))
+	if err != nil {
+		return nil, err
+	}
+	return startSchedule(func(s *Schedule) {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				perform, last := check(now.UTC())
+				if !perform {
+					continue
+				}
+				if !s.fire(last) {
+					return
+				}
+				emitScheduled(scheduled)
+				if last {
+					return
+				}
+			case <-s.stopChan:
+				return
+			}
+		}
+	}), nil
+}
+
+// emitScheduled emits a new event with the payload of the scheduled
+// one, which has been encoded when the schedule started.
+func emitScheduled(scheduled *simpeEvent) {
+	event := newPayloadEvent(scheduled.payload, scheduled.codec, scheduled.topic)
+	if err := emit(event); err != nil && !IsNoSubscriberError(err) {
+		applog.Errorf("cannot emit scheduled event with topic %q: %v", event.topic, err)
+	}
+}
+
+//--------------------
+// SCHEDULE
+//--------------------
+
+// schedules stores all active schedules.
+var schedules = struct {
+	mutex     sync.Mutex
+	schedules map[*Schedule]bool
+}{
+	schedules: make(map[*Schedule]bool),
+}
+
+// stopSchedules cancels all active schedules.
+func stopSchedules() {
+	schedules.mutex.Lock()
+	active := []*Schedule{}
+	for s := range schedules.schedules {
+		active = append(active, s)
+	}
+	schedules.mutex.Unlock()
+	for _, s := range active {
+		s.Cancel()
+	}
+}
+
+// Schedule is the handle of a delayed or scheduled emission.
+type Schedule struct {
+	mutex    sync.Mutex
+	done     bool
+	stopChan chan bool
+}
+
+// startSchedule starts the backend function of a new schedule
+// in the background.
+func startSchedule(backend func(s *Schedule)) *Schedule {
+	s := &Schedule{stopChan: make(chan bool)}
+	schedules.mutex.Lock()
+	schedules.schedules[s] = true
+	schedules.mutex.Unlock()
+	go backend(s)
+	return s
+}
+
+// Cancel stops the schedule. It returns false if the schedule
+// already ended or has been cancelled before.
+func (s *Schedule) Cancel() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.done {
+		return false
+	}
+	s.end()
+	close(s.stopChan)
+	return true
+}
+
+// Active returns true as long as the schedule hasn't
+// ended or been cancelled.
+func (s *Schedule) Active() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return !s.done
+}
+
+// fire checks if the schedule is still active before an emission.
+// If it's the last one the schedule ends.
+func (s *Schedule) fire(last bool) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.done {
+		return false
+	}
+	if last {
+		s.end()
+	}
+	return true
+}
+
+// end marks the schedule as done and removes it from the
+// active schedules.
+func (s *Schedule) end() {
+	s.done = true
+	schedules.mutex.Lock()
+	delete(schedules.schedules, s)
+	schedules.mutex.Unlock()
+}
+
+// EOF
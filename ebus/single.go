@@ -24,14 +24,14 @@ type singleNodeBackend struct {
 	router *nodeRouter
 }
 
-func newSingleNodeBackend() backend {
+func newSingleNodeBackend() Backend {
 	return &singleNodeBackend{newNodeRouter()}
 }
 
 // Init initializes the single event bus with the given configuration. If this
 // isn't done all further operation will fail.
 func (b *singleNodeBackend) Init(config *config.Configuration) error {
-	return nil
+	return b.router.configure(config)
 }
 
 // Stop shuts the event bus down.
@@ -69,8 +69,22 @@ func (b *singleNodeBackend) Unsubscribe(agent Agent, topic string) error {
 
 // Emit emits new event to the event bus.
 func (b *singleNodeBackend) Emit(event Event) error {
-	b.router.push(event)
-	return nil
+	return b.router.push(event)
+}
+
+// Agents returns the ids of all registered agents.
+func (b *singleNodeBackend) Agents() []string {
+	return b.router.agents()
+}
+
+// AgentInfo returns the state of the agent with the id.
+func (b *singleNodeBackend) AgentInfo(id string) (*AgentState, error) {
+	return b.router.agentInfo(id)
+}
+
+// Topics returns all subscribed topics and topic patterns.
+func (b *singleNodeBackend) Topics() []string {
+	return b.router.subscribedTopics()
 }
 
 // EOF
@@ -0,0 +1,272 @@
+// Tideland Common Go Library - Event Bus - Supervision
+//
+// Copyright (C) 2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package ebus
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"github.com/denkhaus/tcgl/supervisor"
+	"sync"
+)
+
+//--------------------
+// FUNCTIONS
+//--------------------
+
+// AgentFactory is a function that creates a new agent instance.
+type AgentFactory func() Agent
+
+// RegisterSupervised registers an agent created by the factory as
+// child of the supervisor. If the agent isn't recoverable after an
+// error a new one is created by the factory, registered and subscribed
+// to the topics of the crashed one. The restart frequency is checked by
+// the supervisor. If it's exceeded the supervisor and its children stop
+// and the supervisors Err() returns a supervisor.TooMuchRestartsError.
+// The returned handle always refers to the current instance.
+func RegisterSupervised(sup *supervisor.Supervisor, factory AgentFactory) (*SupervisedAgent, error) {
+	if eventBus == nil {
+		panic("event bus is not initialized")
+	}
+	next := newSupervisedAgent(factory())
+	handle := &SupervisedAgent{id: next.Id(), current: next}
+	id := handle.id
+	started := make(chan error, 1)
+	var predecessor *supervisedAgent
+	sfunc := func(h *supervisor.Handle) error {
+		agent := next
+		if agent == nil {
+			agent = newSupervisedAgent(factory())
+			handle.set(agent)
+		}
+		next = nil
+		registered, err := agent.register(h, predecessor)
+		if err != nil {
+			select {
+			case started <- err:
+				// Initial start failed, so no restarts.
+				return nil
+			default:
+			}
+			return err
+		}
+		if !registered {
+			// Terminated while waiting for the predecessor.
+			return nil
+		}
+		predecessor = agent
+		select {
+		case started <- nil:
+		default:
+		}
+		select {
+		case <-agent.stopped:
+			if agent.err == nil {
+				supervisions.remove(id)
+			}
+			return agent.err
+		case <-h.Terminate():
+			Deregister(agent)
+			return nil
+		}
+	}
+	supervisions.add(id)
+	if err := sup.Go(id, sfunc); err != nil {
+		supervisions.remove(id)
+		return nil, err
+	}
+	if err := <-started; err != nil {
+		sup.Terminate(id)
+		supervisions.remove(id)
+		return nil, err
+	}
+	return handle, nil
+}
+
+//--------------------
+// SUPERVISED AGENT
+//--------------------
+
+// SupervisedAgent is the handle of an agent registered with
+// RegisterSupervised. It implements Agent by passing all calls
+// to the current instance, so it stays valid after restarts.
+type SupervisedAgent struct {
+	mutex   sync.RWMutex
+	id      string
+	current *supervisedAgent
+}
+
+// Current returns the currently running instance.
+func (a *SupervisedAgent) Current() Agent {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.current.Agent
+}
+
+// Id returns the unique identifier of the agent.
+func (a *SupervisedAgent) Id() string {
+	return a.id
+}
+
+// Process lets the current instance process an event.
+func (a *SupervisedAgent) Process(event Event) error {
+	return a.Current().Process(event)
+}
+
+// Recover lets the current instance recover from an error.
+func (a *SupervisedAgent) Recover(r interface{}, event Event) error {
+	return a.Current().Recover(r, event)
+}
+
+// Stop tells the current instance to cleanup.
+func (a *SupervisedAgent) Stop() {
+	a.Current().Stop()
+}
+
+// Err returns the error the current instance possibly stopped with.
+func (a *SupervisedAgent) Err() error {
+	return a.Current().Err()
+}
+
+// set sets the current instance after a restart.
+func (a *SupervisedAgent) set(current *supervisedAgent) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.current = current
+}
+
+// supervisedAgent wraps an agent to notice when it
+// stops because it isn't recoverable.
+type supervisedAgent struct {
+	Agent
+	stopped chan bool
+	err     error
+}
+
+// newSupervisedAgent wraps the agent.
+func newSupervisedAgent(agent Agent) *supervisedAgent {
+	return &supervisedAgent{agent, make(chan bool), nil}
+}
+
+// inboxConfig returns the inbox configuration of the wrapped
+// agent if it's a BoundedAgent, otherwise the passed defaults.
+func (s *supervisedAgent) inboxConfig(capacity int, policy InboxPolicy) (int, InboxPolicy) {
+	if ba, ok := s.Agent.(BoundedAgent); ok {
+		return ba.InboxConfig()
+	}
+	return capacity, policy
+}
+
+// Recover from an error during the processing of an event. An
+// error returned by the wrapped agent is kept for the restart.
+func (s *supervisedAgent) Recover(r interface{}, event Event) error {
+	err := s.Agent.Recover(r, event)
+	if err != nil {
+		s.err = err
+	}
+	return err
+}
+
+// Stop tells the agent to cleanup.
+func (s *supervisedAgent) Stop() {
+	s.Agent.Stop()
+	close(s.stopped)
+}
+
+// register registers the agent and subscribes it to the topics
+// of its predecessor. The runner of an unrecoverable predecessor
+// deregisters it before stopping it, so the agent waits until the
+// predecessor has stopped. It returns false if the supervisor
+// terminated while waiting.
+func (s *supervisedAgent) register(h *supervisor.Handle, predecessor *supervisedAgent) (bool, error) {
+	if predecessor != nil {
+		select {
+		case <-predecessor.stopped:
+		case <-h.Terminate():
+			return false, nil
+		}
+	}
+	if _, err := Register(s); err != nil {
+		return false, err
+	}
+	for _, topic := range supervisions.topics(s.Id()) {
+		if err := eventBus.Subscribe(s, topic); err != nil {
+			Deregister(s)
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+//--------------------
+// SUPERVISIONS
+//--------------------
+
+// supervision stores the topics of a supervised agent.
+type supervision struct {
+	topics map[string]bool
+}
+
+// supervisions stores the supervisions by agent id.
+var supervisions = &supervisionMap{
+	supervisions: make(map[string]*supervision),
+}
+
+// supervisionMap manages the supervisions.
+type supervisionMap struct {
+	mutex        sync.Mutex
+	supervisions map[string]*supervision
+}
+
+// add adds a supervision for the agent id.
+func (m *supervisionMap) add(id string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.supervisions[id] = &supervision{make(map[string]bool)}
+}
+
+// remove removes the supervision for the agent id.
+func (m *supervisionMap) remove(id string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.supervisions, id)
+}
+
+// subscribe stores the topic if the agent is supervised.
+func (m *supervisionMap) subscribe(id, topic string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if s, ok := m.supervisions[id]; ok {
+		s.topics[topic] = true
+	}
+}
+
+// unsubscribe removes the topic if the agent is supervised.
+func (m *supervisionMap) unsubscribe(id, topic string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if s, ok := m.supervisions[id]; ok {
+		delete(s.topics, topic)
+	}
+}
+
+// topics returns the topics of the supervised agent.
+func (m *supervisionMap) topics(id string) []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	topics := []string{}
+	if s, ok := m.supervisions[id]; ok {
+		for topic := range s.topics {
+			topics = append(topics, topic)
+		}
+	}
+	return topics
+}
+
+// EOF
@@ -12,13 +12,17 @@ package ebus
 //--------------------
 
 import (
-	"bytes"
 	"github.com/denkhaus/tcgl/applog"
+	"github.com/denkhaus/tcgl/config"
+	"github.com/denkhaus/tcgl/identifier"
 	"github.com/denkhaus/tcgl/monitoring"
-	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 //--------------------
@@ -46,27 +50,92 @@ func Id(stem string, parts ...interface{}) string {
 
 // simpleEvent implements the Event interface.
 type simpeEvent struct {
-	payload []byte
-	topic   string
+	payload       []byte
+	codec         string
+	topic         string
+	id            string
+	timestamp     time.Time
+	emitterId     string
+	causationId   string
+	correlationId string
+	replyTo       string
+	headers       map[string]string
+	receiverId    string
 }
 
-// newSimpleEvent creates a new event instance.
-func newSimpleEvent(payload interface{}, topic string) (Event, error) {
-	buf := new(bytes.Buffer)
-	enc := gob.NewEncoder(buf)
-	err := enc.Encode(payload)
+// newSimpleEvent creates a new event instance with the payload
+// encoded by the codec of the topic. It starts a new flow, so
+// its correlation id is its own id.
+func newSimpleEvent(payload interface{}, topic string) (*simpeEvent, error) {
+	return newEncodedEvent("", payload, topic)
+}
+
+// newEncodedEvent creates a new event instance like newSimpleEvent
+// but with the payload encoded by the named codec. An empty name
+// chooses the codec of the topic.
+func newEncodedEvent(codecName string, payload interface{}, topic string) (*simpeEvent, error) {
+	codec, err := lookupCodec(codecName, topic)
+	if err != nil {
+		return nil, err
+	}
+	payloadBytes, err := codec.Encode(payload)
 	if err != nil {
 		return nil, err
 	}
-	payloadBytes := buf.Bytes()
-	return &simpeEvent{payloadBytes, topic}, nil
+	return newPayloadEvent(payloadBytes, codec.Name(), topic), nil
+}
+
+// newPayloadEvent creates a new event instance with the payload
+// already encoded by the named codec.
+func newPayloadEvent(payload []byte, codecName, topic string) *simpeEvent {
+	id := identifier.NewUUID().String()
+	return &simpeEvent{
+		payload:       payload,
+		codec:         codecName,
+		topic:         topic,
+		id:            id,
+		timestamp:     time.Now(),
+		correlationId: id,
+		headers:       make(map[string]string),
+	}
 }
 
-// Payload returns the payload of the event.
+// newCausedEvent creates a new event caused by another one. It
+// continues the flow of the cause and inherits its headers. If
+// the cause has been received by an agent it's the emitter.
+func newCausedEvent(cause Event, codecName string, payload interface{}, topic string) (*simpeEvent, error) {
+	event, err := newEncodedEvent(codecName, payload, topic)
+	if err != nil || cause == nil {
+		return event, err
+	}
+	event.causationId = cause.Id()
+	event.correlationId = cause.CorrelationId()
+	for key, value := range cause.Headers() {
+		event.headers[key] = value
+	}
+	if se, ok := cause.(*simpeEvent); ok {
+		event.emitterId = se.receiverId
+	}
+	return event, nil
+}
+
+// Payload returns the payload of the event decoded by the
+// codec it has been encoded with.
 func (e *simpeEvent) Payload(value interface{}) error {
-	buf := bytes.NewBuffer(e.payload)
-	dec := gob.NewDecoder(buf)
-	return dec.Decode(value)
+	name := e.codec
+	if name == "" {
+		name = GobCodecName
+	}
+	codec, err := lookupCodec(name, e.topic)
+	if err != nil {
+		return err
+	}
+	return codec.Decode(e.payload, value)
+}
+
+// Codec returns the name of the payload codec.
+func (e *simpeEvent) Codec() string {
+	return e.codec
 }
 
 // Topic returns the topic of the event.
@@ -74,12 +143,134 @@ func (e *simpeEvent) Topic() string {
 	return e.topic
 }
 
+// Id returns the unique identifier of the event.
+func (e *simpeEvent) Id() string {
+	return e.id
+}
+
+// Timestamp returns the creation time of the event.
+func (e *simpeEvent) Timestamp() time.Time {
+	return e.timestamp
+}
+
+// EmitterId returns the id of the emitting agent.
+func (e *simpeEvent) EmitterId() string {
+	return e.emitterId
+}
+
+// CausationId returns the id of the causing event.
+func (e *simpeEvent) CausationId() string {
+	return e.causationId
+}
+
+// CorrelationId returns the id correlating the events of a flow.
+func (e *simpeEvent) CorrelationId() string {
+	return e.correlationId
+}
+
+// ReplyTo returns the topic for replies to a request.
+func (e *simpeEvent) ReplyTo() string {
+	return e.replyTo
+}
+
+// Header returns the value of the header with the key.
+func (e *simpeEvent) Header(key string) string {
+	return e.headers[key]
+}
+
+// Headers returns a copy of all headers.
+func (e *simpeEvent) Headers() map[string]string {
+	headers := make(map[string]string, len(e.headers))
+	for key, value := range e.headers {
+		headers[key] = value
+	}
+	return headers
+}
+
+// receivedBy returns a copy of the event marked as received
+// by the agent with the given id.
+func (e *simpeEvent) receivedBy(id string) *simpeEvent {
+	received := *e
+	received.receiverId = id
+	return &received
+}
+
+// eventEnvelope is the serializable form of an event used to
+// transport it between nodes and to journal it. It's encoded as
+// JSON, so that consumers not written in Go can read it too. JSON
+// payloads are embedded as they are, all others are passed as data.
+// The topic is not part of the envelope, it's transported by the
+// backend.
+type eventEnvelope struct {
+	Payload       json.RawMessage   `json:"payload,omitempty"`
+	Data          []byte            `json:"data,omitempty"`
+	Codec         string            `json:"codec"`
+	Id            string            `json:"id"`
+	Timestamp     time.Time         `json:"timestamp"`
+	EmitterId     string            `json:"emitterId,omitempty"`
+	CausationId   string            `json:"causationId,omitempty"`
+	CorrelationId string            `json:"correlationId,omitempty"`
+	ReplyTo       string            `json:"replyTo,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+}
+
+// marshal serializes the event into an envelope.
+func (e *simpeEvent) marshal() ([]byte, error) {
+	envelope := eventEnvelope{
+		Codec:         e.codec,
+		Id:            e.id,
+		Timestamp:     e.timestamp,
+		EmitterId:     e.emitterId,
+		CausationId:   e.causationId,
+		CorrelationId: e.correlationId,
+		ReplyTo:       e.replyTo,
+		Headers:       e.headers,
+	}
+	if e.codec == JSONCodecName {
+		envelope.Payload = e.payload
+	} else {
+		envelope.Data = e.payload
+	}
+	return json.Marshal(&envelope)
+}
+
+// unmarshalEvent creates an event with the given topic out of
+// a serialized envelope.
+func unmarshalEvent(topic string, data []byte) (*simpeEvent, error) {
+	var envelope eventEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+	if envelope.Headers == nil {
+		envelope.Headers = make(map[string]string)
+	}
+	payload := envelope.Data
+	if envelope.Codec == JSONCodecName {
+		payload = envelope.Payload
+	}
+	return &simpeEvent{
+		payload:       payload,
+		codec:         envelope.Codec,
+		topic:         topic,
+		id:            envelope.Id,
+		timestamp:     envelope.Timestamp,
+		emitterId:     envelope.EmitterId,
+		causationId:   envelope.CausationId,
+		correlationId: envelope.CorrelationId,
+		replyTo:       envelope.ReplyTo,
+		headers:       envelope.Headers,
+	}, nil
+}
+
 //--------------------
 // AGENT BOX
 //--------------------
 
 type boxMsgKind int
 
+// errBoxClosed is returned when pushing into a closed box.
+var errBoxClosed = errors.New("box is closed")
+
 const (
 	msgEvent boxMsgKind = iota
 	msgSubscribe
@@ -101,35 +292,97 @@ type boxEntry struct {
 	next    *boxEntry
 }
 
-// box is an inbox for agent control messages.
+// defaultInboxTimeout is the time an emitter waits for space
+// in a full inbox with the policy InboxBlock.
+const defaultInboxTimeout = 5 * time.Second
+
+// box is an inbox for agent control messages. If it has a
+// capacity it's only limiting event messages, control messages
+// are always accepted.
 type box struct {
-	cond  *sync.Cond
-	first *boxEntry
-	last  *boxEntry
+	cond     *sync.Cond
+	first    *boxEntry
+	last     *boxEntry
+	capacity int
+	policy   InboxPolicy
+	timeout  time.Duration
+	events   int
+	closed   bool
 }
 
-// newBox creates a new inbox.
+// newBox creates a new unbounded inbox.
 func newBox() *box {
+	return newBoundedBox(0, InboxBlock)
+}
+
+// newBoundedBox creates a new inbox for the given number of events
+// handling overflows based on the policy. A capacity of zero or less
+// means unbounded.
+func newBoundedBox(capacity int, policy InboxPolicy) *box {
 	var locker sync.Mutex
-	return &box{sync.NewCond(&locker), nil, nil}
+	return &box{
+		cond:     sync.NewCond(&locker),
+		capacity: capacity,
+		policy:   policy,
+		timeout:  defaultInboxTimeout,
+	}
 }
 
-// push appends a new message to the box.
-func (b *box) push(message *boxMessage) {
+// push appends a new message to the box. It returns true if the
+// message or an older one has been dropped due to the policy. With
+// InboxBlock the push waits at most for the timeout of the box, so
+// agents pushing into their own or each others full inboxes can't
+// deadlock.
+func (b *box) push(message *boxMessage) (dropped bool, err error) {
 	b.cond.L.Lock()
 	defer b.cond.L.Unlock()
-	switch {
-	case b.first == nil:
-		b.first = &boxEntry{message, nil}
-		b.last = nil
-	case b.last == nil:
-		b.last = &boxEntry{message, nil}
-		b.first.next = b.last
-	default:
-		b.last.next = &boxEntry{message, nil}
-		b.last = b.last.next
+	if message.kind == msgEvent && b.capacity > 0 {
+		var deadline time.Time
+		for !b.closed && b.events >= b.capacity {
+			switch b.policy {
+			case InboxDropOldest:
+				b.removeFirstEvent()
+				dropped = true
+			case InboxDropNewest:
+				return true, nil
+			case InboxFail:
+				return true, &InboxFullError{Capacity: b.capacity}
+			default:
+				if deadline.IsZero() {
+					deadline = time.Now().Add(b.timeout)
+					timer := time.AfterFunc(b.timeout, b.wakeup)
+					defer timer.Stop()
+				}
+				if !time.Now().Before(deadline) {
+					return true, &InboxFullError{Capacity: b.capacity}
+				}
+				b.cond.Wait()
+			}
+		}
+	}
+	if b.closed {
+		return true, errBoxClosed
+	}
+	entry := &boxEntry{message, nil}
+	if b.last == nil {
+		b.first = entry
+	} else {
+		b.last.next = entry
 	}
-	b.cond.Signal()
+	b.last = entry
+	if message.kind == msgEvent {
+		b.events++
+	}
+	b.cond.Broadcast()
+	return dropped, nil
+}
+
+// wakeup wakes up all waiting pushes and pops so
+// that they can check their conditions again.
+func (b *box) wakeup() {
+	b.cond.L.Lock()
+	defer b.cond.L.Unlock()
+	b.cond.Broadcast()
 }
 
 // pop retrieves the first message out of the box. If it's 
@@ -137,30 +390,101 @@ func (b *box) push(message *boxMessage) {
 func (b *box) pop() (message *boxMessage) {
 	b.cond.L.Lock()
 	defer b.cond.L.Unlock()
-	for {
-		if b.first == nil {
-			b.cond.Wait()
+	for b.first == nil {
+		b.cond.Wait()
+	}
+	message = b.first.message
+	b.first = b.first.next
+	if b.first == nil {
+		b.last = nil
+	}
+	if message.kind == msgEvent {
+		b.events--
+		b.cond.Broadcast()
+	}
+	return
+}
+
+// removeFirstEvent removes the oldest event message. The
+// lock has to be held by the caller.
+func (b *box) removeFirstEvent() {
+	var prev *boxEntry
+	for current := b.first; current != nil; prev, current = current, current.next {
+		if current.message.kind != msgEvent {
+			continue
+		}
+		if prev == nil {
+			b.first = current.next
 		} else {
-			message = b.first.message
-			b.first = b.first.next
-			break
+			prev.next = current.next
 		}
+		if b.last == current {
+			b.last = prev
+		}
+		b.events--
+		return
 	}
-	return
+}
+
+// limit sets the capacity of the box, the policy for overflows
+// and the timeout of blocked pushes.
+func (b *box) limit(capacity int, policy InboxPolicy, timeout time.Duration) {
+	b.cond.L.Lock()
+	defer b.cond.L.Unlock()
+	b.capacity = capacity
+	b.policy = policy
+	b.timeout = timeout
+	b.cond.Broadcast()
+}
+
+// drain removes all messages from the box and returns the
+// events of the event messages.
+func (b *box) drain() []Event {
+	b.cond.L.Lock()
+	defer b.cond.L.Unlock()
+	events := []Event{}
+	for current := b.first; current != nil; current = current.next {
+		if current.message.kind == msgEvent {
+			events = append(events, current.message.event)
+		}
+	}
+	b.first = nil
+	b.last = nil
+	b.events = 0
+	b.cond.Broadcast()
+	return events
+}
+
+// close tells the box that no more messages will be popped. Blocked
+// and later pushes return errBoxClosed without appending their messages.
+func (b *box) close() {
+	b.cond.L.Lock()
+	defer b.cond.L.Unlock()
+	b.closed = true
+	b.cond.Broadcast()
+}
+
+// limited returns the capacity of the box.
+func (b *box) limited() int {
+	b.cond.L.Lock()
+	defer b.cond.L.Unlock()
+	return b.capacity
+}
+
+// queued returns the number of event messages in the box.
+func (b *box) queued() int {
+	b.cond.L.Lock()
+	defer b.cond.L.Unlock()
+	return b.events
 }
 
 // len returns the number of messages in the box.
 func (b *box) len() int {
 	b.cond.L.Lock()
 	defer b.cond.L.Unlock()
-	if b.first == nil {
-		return 0
-	}
-	ctr := 1
-	current := b.first
-	for current.next != nil {
+	ctr := 0
+	for current := b.first; current != nil; current = current.next {
 		ctr++
-		current = current.next
 	}
 	return ctr
 }
@@ -173,26 +497,77 @@ func (b *box) len() int {
 type agentRunner struct {
 	agent       Agent
 	measuringId string
+	droppedId   string
+	processedId string
+	failedId    string
+	inboxId     string
 	inbox       *box
 	topics      map[string]bool
+	mutex       sync.Mutex
+	processed   int64
+	failed      int64
+	dropped     int64
+	lastError   error
+	duration    time.Duration
+	delegated   bool
 }
 
-// newAgentRunner creates a new agent runner
+// newAgentRunner creates a new agent runner with an unbounded inbox
+// if the agent doesn't configure it on its own.
 func newAgentRunner(agent Agent) *agentRunner {
+	return newBoundedAgentRunner(agent, 0, InboxBlock, defaultInboxTimeout)
+}
+
+// newBoundedAgentRunner creates a new agent runner with the given
+// inbox configuration if the agent doesn't configure it on its own.
+// The timeout is the time emitters wait for space in a full inbox
+// with the policy InboxBlock.
+func newBoundedAgentRunner(agent Agent, capacity int, policy InboxPolicy, timeout time.Duration) *agentRunner {
+	pool, delegated := agent.(*poolAgent)
+	switch a := agent.(type) {
+	case BoundedAgent:
+		capacity, policy = a.InboxConfig()
+	case *supervisedAgent:
+		capacity, policy = a.inboxConfig(capacity, policy)
+	case *poolAgent:
+		capacity, policy = a.configureInbox(capacity, policy, timeout)
+	}
 	a := &agentRunner{
 		agent:       agent,
 		measuringId: Id("agent", agent.Id()),
-		inbox:       newBox(),
+		droppedId:   Id("agent", agent.Id(), "dropped"),
+		processedId: Id("agent", agent.Id(), "processed"),
+		failedId:    Id("agent", agent.Id(), "failed"),
+		inboxId:     Id("agent", agent.Id(), "inbox"),
+		inbox:       newBoundedBox(capacity, policy),
 		topics:      make(map[string]bool),
+		delegated:   delegated,
 	}
+	a.inbox.limit(capacity, policy, timeout)
+	if delegated {
+		pool.setRecorder(a.record, a.recordDrop)
+	}
+	a.publish()
 	go a.backend()
 	return a
 }
 
-// push appends an event for processing.
-func (a *agentRunner) push(event Event) {
+// push appends an event for processing. Dropped events
+// are counted.
+func (a *agentRunner) push(event Event) error {
 	message := &boxMessage{msgEvent, event, ""}
-	a.inbox.push(message)
+	dropped, err := a.inbox.push(message)
+	if err == errBoxClosed {
+		// The runner is stopping.
+		return nil
+	}
+	if dropped {
+		a.recordDrop()
+	}
+	if err != nil {
+		return &InboxFullError{a.agent.Id(), a.inbox.limited()}
+	}
+	return nil
 }
 
 // subscribe tells the runner to subscribe to a topic.
@@ -213,10 +588,13 @@ func (a *agentRunner) stop() {
 	a.inbox.push(message)
 }
 
-// backend runs the endless processing loop.
+// backend runs the endless processing loop. A stopped runner
+// has already been deregistered, a failed one deregisters its agent
+// on its own. So a new agent registered with the same id isn't
+// removed by the ending runner.
 func (a *agentRunner) backend() {
-	defer Deregister(a.agent)
 	defer a.agent.Stop()
+	defer a.inbox.close()
 	for {
 		message := a.inbox.pop()
 		switch message.kind {
@@ -227,33 +605,266 @@ func (a *agentRunner) backend() {
 		case msgUnsubscribe:
 			delete(a.topics, message.topic)
 		default:
-			if err := a.process(message.event); err != nil {
+			event := message.event
+			if se, ok := event.(*simpeEvent); ok {
+				event = se.receivedBy(a.agent.Id())
+			}
+			if err := a.process(event); err != nil {
 				applog.Errorf("agent %q is not recoverable after error: %v", a.agent.Id(), err)
+				emitDeadLetter(message.event, a.agent.Id(), err)
+				Deregister(a.agent)
 				return
 			}
 		}
 	}
 }
 
-// process processes one event.
-func (a *agentRunner) process(event Event) (err error) {
-	// Error recovering.
+// process processes one event inside a measuring. The processings
+// of a pool are recorded by its workers, only its failures to pass
+// the event to a worker are recorded here.
+func (a *agentRunner) process(event Event) error {
+	measuring := monitoring.BeginMeasuring(a.measuringId)
+	name := fmt.Sprintf("agent %q", a.agent.Id())
+	return processEvent(name, a.agent, event, func(duration time.Duration, failure error) {
+		measuring.EndMeasuring()
+		if !a.delegated || failure != nil {
+			a.record(duration, failure)
+		}
+	})
+}
+
+// processEvent lets the agent process the event. Errors and panics
+// are logged under the name and passed to the Recover method of the
+// agent, its result is returned. The duration and the failure of
+// the processing are passed to record.
+func processEvent(name string, agent Agent, event Event, record func(duration time.Duration, failure error)) (err error) {
+	var failure error
+	start := time.Now()
+	// Error recovering and statistics.
 	defer func() {
 		if r := recover(); r != nil {
-			applog.Errorf("agent %q has panicked: %v", a.agent.Id(), r)
-			err = a.agent.Recover(r, event)
+			applog.Errorf("%s has panicked: %v", name, r)
+			failure = fmt.Errorf("panic: %v", r)
+			err = agent.Recover(r, event)
 		}
+		record(time.Now().Sub(start), failure)
 	}()
-	// Handle the event inside a measuring.
-	measuring := monitoring.BeginMeasuring(a.measuringId)
-	defer measuring.EndMeasuring()
-	if err = a.agent.Process(event); err != nil {
-		applog.Errorf("agent %q has failed: %v", a.agent.Id(), err)
-		return a.agent.Recover(err, event)
+	if failure = agent.Process(event); failure != nil {
+		applog.Errorf("%s has failed: %v", name, failure)
+		return agent.Recover(failure, event)
 	}
 	return nil
 }
 
+// record updates the statistics after the processing of an event.
+func (a *agentRunner) record(duration time.Duration, failure error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.processed++
+	a.duration += duration
+	if failure != nil {
+		a.failed++
+		a.lastError = failure
+	}
+}
+
+// recordDrop counts an event dropped due to the inbox policy.
+func (a *agentRunner) recordDrop() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.dropped++
+}
+
+// publish sets the monitoring variables to the statistics of the
+// runner. It's called by the router when the runner is created, in
+// the interval statisticsInterval and when the runner is stopped. So
+// an agent registered again with the same id doesn't continue the
+// counting of its predecessor.
+func (a *agentRunner) publish() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	monitoring.SetVariable(a.processedId, a.processed)
+	monitoring.SetVariable(a.failedId, a.failed)
+	monitoring.SetVariable(a.droppedId, a.dropped)
+	monitoring.SetVariable(a.inboxId, int64(a.inbox.queued()))
+}
+
+// info returns the state of the runner and its agent.
+func (a *agentRunner) info(topics []string) *AgentState {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	info := &AgentState{
+		Id:          a.agent.Id(),
+		Topics:      topics,
+		InboxLength: a.inbox.queued(),
+		Processed:   a.processed,
+		Failed:      a.failed,
+		LastError:   a.lastError,
+	}
+	if a.processed > 0 {
+		info.AverageDuration = a.duration / time.Duration(a.processed)
+	}
+	return info
+}
+
+//--------------------
+// TOPIC TRIE
+//--------------------
+
+const (
+	// WildcardSegment matches exactly one segment of a topic.
+	WildcardSegment = "*"
+	// WildcardMultiSegment matches any number of trailing segments
+	// of a topic, including none. It has to be the last segment.
+	WildcardMultiSegment = "#"
+)
+
+// topicNode is one node of the topic trie. The runners are
+// those subscribed to the topic ending at this node.
+type topicNode struct {
+	children map[string]*topicNode
+	runners  map[string]*agentRunner
+}
+
+// newTopicNode creates an empty topic node.
+func newTopicNode() *topicNode {
+	return &topicNode{
+		children: make(map[string]*topicNode),
+		runners:  make(map[string]*agentRunner),
+	}
+}
+
+// topicTrie stores subscriptions to topics and topic patterns
+// segment by segment, so matching an event topic only walks
+// along its segments instead of testing every subscription.
+type topicTrie struct {
+	root *topicNode
+}
+
+// newTopicTrie creates an empty topic trie.
+func newTopicTrie() *topicTrie {
+	return &topicTrie{newTopicNode()}
+}
+
+// splitTopic splits a topic into its segments and validates
+// the usage of the multi segment wildcard.
+func splitTopic(topic string) ([]string, error) {
+	segments := strings.Split(topic, "/")
+	for i, segment := range segments {
+		if segment == WildcardMultiSegment && i != len(segments)-1 {
+			return nil, &InvalidTopicPatternError{topic}
+		}
+	}
+	return segments, nil
+}
+
+// add subscribes the runner to the topic or topic pattern.
+func (t *topicTrie) add(topic string, runner *agentRunner) error {
+	segments, err := splitTopic(topic)
+	if err != nil {
+		return err
+	}
+	node := t.root
+	for _, segment := range segments {
+		child := node.children[segment]
+		if child == nil {
+			child = newTopicNode()
+			node.children[segment] = child
+		}
+		node = child
+	}
+	node.runners[runner.agent.Id()] = runner
+	return nil
+}
+
+// remove unsubscribes the agent with the id from the topic or
+// topic pattern. Nodes without runners and children are pruned.
+func (t *topicTrie) remove(topic string, id string) {
+	segments, err := splitTopic(topic)
+	if err != nil {
+		return
+	}
+	t.removeFrom(t.root, segments, id)
+}
+
+// removeFrom recursively removes the agent from the node matching
+// the segments. It returns true if the node can be pruned.
+func (t *topicTrie) removeFrom(node *topicNode, segments []string, id string) bool {
+	if len(segments) == 0 {
+		delete(node.runners, id)
+	} else if child := node.children[segments[0]]; child != nil {
+		if t.removeFrom(child, segments[1:], id) {
+			delete(node.children, segments[0])
+		}
+	}
+	return len(node.runners) == 0 && len(node.children) == 0
+}
+
+// match returns all runners subscribed to a topic or a pattern
+// matching the topic.
+func (t *topicTrie) match(topic string) map[string]*agentRunner {
+	runners := make(map[string]*agentRunner)
+	t.matchNode(t.root, strings.Split(topic, "/"), runners)
+	return runners
+}
+
+// matchNode recursively collects the runners of the node and its
+// children matching the segments.
+func (t *topicTrie) matchNode(node *topicNode, segments []string, runners map[string]*agentRunner) {
+	if multi := node.children[WildcardMultiSegment]; multi != nil {
+		for id, runner := range multi.runners {
+			runners[id] = runner
+		}
+	}
+	if len(segments) == 0 {
+		for id, runner := range node.runners {
+			runners[id] = runner
+		}
+		return
+	}
+	if child := node.children[segments[0]]; child != nil {
+		t.matchNode(child, segments[1:], runners)
+	}
+	if segments[0] != WildcardSegment {
+		if child := node.children[WildcardSegment]; child != nil {
+			t.matchNode(child, segments[1:], runners)
+		}
+	}
+}
+
+// each calls f for each topic or topic pattern with subscribers.
+func (t *topicTrie) each(f func(topic string, runners map[string]*agentRunner)) {
+	t.eachNode(t.root, nil, f)
+}
+
+// eachNode recursively calls f for the node and its children.
+func (t *topicTrie) eachNode(node *topicNode, segments []string, f func(string, map[string]*agentRunner)) {
+	if len(node.runners) > 0 {
+		f(strings.Join(segments, "/"), node.runners)
+	}
+	for segment, child := range node.children {
+		t.eachNode(child, append(segments, segment), f)
+	}
+}
+
+// matchTopic checks if a single topic or topic pattern matches
+// the topic.
+func matchTopic(pattern, topic string) bool {
+	patternSegments := strings.Split(pattern, "/")
+	topicSegments := strings.Split(topic, "/")
+	for i, segment := range patternSegments {
+		switch {
+		case segment == WildcardMultiSegment:
+			return true
+		case i >= len(topicSegments):
+			return false
+		case segment != WildcardSegment && segment != topicSegments[i]:
+			return false
+		}
+	}
+	return len(patternSegments) == len(topicSegments)
+}
+
 //--------------------
 // NODE ROUTER
 //--------------------
@@ -287,7 +898,20 @@ type opUnsubscribe struct {
 
 type opPush struct {
 	event    Event
-	response chan *response
+	response chan *pushResponse
+}
+
+type opAgents struct {
+	response chan []string
+}
+
+type opAgentInfo struct {
+	id       string
+	response chan *infoResponse
+}
+
+type opTopics struct {
+	response chan []string
 }
 
 type opStop struct{}
@@ -297,19 +921,37 @@ type response struct {
 	err   error
 }
 
+type pushResponse struct {
+	runners map[string]*agentRunner
+	err     error
+}
+
+type infoResponse struct {
+	info *AgentState
+	err  error
+}
+
+// statisticsInterval is the interval in which the router publishes
+// the statistics of the agent runners via monitoring.
+const statisticsInterval = time.Second
+
 // nodeRouter manages registrations and subsciptions per node.
 type nodeRouter struct {
 	registry      map[string]*agentRunner
-	topic2Runners map[string]map[string]*agentRunner
+	topics        *topicTrie
+	inboxCapacity int
+	inboxPolicy   InboxPolicy
+	inboxTimeout  time.Duration
 	ops           chan interface{}
 }
 
 // newNodeRouter create a new node router.
 func newNodeRouter() *nodeRouter {
 	n := &nodeRouter{
-		registry:      make(map[string]*agentRunner),
-		topic2Runners: make(map[string]map[string]*agentRunner),
-		ops:           make(chan interface{}),
+		registry:     make(map[string]*agentRunner),
+		topics:       newTopicTrie(),
+		inboxTimeout: defaultInboxTimeout,
+		ops:          make(chan interface{}),
 	}
 	go n.backend()
 	return n
@@ -359,13 +1001,74 @@ func (n *nodeRouter) unsubscribe(agent Agent, topic string) error {
 	return response.err
 }
 
+// configure sets the default inbox capacity and policy for
+// the runners of agents registered afterwards as well as the
+// timeout for blocked emitters. The configuration keys are
+// "inbox-capacity", "inbox-policy" and "inbox-timeout".
+func (n *nodeRouter) configure(config *config.Configuration) error {
+	capacity, err := config.GetIntDefault("inbox-capacity", 0)
+	if err != nil {
+		return err
+	}
+	name, err := config.GetDefault("inbox-policy", "block")
+	if err != nil {
+		return err
+	}
+	policy, err := ParseInboxPolicy(name)
+	if err != nil {
+		return err
+	}
+	timeout, err := config.GetDurationDefault("inbox-timeout", defaultInboxTimeout)
+	if err != nil {
+		return err
+	}
+	n.inboxCapacity = capacity
+	n.inboxPolicy = policy
+	n.inboxTimeout = timeout
+	return nil
+}
+
 // push pushes an event to the router so that will be delivered
-// to all subscribers.
+// to all subscribers. The event is pushed into the inboxes in
+// the goroutine of the caller, so only the emitter is blocked
+// by full inboxes.
 func (n *nodeRouter) push(event Event) error {
-	op := &opPush{event, make(chan *response)}
+	op := &opPush{event, make(chan *pushResponse)}
 	n.ops <- op
 	response := <-op.response
-	return response.err
+	if response.err != nil {
+		return response.err
+	}
+	var err error
+	for _, runner := range response.runners {
+		if perr := runner.push(event); perr != nil && err == nil {
+			err = perr
+		}
+	}
+	return err
+}
+
+// agents returns the ids of all registered agents.
+func (n *nodeRouter) agents() []string {
+	op := &opAgents{make(chan []string)}
+	n.ops <- op
+	return <-op.response
+}
+
+// agentInfo returns the state of the agent with the id.
+func (n *nodeRouter) agentInfo(id string) (*AgentState, error) {
+	op := &opAgentInfo{id, make(chan *infoResponse)}
+	n.ops <- op
+	response := <-op.response
+	return response.info, response.err
+}
+
+// subscribedTopics returns all topics and topic patterns
+// with subscribers.
+func (n *nodeRouter) subscribedTopics() []string {
+	op := &opTopics{make(chan []string)}
+	n.ops <- op
+	return <-op.response
 }
 
 // stop tells the router to stop working.
@@ -373,10 +1076,22 @@ func (n *nodeRouter) stop() {
 	n.ops <- &opStop{}
 }
 
-// backend runs the endless processing loop.
+// backend runs the endless processing loop. It also publishes
+// the statistics of the agent runners via monitoring.
 func (n *nodeRouter) backend() {
 	defer n.stopAgents()
-	for next := range n.ops {
+	ticker := time.NewTicker(statisticsInterval)
+	defer ticker.Stop()
+	for {
+		var next interface{}
+		select {
+		case <-ticker.C:
+			for _, runner := range n.registry {
+				runner.publish()
+			}
+			continue
+		case next = <-n.ops:
+		}
 		switch op := next.(type) {
 		case *opRegister:
 			id := op.agent.Id()
@@ -385,7 +1100,7 @@ func (n *nodeRouter) backend() {
 				continue
 			}
 			// Regiser new agent runner.
-			n.registry[id] = newAgentRunner(op.agent)
+			n.registry[id] = newBoundedAgentRunner(op.agent, n.inboxCapacity, n.inboxPolicy, n.inboxTimeout)
 			op.response <- &response{}
 		case *opDeregister:
 			id := op.agent.Id()
@@ -397,8 +1112,9 @@ func (n *nodeRouter) backend() {
 			// Deregister and unsubscribe agent runner.
 			delete(n.registry, id)
 			runner.stop()
+			runner.publish()
 			for topic := range runner.topics {
-				delete(n.topic2Runners[topic], id)
+				n.topics.remove(topic, id)
 			}
 			op.response <- &response{}
 		case *opLookup:
@@ -417,11 +1133,11 @@ func (n *nodeRouter) backend() {
 				continue
 			}
 			// Subscribe agent runner.
-			runner.subscribe(op.topic)
-			if n.topic2Runners[op.topic] == nil {
-				n.topic2Runners[op.topic] = make(map[string]*agentRunner)
+			if err := n.topics.add(op.topic, runner); err != nil {
+				op.response <- &response{nil, err}
+				continue
 			}
-			n.topic2Runners[op.topic][id] = runner
+			runner.subscribe(op.topic)
 			op.response <- &response{}
 		case *opUnsubscribe:
 			id := op.agent.Id()
@@ -432,23 +1148,41 @@ func (n *nodeRouter) backend() {
 			}
 			// Unsubscribe agent runner.
 			runner.unsubscribe(op.topic)
-			if n.topic2Runners[op.topic] != nil {
-				delete(n.topic2Runners[op.topic], id)
-			}
-			if len(n.topic2Runners[op.topic]) == 0 {
-				delete(n.topic2Runners, op.topic)
-			}
+			n.topics.remove(op.topic, id)
 			op.response <- &response{}
 		case *opPush:
-			runners := n.topic2Runners[op.event.Topic()]
-			if runners == nil {
-				op.response <- &response{nil, &NoSubscriberError{op.event.Topic()}}
+			runners := n.topics.match(op.event.Topic())
+			if len(runners) == 0 {
+				op.response <- &pushResponse{nil, &NoSubscriberError{op.event.Topic()}}
 				continue
 			}
-			for _, runner := range runners {
-				runner.push(op.event)
+			op.response <- &pushResponse{runners, nil}
+		case *opAgents:
+			ids := []string{}
+			for id := range n.registry {
+				ids = append(ids, id)
 			}
-			op.response <- &response{}
+			op.response <- ids
+		case *opAgentInfo:
+			runner := n.registry[op.id]
+			if runner == nil {
+				op.response <- &infoResponse{nil, &AgentNotRegisteredError{op.id}}
+				continue
+			}
+			topics := []string{}
+			n.topics.each(func(topic string, runners map[string]*agentRunner) {
+				if runners[op.id] != nil {
+					topics = append(topics, topic)
+				}
+			})
+			sort.Strings(topics)
+			op.response <- &infoResponse{runner.info(topics), nil}
+		case *opTopics:
+			topics := []string{}
+			n.topics.each(func(topic string, runners map[string]*agentRunner) {
+				topics = append(topics, topic)
+			})
+			op.response <- topics
 		case *opStop:
 			return
 		}
@@ -460,6 +1194,7 @@ func (n *nodeRouter) backend() {
 func (n *nodeRouter) stopAgents() {
 	for _, runner := range n.registry {
 		runner.stop()
+		runner.publish()
 	}
 }
 
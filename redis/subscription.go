@@ -7,6 +7,14 @@
 
 package redis
 
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"sync"
+)
+
 //--------------------
 // SUBSCRIPTION VALUE
 //--------------------
@@ -46,10 +54,12 @@ func newSubscriptionValue(data [][]byte) *SubscriptionValue {
 
 // Subscription manages a subscription one or more channels in Redis.
 type Subscription struct {
+	mutex        sync.Mutex
 	urp          *unifiedRequestProtocol
 	error        error
 	channelCount int
 	valueChan    chan *SubscriptionValue
+	stopChan     chan bool
 }
 
 // newSubscription creates a new subscription.
@@ -57,6 +67,7 @@ func newSubscription(urp *unifiedRequestProtocol, channels ...string) *Subscript
 	sub := &Subscription{
 		urp:       urp,
 		valueChan: make(chan *SubscriptionValue, 10),
+		stopChan:  make(chan bool),
 	}
 	sub.channelCount = sub.urp.subscribe(channels...)
 	go sub.backend()
@@ -80,29 +91,58 @@ func (s *Subscription) ChannelCount() int {
 	return s.channelCount
 }
 
-// Values returns a channel emitting the subscription valies.
+// Values returns a channel emitting the subscription valies. It
+// is closed when the subscription is stopped or has ended with
+// an error. Slow receivers slow down the subscription, no value
+// is dropped.
 func (s *Subscription) Values() <-chan *SubscriptionValue {
 	return s.valueChan
 }
 
+// Err returns the error the subscription possibly ended with.
+func (s *Subscription) Err() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.error
+}
+
 // Stop ends the subscription..
 func (s *Subscription) Stop() {
-	s.urp.stop()
-	close(s.valueChan)
+	close(s.stopChan)
+	for {
+		select {
+		case s.urp.stopChan <- true:
+			return
+		case <-s.urp.publishedDataChan:
+			// Drop data published while stopping.
+		}
+	}
 }
 
 // backend is the serving goroutine for the subscription.
 func (s *Subscription) backend() {
-	for epd := range s.urp.publishedDataChan {
-		// Received a published data, republish
-		// as subscription value.
-		sv := newSubscriptionValue(epd.data)
-		// Send the subscription value.
+	defer close(s.valueChan)
+	for {
 		select {
-		case s.valueChan <- sv:
-			// OK.
-		default:
-			// Not sent!
+		case epd := <-s.urp.publishedDataChan:
+			if epd.err != nil {
+				// Subscription is broken.
+				s.mutex.Lock()
+				s.error = epd.err
+				s.mutex.Unlock()
+				return
+			}
+			// Received a published data, republish
+			// as subscription value.
+			sv := newSubscriptionValue(epd.data)
+			// Send the subscription value.
+			select {
+			case s.valueChan <- sv:
+				// OK.
+			case <-s.stopChan:
+				return
+			}
+		case <-s.stopChan:
 			return
 		}
 	}